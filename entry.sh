@@ -1,8 +1,8 @@
 #!/bin/bash
 
-port=${PENTADB_PORT:-'4567'}
-path=${PENTADB_PATH:-'/tmp/pentadb'}
+# the server reads PENTADB_PORT, PENTADB_PATH, PENTADB_CONFIG
+# and the other PENTADB_<SECTION>_<KEY> variables itself
 
 # exec
 server_dir="/pentadb/src/github.com/shenaishiren/pentadb/commands"
-go run ${server_dir}/server.go -p ${port} -a ${path}
\ No newline at end of file
+go run $(ls ${server_dir}/*.go | grep -v _test.go)
@@ -0,0 +1,286 @@
+// Contains the portable archive format of node backups
+
+/* BSD 3-Clause License
+
+Copyright (c) 2017, Guan Jiawen, Li Lundong
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice, this
+  list of conditions and the following disclaimer.
+
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+
+* Neither the name of the copyright holder nor the names of its
+  contributors may be used to endorse or promote products derived from
+  this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package archive
+
+import (
+	"io"
+	"fmt"
+	"hash"
+	"bufio"
+	"bytes"
+	"errors"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/binary"
+)
+
+// An archive is a stream of raw database pairs, independent of the
+// LevelDB file format:
+//
+//	magic (8 bytes)
+//	'P' | uvarint key length | key | uvarint value length | value
+//	...
+//	'E' | uvarint number of pairs | sha256 of all bytes before 'E'
+var magic = []byte("PENTADB\x01")
+
+const (
+	recordPair = 'P'
+	recordEnd  = 'E'
+)
+
+var (
+	ErrBadArchive = errors.New("archive: not a pentadb archive")
+	ErrChecksum   = errors.New("archive: checksum mismatch")
+	ErrTruncated  = errors.New("archive: truncated")
+)
+
+// What the trailer of an archive records
+type Summary struct {
+	Pairs int64
+
+	// sha256 in hex
+	Checksum string
+}
+
+type Writer struct {
+	w *bufio.Writer
+
+	sum hash.Hash
+
+	pairs int64
+
+	err error
+}
+
+// NewWriter starts an archive on `w`, Close must be called to finish it
+func NewWriter(w io.Writer) (*Writer, error) {
+	aw := &Writer{w: bufio.NewWriter(w), sum: sha256.New()}
+	aw.write(magic)
+	return aw, aw.err
+}
+
+// write and hash, the first error sticks
+func (w *Writer) write(p []byte) {
+	if w.err != nil {
+		return
+	}
+	w.sum.Write(p)
+	_, w.err = w.w.Write(p)
+}
+
+func (w *Writer) Add(key []byte, value []byte) error {
+	var buf [1 + 2 * binary.MaxVarintLen64]byte
+	buf[0] = recordPair
+	n := 1 + binary.PutUvarint(buf[1:], uint64(len(key)))
+	w.write(buf[:n])
+	w.write(key)
+	n = binary.PutUvarint(buf[:], uint64(len(value)))
+	w.write(buf[:n])
+	w.write(value)
+	w.pairs++
+	return w.err
+}
+
+// Close writes the trailer and flushes, it does not close the stream
+func (w *Writer) Close() (Summary, error) {
+	checksum := w.sum.Sum(nil)
+	var buf [1 + binary.MaxVarintLen64]byte
+	buf[0] = recordEnd
+	n := 1 + binary.PutUvarint(buf[1:], uint64(w.pairs))
+	if w.err == nil {
+		_, w.err = w.w.Write(append(buf[:n], checksum...))
+	}
+	if w.err == nil {
+		w.err = w.w.Flush()
+	}
+	return Summary{Pairs: w.pairs, Checksum: hex.EncodeToString(checksum)}, w.err
+}
+
+// A Reader returns the pairs of an archive. The checksum can only be
+// verified at the end, so pairs read must be thrown away if Next stops
+// with an error.
+type Reader struct {
+	r *bufio.Reader
+
+	sum hash.Hash
+
+	pairs int64
+
+	key, value []byte
+
+	summary Summary
+
+	err error
+}
+
+func NewReader(r io.Reader) (*Reader, error) {
+	ar := &Reader{r: bufio.NewReader(r), sum: sha256.New()}
+	head := make([]byte, len(magic))
+	if _, err := io.ReadFull(ar.r, head); err != nil || !bytes.Equal(head, magic) {
+		return nil, ErrBadArchive
+	}
+	ar.sum.Write(head)
+	return ar, nil
+}
+
+func (r *Reader) readByte() byte {
+	if r.err != nil {
+		return 0
+	}
+	b, err := r.r.ReadByte()
+	if err != nil {
+		r.err = ErrTruncated
+		return 0
+	}
+	r.sum.Write([]byte{b})
+	return b
+}
+
+func (r *Reader) readUvarint() uint64 {
+	var buf [binary.MaxVarintLen64]byte
+	for i := range buf {
+		buf[i] = r.readByte()
+		if r.err != nil {
+			return 0
+		}
+		if buf[i] < 0x80 {
+			v, _ := binary.Uvarint(buf[:i + 1])
+			return v
+		}
+	}
+	r.err = ErrBadArchive
+	return 0
+}
+
+func (r *Reader) readBytes() []byte {
+	n := r.readUvarint()
+	if r.err != nil {
+		return nil
+	}
+	// do not trust the length with a huge allocation
+	var buf bytes.Buffer
+	if _, err := io.CopyN(&buf, r.r, int64(n)); err != nil {
+		r.err = ErrTruncated
+		return nil
+	}
+	r.sum.Write(buf.Bytes())
+	return buf.Bytes()
+}
+
+// Next reads the next pair, it returns false at the end or on error
+func (r *Reader) Next() bool {
+	if r.err != nil {
+		return false
+	}
+	kind, err := r.r.ReadByte()
+	if err != nil {
+		r.err = ErrTruncated
+		return false
+	}
+	// the checksum covers everything before the end record
+	var checksum []byte
+	if kind == recordEnd {
+		checksum = r.sum.Sum(nil)
+	}
+	r.sum.Write([]byte{kind})
+	switch kind {
+	case recordPair:
+		r.key = r.readBytes()
+		r.value = r.readBytes()
+		if r.err != nil {
+			return false
+		}
+		r.pairs++
+		return true
+	case recordEnd:
+		pairs := r.readUvarint()
+		stored := make([]byte, sha256.Size)
+		if r.err == nil {
+			if _, err := io.ReadFull(r.r, stored); err != nil {
+				r.err = ErrTruncated
+			}
+		}
+		if r.err != nil {
+			return false
+		}
+		if int64(pairs) != r.pairs || !bytes.Equal(stored, checksum) {
+			r.err = ErrChecksum
+			return false
+		}
+		if _, err := r.r.ReadByte(); err != io.EOF {
+			r.err = ErrBadArchive
+			return false
+		}
+		r.summary = Summary{Pairs: r.pairs, Checksum: hex.EncodeToString(checksum)}
+		r.err = io.EOF
+		return false
+	default:
+		r.err = ErrBadArchive
+		return false
+	}
+}
+
+// Key and Value are valid until the next call of Next
+func (r *Reader) Key() []byte { return r.key }
+
+func (r *Reader) Value() []byte { return r.value }
+
+// Err returns nil once the whole archive is read and verified
+func (r *Reader) Err() error {
+	if r.err == io.EOF {
+		return nil
+	}
+	return r.err
+}
+
+// Summary is known once Next has returned false with no error
+func (r *Reader) Summary() Summary { return r.summary }
+
+// Verify reads a whole archive and checks its checksum
+func Verify(r io.Reader) (Summary, error) {
+	ar, err := NewReader(r)
+	if err != nil {
+		return Summary{}, err
+	}
+	for ar.Next() {
+	}
+	if err := ar.Err(); err != nil {
+		return Summary{}, err
+	}
+	return ar.Summary(), nil
+}
+
+func (s Summary) String() string {
+	return fmt.Sprintf("%d pairs, sha256 %s", s.Pairs, s.Checksum)
+}
@@ -0,0 +1,47 @@
+package archive
+
+import (
+	"fmt"
+	"bytes"
+	"testing"
+)
+
+func TestArchive(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for i := 0; i < 100; i++ {
+		w.Add([]byte(fmt.Sprint("key", i)), bytes.Repeat([]byte{byte(i)}, i))
+	}
+	written, err := w.Close()
+	if err != nil || written.Pairs != 100 {
+		t.Fatalf("close: %v %+v", err, written)
+	}
+
+	r, err := NewReader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	i := 0
+	for r.Next() {
+		if string(r.Key()) != fmt.Sprint("key", i) || len(r.Value()) != i {
+			t.Fatalf("pair %d is %q", i, r.Key())
+		}
+		i++
+	}
+	if err := r.Err(); err != nil || r.Summary() != written {
+		t.Fatalf("read: %v %+v, want %+v", err, r.Summary(), written)
+	}
+
+	// any flipped bit or missing byte is detected
+	corrupt := append([]byte(nil), buf.Bytes()...)
+	corrupt[len(magic) + 10] ^= 1
+	if _, err := Verify(bytes.NewReader(corrupt)); err == nil {
+		t.Fatal("corrupt archive verified")
+	}
+	if _, err := Verify(bytes.NewReader(buf.Bytes()[:buf.Len() - 1])); err != ErrTruncated {
+		t.Fatalf("truncated archive: %v", err)
+	}
+}
@@ -33,6 +33,12 @@ OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
 
 package args
 
+import "time"
+
+// keys under this prefix belong to the nodes themselves,
+// clients can neither write nor see them
+const InternalPrefix = "\xffpentadb/"
+
 type InitArgs struct {
 	Self string
 
@@ -43,15 +49,361 @@ type InitArgs struct {
 	Replicas int
 }
 
+// Header is carried by every data request
+type Header struct {
+	// how long the client is still waiting for the reply when
+	// sending the request, zero means no deadline
+	Timeout time.Duration
+
+	// unique per request and kept when it is retried,
+	// so that the server can answer a retry from cache
+	RequestID string
+}
+
+// GetHeader gives access to the header of any request embedding it
+func (h *Header) GetHeader() *Header {
+	return h
+}
+
+// Deadline returns the time after which the reply is useless,
+// `received` is when the server received the request
+func (h Header) Deadline(received time.Time) (time.Time, bool) {
+	if h.Timeout <= 0 {
+		return time.Time{}, false
+	}
+	return received.Add(h.Timeout), true
+}
+
+type KeyArgs struct {
+	Header
+
+	Key []byte
+}
+
 type KVArgs struct {
+	Header
+
 	Key []byte
 
 	Value []byte
+
+	// time to live set by the client, zero means forever
+	TTL time.Duration
+
+	// absolute expiry in unix nanoseconds, set instead of `TTL`
+	// when nodes copy pairs so that the expiry does not move
+	ExpireAt int64
 }
 
 type KVArrayArgs struct {
+	Header
+
+	KVs []KVArgs
+}
+
+type KeyArrayArgs struct {
+	Header
+
+	Keys [][]byte
+}
+
+// Reply of a read which also reports the expiry of the value
+type ValueReply struct {
+	Value []byte
+
+	// in unix nanoseconds, zero if the value never expires
+	ExpireAt int64
+}
+
+// Reply of multi-key reads, in the order of requested keys
+type ValueArrayReply struct {
+	Values [][]byte
+
+	// false if the key does not exist
+	Found []bool
+}
+
+// A range of hash values on hash ring, it is (Start, End]
+// and wraps around zero when Start >= End
+type HashRange struct {
+	Start uint32
+
+	End uint32
+}
+
+func (r HashRange) Contains(hash uint32) bool {
+	if r.Start < r.End {
+		return hash > r.Start && hash <= r.End
+	}
+	return hash > r.Start || hash <= r.End
+}
+
+type MigrateArgs struct {
+	// the node which the data is moved to
+	Target string
+
+	// keys whose hash falls into these ranges are moved
+	Ranges []HashRange
+
+	// revision of the target before the ring changed, keys the
+	// target changed after it are newer than the moved ones.
+	// Negative if unknown.
+	Since int64
+}
+
+// Pairs moved to a node, written only if the node does not have
+// a newer version of the key
+type MigratePairsArgs struct {
+	Header
+
+	// see MigrateArgs.Since
+	Since int64
+
 	KVs []KVArgs
 }
 
+type BatchOpType int
+
+const (
+	OpPut BatchOpType = iota
+	OpDelete
+)
+
+// One write in a batch
+type BatchOp struct {
+	Type BatchOpType
+
+	Key []byte
+
+	// only for OpPut
+	Value []byte
+}
+
+type BatchArgs struct {
+	Header
+
+	// applied in order, a later op on the same key wins
+	Ops []BatchOp
+}
+
+// Arguments of two-phase commit, Ops is only sent when preparing
+type TxnArgs struct {
+	Header
+
+	TxnID string
+
+	Ops []BatchOp
+}
+
+// Keys in [Start, End) which also have Prefix, nil means unbounded
+type ScanArgs struct {
+	Header
+
+	Start []byte
+
+	End []byte
+
+	Prefix []byte
+
+	// max number of pairs in reply
+	Limit int
+}
+
+type ScanReply struct {
+	// in key order, with ExpireAt set on pairs which expire
+	KVs []KVArgs
+
+	// whether more keys remain after the last one
+	More bool
+}
+
+// A write applied only if the current value matches
+type CASArgs struct {
+	Header
+
+	Key []byte
+
+	// the condition holds if the key does not exist
+	ExpectAbsent bool
+
+	// otherwise the current value must equal Expected
+	Expected []byte
+
+	// delete the key instead of writing Value
+	Delete bool
+
+	Value []byte
+}
 
+type EventType int
 
+const (
+	EventPut EventType = iota
+	EventDelete
+)
+
+// A change of one key, the revision is its sequence number
+// in the change log of the node
+type Event struct {
+	Type EventType
+
+	Key []byte
+
+	Value []byte
+
+	Revision int64
+
+	// when the change was applied, in unix nanoseconds
+	Time int64
+}
+
+// Wait for changes of keys with Prefix after revision After,
+// a negative After asks only for the current revision
+type WatchArgs struct {
+	Header
+
+	Prefix []byte
+
+	After int64
+
+	// leave out the values of puts
+	KeysOnly bool
+}
+
+type WatchReply struct {
+	Events []Event
+
+	// the changes up to this revision have been seen
+	Revision int64
+}
+
+// Read the change log from sequence number FromSeq,
+// zero means from the oldest change kept
+type ChangesArgs struct {
+	Header
+
+	FromSeq int64
+
+	Limit int
+}
+
+type ChangesReply struct {
+	Events []Event
+
+	// the last sequence number returned, or the one
+	// before FromSeq if there is no change yet
+	LastSeq int64
+}
+
+// Add Delta to the integer stored at Key
+type IncrArgs struct {
+	Header
+
+	Key []byte
+
+	Delta int64
+}
+
+type StatsArgs struct {
+	Header
+}
+
+// LevelDB settings of a node, with the defaults filled in
+type LevelDBOptions struct {
+	BlockCacheSize int
+
+	WriteBufferSize int
+
+	// zero means no bloom filter
+	BloomBitsPerKey int
+
+	// snappy or none
+	Compression string
+
+	CompactionTableSize int
+
+	OpenFilesCacheCapacity int
+}
+
+type StatsReply struct {
+	Options LevelDBOptions
+
+	// bytes used by the block cache
+	BlockCacheSize int
+
+	OpenedTables int
+
+	// bytes read from and written to files
+	IORead uint64
+
+	IOWrite uint64
+
+	// writes slowed down by compaction
+	WriteDelayCount int32
+
+	WriteDelayDuration time.Duration
+
+	// bytes and tables of each level
+	LevelSizes []int64
+
+	LevelTables []int
+
+	// the last sequence number of the change log
+	Revision int64
+}
+
+// Back up a snapshot of the node into `Dir` on the node, or keep
+// the snapshot to be read with ReadBackup if `Dir` is empty
+type BackupArgs struct {
+	Header
+
+	Dir string
+}
+
+type BackupReply struct {
+	// id of the kept snapshot
+	ID string
+
+	// the archive written in `Dir`
+	Path string
+
+	Pairs int64
+
+	// sha256 in hex of the archive written
+	Checksum string
+}
+
+type ReadBackupArgs struct {
+	Header
+
+	ID string
+
+	// read the pairs after `After`, from the first one if not `Started`
+	After []byte
+
+	Started bool
+
+	Limit int
+}
+
+// raw pairs of the database, internal keys included
+type ReadBackupReply struct {
+	KVs []KVArgs
+
+	More bool
+}
+
+// Stop the writes of a node and take a snapshot, kept to be read with
+// ReadBackup. Writes resume on Thaw or after `Hold`.
+type FreezeArgs struct {
+	Header
+
+	Hold time.Duration
+}
+
+// Write raw pairs read from a backup, expiries are kept
+type RestoreArgs struct {
+	Header
+
+	KVs []KVArgs
+}
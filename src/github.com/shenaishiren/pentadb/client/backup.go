@@ -0,0 +1,174 @@
+// Contains the backups of nodes read by Client
+
+/* BSD 3-Clause License
+
+Copyright (c) 2017, Guan Jiawen, Li Lundong
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice, this
+  list of conditions and the following disclaimer.
+
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+
+* Neither the name of the copyright holder nor the names of its
+  contributors may be used to endorse or promote products derived from
+  this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package client
+
+import (
+	"io"
+	"fmt"
+	"os"
+	"context"
+	"github.com/shenaishiren/pentadb/opt"
+	"github.com/shenaishiren/pentadb/args"
+	"github.com/shenaishiren/pentadb/archive"
+)
+
+// Backup makes the node write an archive of a snapshot of its
+// database into `dir`, a directory on the node
+func (np *NodeProxy) Backup(ctx context.Context, dir string) (*args.BackupReply, error) {
+	backupArgs := &args.BackupArgs{Header: newHeader(ctx), Dir: dir}
+	reply := new(args.BackupReply)
+	if err := np.call(ctx, "Node.Backup", backupArgs, reply); err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+// BackupTo streams an archive of a snapshot of the node to `w`. The node
+// releases the snapshot if `w` blocks for longer than opt.DefaultBackupTimeout.
+func (np *NodeProxy) BackupTo(ctx context.Context, w io.Writer) (archive.Summary, error) {
+	id, err := np.openBackup(ctx)
+	if err != nil {
+		return archive.Summary{}, err
+	}
+	return np.readBackup(ctx, id, w)
+}
+
+// BackupToFile is like BackupTo, but writes a local file which is
+// complete or missing
+func (np *NodeProxy) BackupToFile(ctx context.Context, path string) (archive.Summary, error) {
+	id, err := np.openBackup(ctx)
+	if err != nil {
+		return archive.Summary{}, err
+	}
+	return np.readBackupFile(ctx, id, path)
+}
+
+// keep a snapshot on the node and return its id
+func (np *NodeProxy) openBackup(ctx context.Context) (string, error) {
+	backupArgs := &args.BackupArgs{Header: newHeader(ctx)}
+	reply := new(args.BackupReply)
+	if err := np.call(ctx, "Node.Backup", backupArgs, reply); err != nil {
+		return "", err
+	}
+	return reply.ID, nil
+}
+
+// read a kept snapshot into an archive and release it
+func (np *NodeProxy) readBackup(ctx context.Context, id string, w io.Writer) (archive.Summary, error) {
+	defer np.releaseBackup(id)
+	aw, err := archive.NewWriter(w)
+	if err != nil {
+		return archive.Summary{}, err
+	}
+	readArgs := &args.ReadBackupArgs{ID: id}
+	for {
+		readArgs.Header = newHeader(ctx)
+		reply := new(args.ReadBackupReply)
+		if err := np.call(ctx, "Node.ReadBackup", readArgs, reply); err != nil {
+			return archive.Summary{}, err
+		}
+		for _, kv := range reply.KVs {
+			if err := aw.Add(kv.Key, kv.Value); err != nil {
+				return archive.Summary{}, err
+			}
+		}
+		if !reply.More {
+			break
+		}
+		readArgs.After, readArgs.Started = reply.KVs[len(reply.KVs) - 1].Key, true
+	}
+	return aw.Close()
+}
+
+// release a snapshot, it expires on the node anyway
+func (np *NodeProxy) releaseBackup(id string) {
+	ctx, cancel := context.WithTimeout(context.Background(), opt.DefaultTimeout)
+	defer cancel()
+	var result []byte
+	np.call(ctx, "Node.ReleaseBackup", id, &result)
+}
+
+func (np *NodeProxy) readBackupFile(ctx context.Context, id string, path string) (archive.Summary, error) {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		np.releaseBackup(id)
+		return archive.Summary{}, err
+	}
+	defer os.Remove(tmp)
+	defer f.Close()
+
+	summary, err := np.readBackup(ctx, id, f)
+	if err != nil {
+		return summary, err
+	}
+	if err := f.Sync(); err != nil {
+		return summary, err
+	}
+	if err := f.Close(); err != nil {
+		return summary, err
+	}
+	return summary, os.Rename(tmp, path)
+}
+
+// stop writes on the node and take a snapshot, see Node.Freeze
+func (np *NodeProxy) freeze(ctx context.Context) (string, error) {
+	freezeArgs := &args.FreezeArgs{Header: newHeader(ctx)}
+	reply := new(args.BackupReply)
+	if err := np.call(ctx, "Node.Freeze", freezeArgs, reply); err != nil {
+		return "", err
+	}
+	return reply.ID, nil
+}
+
+// let writes go on, the node thaws by itself if this fails. The error
+// tells whether the node was still frozen under `id` until now.
+func (np *NodeProxy) thaw(id string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), opt.DefaultTimeout)
+	defer cancel()
+	var thawed bool
+	if err := np.call(ctx, "Node.Thaw", id, &thawed); err != nil {
+		return err
+	}
+	if !thawed {
+		return fmt.Errorf("%w: node %s thawed before all nodes froze", ErrBusy, np.node.Ipaddr)
+	}
+	return nil
+}
+
+func (np *NodeProxy) restorePairs(ctx context.Context, kvs []args.KVArgs) error {
+	restoreArgs := &args.RestoreArgs{Header: newHeader(ctx), KVs: kvs}
+	var result []byte
+	return np.call(ctx, "Node.RestorePairs", restoreArgs, &result)
+}
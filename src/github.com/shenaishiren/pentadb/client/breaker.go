@@ -0,0 +1,188 @@
+// Contains the circuit breaker of NodeProxy
+
+/* BSD 3-Clause License
+
+Copyright (c) 2017, Guan Jiawen, Li Lundong
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice, this
+  list of conditions and the following disclaimer.
+
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+
+* Neither the name of the copyright holder nor the names of its
+  contributors may be used to endorse or promote products derived from
+  this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+
+
+package client
+
+import (
+	"sync"
+	"time"
+	"errors"
+	"context"
+	"github.com/shenaishiren/pentadb/opt"
+)
+
+type BreakerState int
+
+const (
+	// calls go through
+	BreakerClosed BreakerState = iota
+
+	// the node failed too often, calls fail fast
+	BreakerOpen
+
+	// one probe call goes through, it closes the breaker
+	// if it succeeds and opens it again otherwise
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// Stops calling a node which keeps failing, and lets a probe
+// through after a while to find out whether it is back
+type breaker struct {
+	ipaddr string
+
+	mu *sync.Mutex
+
+	state BreakerState
+
+	// consecutive failures while closed
+	failures int
+
+	openedAt time.Time
+
+	// a probe is in flight while half-open
+	probing bool
+
+	// changes with the state, so a call allowed under an older
+	// state cannot be taken for the probe when it completes
+	generation uint64
+
+	threshold int
+
+	openTimeout time.Duration
+}
+
+func newBreaker(ipaddr string, options *opt.ClientOptions) *breaker {
+	return &breaker{
+		ipaddr:      ipaddr,
+		mu:          new(sync.Mutex),
+		threshold:   options.GetBreakerThreshold(),
+		openTimeout: options.GetBreakerOpenTimeout(),
+	}
+}
+
+// report whether a call may go to the node, every allowed call
+// must be followed by `done` with the generation returned
+func (b *breaker) allow() (uint64, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case BreakerOpen:
+		if time.Since(b.openedAt) < b.openTimeout {
+			return 0, false
+		}
+		b.setState(BreakerHalfOpen)
+		fallthrough
+	case BreakerHalfOpen:
+		if b.probing {
+			return 0, false
+		}
+		b.probing = true
+	}
+	return b.generation, true
+}
+
+// mu must be held
+func (b *breaker) setState(state BreakerState) {
+	b.state = state
+	b.generation++
+}
+
+// record the result of an allowed call
+func (b *breaker) done(generation uint64, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// the state changed since the call was allowed, its result is
+	// stale. Only the probe is allowed while half-open.
+	if generation != b.generation {
+		return
+	}
+	probe := b.state == BreakerHalfOpen
+	if probe {
+		b.probing = false
+	}
+	switch {
+	case nodeFailed(err):
+		b.failures++
+		if probe || b.failures >= b.threshold {
+			LOG.Warningf("circuit breaker of node %s opened after %d failures", b.ipaddr, b.failures)
+			b.setState(BreakerOpen)
+			b.openedAt = time.Now()
+		}
+	case err != nil && !answered(err):
+		// the caller gave up, nothing is known about the node
+	default:
+		if b.state != BreakerClosed {
+			LOG.Infof("circuit breaker of node %s closed", b.ipaddr)
+			b.setState(BreakerClosed)
+		}
+		b.failures = 0
+	}
+}
+
+func (b *breaker) State() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// the node could not be reached or did not answer in time
+func nodeFailed(err error) bool {
+	if err == nil || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		return false
+	}
+	if errors.Is(err, errPoolClosed) {
+		return false
+	}
+	return errors.Is(err, ErrUnavailable) || errors.Is(err, ErrTimeout)
+}
+
+// the node handled the call, even if the call failed
+func answered(err error) bool {
+	return !errors.Is(err, context.DeadlineExceeded) && !errors.Is(err, context.Canceled) && !errors.Is(err, errPoolClosed)
+}
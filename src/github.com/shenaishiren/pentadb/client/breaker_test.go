@@ -0,0 +1,78 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+	"github.com/shenaishiren/pentadb/opt"
+)
+
+func TestBreaker(t *testing.T) {
+	b := newBreaker("x", &opt.ClientOptions{BreakerThreshold: 2, BreakerOpenTimeout: 20 * time.Millisecond})
+	failure := fmt.Errorf("%w: node x", ErrUnavailable)
+	call := func(err error) bool {
+		generation, ok := b.allow()
+		if !ok {
+			return false
+		}
+		b.done(generation, err)
+		return true
+	}
+	// answers of the node and given up calls keep it closed
+	call(ErrNotFound)
+	call(failure)
+	call(context.Canceled)
+	call(nil)
+	call(failure)
+	if b.State() != BreakerClosed {
+		t.Fatalf("state %s after one failure in a row", b.State())
+	}
+	call(failure)
+	if b.State() != BreakerOpen {
+		t.Fatalf("state %s after two failures in a row", b.State())
+	}
+	if call(nil) {
+		t.Fatal("open breaker let a call through")
+	}
+	// a failed probe opens it again
+	time.Sleep(30 * time.Millisecond)
+	probe, ok := b.allow()
+	if !ok {
+		t.Fatal("no probe after open timeout")
+	}
+	if _, ok := b.allow(); ok {
+		t.Fatal("second probe while half-open")
+	}
+	b.done(probe, failure)
+	if b.State() != BreakerOpen {
+		t.Fatalf("state %s after failed probe", b.State())
+	}
+	// a successful probe closes it
+	time.Sleep(30 * time.Millisecond)
+	if !call(nil) || b.State() != BreakerClosed {
+		t.Fatalf("state %s after successful probe", b.State())
+	}
+}
+
+func TestBreakerLateResult(t *testing.T) {
+	b := newBreaker("x", &opt.ClientOptions{BreakerThreshold: 1, BreakerOpenTimeout: 20 * time.Millisecond})
+	failure := fmt.Errorf("%w: node x", ErrUnavailable)
+	late, _ := b.allow()
+	failed, _ := b.allow()
+	b.done(failed, failure)
+	time.Sleep(30 * time.Millisecond)
+	probe, ok := b.allow()
+	if !ok {
+		t.Fatal("no probe after open timeout")
+	}
+	// a call allowed before the breaker opened is not the probe
+	b.done(late, nil)
+	if b.State() != BreakerHalfOpen {
+		t.Fatalf("state %s after a late success", b.State())
+	}
+	b.done(probe, nil)
+	if b.State() != BreakerClosed {
+		t.Fatalf("state %s after successful probe", b.State())
+	}
+}
@@ -0,0 +1,322 @@
+// Contains the read cache of Client
+
+/* BSD 3-Clause License
+
+Copyright (c) 2017, Guan Jiawen, Li Lundong
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice, this
+  list of conditions and the following disclaimer.
+
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+
+* Neither the name of the copyright holder nor the names of its
+  contributors may be used to endorse or promote products derived from
+  this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+
+
+package client
+
+import (
+	"sync"
+	"time"
+	"container/list"
+)
+
+type CacheStats struct {
+	Hits uint64
+
+	Misses uint64
+
+	// entries dropped to keep the cache in size
+	Evictions uint64
+
+	// entries dropped because their key changed
+	Invalidations uint64
+
+	// entries dropped because they outlived the cache ttl
+	Expirations uint64
+
+	// values not cached because their key changed while they were read,
+	// each one is a stale read prevented
+	StaleRejected uint64
+
+	// number of entries
+	Size int
+}
+
+func (s CacheStats) HitRatio() float64 {
+	if s.Hits + s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits + s.Misses)
+}
+
+type cacheEntry struct {
+	key string
+
+	value []byte
+
+	expire time.Time
+
+	// a tombstone holds no value, it remembers that the key changed
+	// while some reads were in flight
+	tombstone bool
+
+	seq uint64
+}
+
+// A bounded LRU cache of values read from nodes. Reads must be wrapped
+// in `begin` and `end`, so a value read before its key changed is not
+// cached after the invalidation arrived.
+type readCache struct {
+	mu *sync.Mutex
+
+	size int
+
+	ttl time.Duration
+
+	entries map[string]*list.Element
+
+	// most recently used first
+	lru *list.List
+
+	// counts invalidations
+	seq uint64
+
+	// reads begun before are not cached, it is raised when a tombstone
+	// is evicted or the invalidations may have been missed
+	minSeq uint64
+
+	inflight int
+
+	// no value is cached while invalidations can not arrive
+	suspended bool
+
+	stats CacheStats
+}
+
+func newReadCache(size int, ttl time.Duration) *readCache {
+	return &readCache{
+		mu:        new(sync.Mutex),
+		size:      size,
+		ttl:       ttl,
+		entries:   make(map[string]*list.Element),
+		lru:       list.New(),
+		suspended: true,
+	}
+}
+
+func (rc *readCache) get(key []byte) ([]byte, bool) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	elem, ok := rc.entries[string(key)]
+	if !ok || elem.Value.(*cacheEntry).tombstone {
+		rc.stats.Misses++
+		return nil, false
+	}
+	entry := elem.Value.(*cacheEntry)
+	if time.Now().After(entry.expire) {
+		rc.remove(elem)
+		rc.stats.Expirations++
+		rc.stats.Misses++
+		return nil, false
+	}
+	rc.lru.MoveToFront(elem)
+	rc.stats.Hits++
+	return append([]byte(nil), entry.value...), true
+}
+
+// start reading a key from its node
+func (rc *readCache) begin() uint64 {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	rc.inflight++
+	return rc.seq
+}
+
+// finish a read begun at `seq`, the value is cached if `found`, but
+// not beyond `expire` when it expires on the node, zero if it never does
+func (rc *readCache) end(key []byte, value []byte, expire time.Time, found bool, seq uint64) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	rc.inflight--
+	if !found {
+		return
+	}
+	elem, ok := rc.entries[string(key)]
+	if rc.suspended || seq < rc.minSeq || (ok && elem.Value.(*cacheEntry).seq > seq) {
+		rc.stats.StaleRejected++
+		return
+	}
+	entry := &cacheEntry{
+		key:    string(key),
+		value:  append([]byte(nil), value...),
+		expire: time.Now().Add(rc.ttl),
+		seq:    seq,
+	}
+	if !expire.IsZero() && expire.Before(entry.expire) {
+		entry.expire = expire
+	}
+	if ok {
+		elem.Value = entry
+		rc.lru.MoveToFront(elem)
+	} else {
+		rc.entries[entry.key] = rc.lru.PushFront(entry)
+	}
+	for rc.lru.Len() > rc.size {
+		back := rc.lru.Back()
+		if !back.Value.(*cacheEntry).tombstone {
+			rc.stats.Evictions++
+		}
+		rc.remove(back)
+	}
+}
+
+// drop a key which changed
+func (rc *readCache) invalidate(key []byte) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	rc.seq++
+	elem, ok := rc.entries[string(key)]
+	if ok && !elem.Value.(*cacheEntry).tombstone {
+		rc.stats.Invalidations++
+	}
+	// reads begun later see the new value
+	if rc.inflight == 0 {
+		if ok {
+			rc.remove(elem)
+		}
+		return
+	}
+	entry := &cacheEntry{key: string(key), tombstone: true, seq: rc.seq}
+	if ok {
+		elem.Value = entry
+		rc.lru.MoveToFront(elem)
+		return
+	}
+	rc.entries[entry.key] = rc.lru.PushFront(entry)
+	for rc.lru.Len() > rc.size {
+		rc.remove(rc.lru.Back())
+	}
+}
+
+// remove an entry, lock must be held
+func (rc *readCache) remove(elem *list.Element) {
+	entry := rc.lru.Remove(elem).(*cacheEntry)
+	delete(rc.entries, entry.key)
+	if entry.tombstone && entry.seq > rc.minSeq {
+		// reads begun before it can not be checked any more
+		rc.minSeq = entry.seq
+	}
+}
+
+// Drop everything and stop caching, while invalidations can not arrive
+func (rc *readCache) suspend() {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	rc.entries = make(map[string]*list.Element)
+	rc.lru.Init()
+	rc.suspended = true
+}
+
+// Cache again once invalidations arrive, reads begun before are not cached
+func (rc *readCache) resume() {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	rc.seq++
+	rc.minSeq = rc.seq
+	rc.suspended = false
+}
+
+func (rc *readCache) Stats() CacheStats {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	stats := rc.stats
+	stats.Size = rc.lru.Len()
+	return stats
+}
+
+// keep the cache consistent with the nodes, until the client is closed
+func (c *Client) invalidateLoop() {
+	for {
+		// changes are missed until the new watcher is ready
+		c.cache.suspend()
+		w := c.watch(nil, nil, true)
+		c.cache.resume()
+		c.mu.Lock()
+		c.cacheWatcher = w
+		c.mu.Unlock()
+		select {
+		case <-c.closed:
+			w.Close()
+		default:
+		}
+
+		for event := range w.Events() {
+			c.cache.invalidate(event.Key)
+		}
+		select {
+		case <-c.closed:
+			return
+		default:
+		}
+		if err := w.Err(); err != nil {
+			LOG.Warningf("cache invalidation stopped: %s", err.Error())
+		}
+	}
+}
+
+// watch the nodes of the ring again
+func (c *Client) restartInvalidation() {
+	c.mu.RLock()
+	w := c.cacheWatcher
+	c.mu.RUnlock()
+	if w != nil {
+		w.Close()
+	}
+}
+
+// drop keys written by this client, without waiting for their
+// invalidation to arrive from the nodes
+func (c *Client) invalidate(keys ...[]byte) {
+	if c.cache == nil {
+		return
+	}
+	for _, key := range keys {
+		c.cache.invalidate(key)
+	}
+}
+
+// CacheStats returns the counters of the read cache, see ClientOptions.CacheSize
+func (c *Client) CacheStats() CacheStats {
+	if c.cache == nil {
+		return CacheStats{}
+	}
+	return c.cache.Stats()
+}
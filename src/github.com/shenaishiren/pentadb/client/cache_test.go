@@ -0,0 +1,62 @@
+package client
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReadCache(t *testing.T) {
+	rc := newReadCache(2, time.Minute)
+	read := func(key string, value string) {
+		seq := rc.begin()
+		rc.end([]byte(key), []byte(value), time.Time{}, true, seq)
+	}
+	// nothing is cached until invalidations arrive
+	read("a", "1")
+	if _, ok := rc.get([]byte("a")); ok {
+		t.Fatal("cached while suspended")
+	}
+	rc.resume()
+	read("a", "1")
+	read("b", "2")
+	read("c", "3")
+	if _, ok := rc.get([]byte("a")); ok {
+		t.Fatal("least recently used key not evicted")
+	}
+	if value, ok := rc.get([]byte("c")); !ok || string(value) != "3" {
+		t.Fatalf("get c = %q, %v", value, ok)
+	}
+	rc.invalidate([]byte("c"))
+	if _, ok := rc.get([]byte("c")); ok {
+		t.Fatal("invalidated key still cached")
+	}
+	// a value read before its key changed is not cached
+	seq := rc.begin()
+	rc.invalidate([]byte("d"))
+	rc.end([]byte("d"), []byte("old"), time.Time{}, true, seq)
+	if _, ok := rc.get([]byte("d")); ok {
+		t.Fatal("stale value cached")
+	}
+	stats := rc.Stats()
+	if stats.StaleRejected != 2 || stats.Evictions != 1 || stats.Invalidations != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	if stats.HitRatio() <= 0 || stats.HitRatio() >= 1 {
+		t.Fatalf("hit ratio %f", stats.HitRatio())
+	}
+}
+
+func TestReadCacheExpire(t *testing.T) {
+	rc := newReadCache(2, time.Minute)
+	rc.resume()
+	seq := rc.begin()
+	rc.end([]byte("a"), []byte("1"), time.Now().Add(20 * time.Millisecond), true, seq)
+	if _, ok := rc.get([]byte("a")); !ok {
+		t.Fatal("value with an expiry not cached")
+	}
+	// the expiry of the value on the node wins over the cache ttl
+	time.Sleep(30 * time.Millisecond)
+	if _, ok := rc.get([]byte("a")); ok {
+		t.Fatal("expired value served from the cache")
+	}
+}
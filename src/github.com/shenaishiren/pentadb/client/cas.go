@@ -0,0 +1,81 @@
+// Contains the conditional writes of PentaDB Client
+
+/* BSD 3-Clause License
+
+Copyright (c) 2017, Guan Jiawen, Li Lundong
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice, this
+  list of conditions and the following disclaimer.
+
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+
+* Neither the name of the copyright holder nor the names of its
+  contributors may be used to endorse or promote products derived from
+  this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+
+package client
+
+import (
+	"context"
+	"github.com/shenaishiren/pentadb/args"
+)
+
+// send a conditional write to the node owning the key
+func (c *Client) compareAndSwap(ctx context.Context, casArgs *args.CASArgs) (bool, error) {
+	node, err := c.locate(casArgs.Key)
+	if err != nil {
+		return false, err
+	}
+	defer c.invalidate(casArgs.Key)
+	return node.Proxy.CompareAndSwap(ctx, casArgs)
+}
+
+// CompareAndSwap sets `key` to `value` only if it exists and equals
+// `expected`, it reports whether the value was swapped
+func (c *Client) CompareAndSwap(key []byte, expected []byte, value []byte) (bool, error) {
+	return c.CompareAndSwapContext(context.Background(), key, expected, value)
+}
+
+// CompareAndSwapContext is like CompareAndSwap, but gives up once ctx is done
+func (c *Client) CompareAndSwapContext(ctx context.Context, key []byte, expected []byte, value []byte) (bool, error) {
+	return c.compareAndSwap(ctx, &args.CASArgs{Key: key, Expected: expected, Value: value})
+}
+
+// PutIfAbsent sets `key` to `value` only if it does not exist
+func (c *Client) PutIfAbsent(key []byte, value []byte) (bool, error) {
+	return c.PutIfAbsentContext(context.Background(), key, value)
+}
+
+// PutIfAbsentContext is like PutIfAbsent, but gives up once ctx is done
+func (c *Client) PutIfAbsentContext(ctx context.Context, key []byte, value []byte) (bool, error) {
+	return c.compareAndSwap(ctx, &args.CASArgs{Key: key, ExpectAbsent: true, Value: value})
+}
+
+// DeleteIfEquals deletes `key` only if its value equals `expected`
+func (c *Client) DeleteIfEquals(key []byte, expected []byte) (bool, error) {
+	return c.DeleteIfEqualsContext(context.Background(), key, expected)
+}
+
+// DeleteIfEqualsContext is like DeleteIfEquals, but gives up once ctx is done
+func (c *Client) DeleteIfEqualsContext(ctx context.Context, key []byte, expected []byte) (bool, error) {
+	return c.compareAndSwap(ctx, &args.CASArgs{Key: key, Expected: expected, Delete: true})
+}
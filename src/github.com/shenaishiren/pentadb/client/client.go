@@ -35,15 +35,18 @@ package client
 
 import (
 	"fmt"
+	"sync"
+	"time"
+	"context"
 	"errors"
 	"github.com/shenaishiren/pentadb/opt"
+	"github.com/shenaishiren/pentadb/args"
+	"github.com/shenaishiren/pentadb/keyhash"
 	"github.com/shenaishiren/pentadb/log"
 )
 
 var LOG = log.DefaultLog
 
-const MAXN = 1024
-
 type Client struct {
 	// all nodes in hash ring
 	nodes map[string]*Node
@@ -51,11 +54,29 @@ type Client struct {
 	// hash ring
 	hashRing *HashRing
 
-	// the channel is used for checking what node is lost
-	unreachableChan chan string
+	// protect nodes and hash ring
+	mu *sync.RWMutex
+
+	options *opt.ClientOptions
+
+	// nil if there is no read cache
+	cache *readCache
+
+	// reports changes of keys to the cache
+	cacheWatcher *Watcher
+
+	// closed when the client is closed
+	closed chan struct{}
+
+	closeOnce *sync.Once
 }
 
 func NewClient(nodeIpaddrs []string, weights map[string]int, replicas int) (*Client, error) {
+	return NewClientWithOptions(nodeIpaddrs, weights, replicas, nil)
+}
+
+// NewClientWithOptions is like NewClient, nil options mean defaults
+func NewClientWithOptions(nodeIpaddrs []string, weights map[string]int, replicas int, options *opt.ClientOptions) (*Client, error) {
 	// check nodes' count
 	nodesCount := len(nodeIpaddrs)
 	// TODO
@@ -70,8 +91,13 @@ func NewClient(nodeIpaddrs []string, weights map[string]int, replicas int) (*Cli
 			fmt.Sprintf("replicas must > %d and < %d", opt.DefaultReplicas, nodesCount),
 		)
 	}
+	// see ClientOptions.HedgedReads
+	if options.GetHedgedReads() {
+		return nil, errors.New("hedged reads need replicas, which the client does not write yet")
+	}
 	// initialize hash ring
 	hashRing := NewHashRing()
+	hashRing.options = options
 	// check whether the ip address is connectable or not in `init` function
 	nodes, _ := hashRing.init(nodeIpaddrs, weights)
 	nodeDict := make(map[string]*Node)
@@ -79,75 +105,284 @@ func NewClient(nodeIpaddrs []string, weights map[string]int, replicas int) (*Cli
 	client := &Client{
 		nodes: nodeDict,
 		hashRing: hashRing,
-		unreachableChan: make(chan string, MAXN),
+		mu: new(sync.RWMutex),
+		options: options,
+		closed: make(chan struct{}),
+		closeOnce: new(sync.Once),
 	}
 	for _, node := range nodes {
 		nodeDict[node.Name] = node
 		// asynchronously
-		go node.Proxy.Init(nodeIpaddrs, replicas, client.unreachableChan)
-	}
-	// event loop about checking nodes
-	go func() {
-		for {
-			select {
-				case nodeName := <- client.unreachableChan:
-					client.RemoveNode(nodeName)
+		go func(node *Node) {
+			if err := node.Proxy.Init(nodeIpaddrs, replicas); err != nil {
+				LOG.Errorf("init node %s failed: %s", node.Ipaddr, err.Error())
 			}
-		}
-	}()
-
+		}(node)
+	}
+	if size := options.GetCacheSize(); size > 0 {
+		client.cache = newReadCache(size, options.GetCacheTTL())
+		go client.invalidateLoop()
+	}
 	return client, nil
 }
 
 func (c *Client) AddNode(nodeIpaddr string, weight int) {
+	c.mu.Lock()
+	before := c.hashRing.points()
 	node := c.hashRing.addNode(nodeIpaddr, weight)
 	if node == nil {
+		c.mu.Unlock()
 		return
 	}
-	c.nodes[nodeIpaddr] = node
-	node.Proxy.AddNode(nodeIpaddr, c.unreachableChan)
+	c.nodes[node.Name] = node
+	migrations := diffPoints(before, c.hashRing.points())
+	revisions := targetRevisions(migrations)
+	c.mu.Unlock()
+
+	if err := node.Proxy.AddNode(nodeIpaddr); err != nil {
+		LOG.Errorf("add node %s failed: %s", nodeIpaddr, err.Error())
+	}
+	c.restartInvalidation()
+	if err := c.migrate(migrations, revisions); err != nil {
+		LOG.Error("migrate data failed: ", err.Error())
+	}
 }
 
 func (c *Client) RemoveNode(nodeName string) {
+	c.mu.Lock()
 	node := c.nodes[nodeName]
-	if node != nil {
-		c.hashRing.deleteNode(node.Ipaddr, node.Weight)
-		go node.Proxy.RemoveNode(node.Ipaddr, c.unreachableChan)
-		delete(c.nodes, nodeName)
+	if node == nil {
+		c.mu.Unlock()
+		return
 	}
+	before := c.hashRing.points()
+	c.hashRing.deleteNode(node.Ipaddr)
+	delete(c.nodes, nodeName)
+	migrations := diffPoints(before, c.hashRing.points())
+	revisions := targetRevisions(migrations)
+	c.mu.Unlock()
+
+	// tell the node before closing its connections
+	if err := node.Proxy.RemoveNode(node.Ipaddr); err != nil {
+		LOG.Errorf("remove node %s failed: %s", node.Ipaddr, err.Error())
+	}
+	node.Proxy.Close()
+	c.restartInvalidation()
+	if err := c.migrate(migrations, revisions); err != nil {
+		LOG.Error("migrate data failed: ", err.Error())
+	}
+}
+
+// Change the weight of a node online, then move the data
+// of the ranges which changed owner
+func (c *Client) UpdateWeight(nodeIpaddr string, weight int) error {
+	c.mu.Lock()
+	before := c.hashRing.points()
+	if err := c.hashRing.updateWeight(nodeIpaddr, weight); err != nil {
+		c.mu.Unlock()
+		return err
+	}
+	migrations := diffPoints(before, c.hashRing.points())
+	revisions := targetRevisions(migrations)
+	c.mu.Unlock()
+
+	return c.migrate(migrations, revisions)
+}
+
+// Return the revisions of the targets of migrations, a target does not
+// overwrite keys it changed after its revision with moved ones. Called
+// before the new ring is used, so the revisions predate its writes.
+func targetRevisions(migrations []*Migration) map[*Node]int64 {
+	revisions := make(map[*Node]int64)
+	for _, m := range migrations {
+		if _, ok := revisions[m.To]; ok {
+			continue
+		}
+		// unknown, the target then keeps only the keys it has
+		revisions[m.To] = -1
+		reply, err := m.To.Proxy.Stats(context.Background())
+		if err != nil {
+			LOG.Errorf("revision of node %s unknown: %s", m.To.Ipaddr, err.Error())
+			continue
+		}
+		revisions[m.To] = reply.Revision
+	}
+	return revisions
 }
 
-func (c *Client) Put(key []byte, value []byte) {
+// ask the old owners to hand over data to the new owners,
+// return the first error but keep migrating the rest
+func (c *Client) migrate(migrations []*Migration, revisions map[*Node]int64) error {
+	var firstErr error
+	for _, m := range migrations {
+		c.mu.RLock()
+		_, ok := c.nodes[m.From.Name]
+		c.mu.RUnlock()
+		// the data on a removed node is lost
+		if !ok {
+			continue
+		}
+		err := m.From.Proxy.Migrate(m.To.Ipaddr, m.Ranges, revisions[m.To])
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// find the node which stores `key`
+func (c *Client) locate(key []byte) (*Node, error) {
+	hashKey := keyhash.Key(key)
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	vNode, err := c.hashRing.findProperNode(hashKey)
+	if err != nil {
+		return nil, err
+	}
+	return vNode.rNode, nil
+}
+
+func (c *Client) Put(key []byte, value []byte) error {
+	return c.PutContext(context.Background(), key, value)
+}
+
+// PutContext is like Put, but gives up once ctx is done
+func (c *Client) PutContext(ctx context.Context, key []byte, value []byte) error {
 	// choose a node
-	hashKey := KemataHash(Md5Hash(key), 0)
-	node, err := c.hashRing.findProperNode(hashKey)
+	node, err := c.locate(key)
 	if err != nil {
-		LOG.Error("error occurred when find proper node: ", err.Error())
-		return
+		return err
 	}
-	node.rNode.Proxy.Put(key, value, c.unreachableChan)
+	defer c.invalidate(key)
+	return node.Proxy.Put(ctx, key, value, 0)
 }
 
-func (c *Client) Get(key []byte) []byte {
-	hashKey := KemataHash(Md5Hash(key), 0)
-	node, err := c.hashRing.findProperNode(hashKey)
+// PutWithTTL writes a pair which expires after `ttl`, the expiry
+// is fixed by the node when the write arrives
+func (c *Client) PutWithTTL(key []byte, value []byte, ttl time.Duration) error {
+	return c.PutWithTTLContext(context.Background(), key, value, ttl)
+}
+
+// PutWithTTLContext is like PutWithTTL, but gives up once ctx is done
+func (c *Client) PutWithTTLContext(ctx context.Context, key []byte, value []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		return errors.New(fmt.Sprintf("invalid ttl %s", ttl))
+	}
+	node, err := c.locate(key)
 	if err != nil {
-		LOG.Error("error occurred when find proper node: ", err.Error())
-		return nil
+		return err
 	}
-	return node.rNode.Proxy.Get(key, c.unreachableChan)
+	defer c.invalidate(key)
+	return node.Proxy.Put(ctx, key, value, ttl)
+}
+
+// Get returns ErrNotFound if the key does not exist
+func (c *Client) Get(key []byte) ([]byte, error) {
+	return c.GetContext(context.Background(), key)
 }
 
-func (c *Client) Delete(key []byte) {
-	hashKey := KemataHash(Md5Hash(key), 0)
-	node, err := c.hashRing.findProperNode(hashKey)
+// GetContext is like Get, but gives up once ctx is done
+func (c *Client) GetContext(ctx context.Context, key []byte) ([]byte, error) {
+	if c.cache == nil {
+		reply, err := c.get(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		return reply.Value, nil
+	}
+	if value, ok := c.cache.get(key); ok {
+		return value, nil
+	}
+	seq := c.cache.begin()
+	reply, err := c.get(ctx, key)
 	if err != nil {
-		LOG.Error("error occurred when find proper node: ", err.Error())
-		return
+		c.cache.end(key, nil, time.Time{}, false, seq)
+		return nil, err
+	}
+	var expire time.Time
+	if reply.ExpireAt != 0 {
+		expire = time.Unix(0, reply.ExpireAt)
+	}
+	c.cache.end(key, reply.Value, expire, true, seq)
+	return reply.Value, nil
+}
+
+// read a key from the nodes, bypassing the cache
+func (c *Client) get(ctx context.Context, key []byte) (*args.ValueReply, error) {
+	if c.options.GetHedgedReads() {
+		return c.hedgedGet(ctx, key)
 	}
-	node.rNode.Proxy.Delete(key, c.unreachableChan)
+	node, err := c.locate(key)
+	if err != nil {
+		return nil, err
+	}
+	return node.Proxy.GetEntry(ctx, key)
+}
+
+func (c *Client) Delete(key []byte) error {
+	return c.DeleteContext(context.Background(), key)
+}
+
+// DeleteContext is like Delete, but gives up once ctx is done
+func (c *Client) DeleteContext(ctx context.Context, key []byte) error {
+	node, err := c.locate(key)
+	if err != nil {
+		return err
+	}
+	defer c.invalidate(key)
+	return node.Proxy.Delete(ctx, key)
+}
+
+// Run `f` with the hash ring, the ring must not be retained or modified
+func (c *Client) Inspect(f func(hr *HashRing)) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	f(c.hashRing)
 }
 
+// Stats asks every node for its LevelDB settings and counters. Nodes
+// which fail are left out and the first error is returned.
+func (c *Client) Stats(ctx context.Context) (map[string]*args.StatsReply, error) {
+	c.mu.RLock()
+	var nodes []*Node
+	for _, node := range c.nodes {
+		nodes = append(nodes, node)
+	}
+	c.mu.RUnlock()
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var firstErr error
+	stats := make(map[string]*args.StatsReply)
+	for _, node := range nodes {
+		wg.Add(1)
+		go func(node *Node) {
+			defer wg.Done()
+			reply, err := node.Proxy.Stats(ctx)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				return
+			}
+			stats[node.Ipaddr] = reply
+		}(node)
+	}
+	wg.Wait()
+	return stats, firstErr
+}
+
+// Close stops the client, closing it again does nothing
 func (c *Client) Close() {
-	close(c.unreachableChan)
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.restartInvalidation()
+		c.mu.Lock()
+		for _, node := range c.nodes {
+			node.Proxy.Close()
+		}
+		c.mu.Unlock()
+	})
 }
\ No newline at end of file
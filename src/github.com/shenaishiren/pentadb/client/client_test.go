@@ -3,7 +3,11 @@
 package client
 
 import (
+	"errors"
+	"net/rpc"
 	"testing"
+
+	nrpc "github.com/shenaishiren/pentadb/rpc"
 )
 
 //func TestNewClient_NoEnoughNodes(t *testing.T) {
@@ -28,14 +32,73 @@ func TestNewClient(t *testing.T) {
 	if len(client.nodes) != len(nodes) {
 		t.Error("wrong node number")
 	}
-	client.Put([]byte("p"), []byte("v"))
-	if value := client.Get([]byte("p")); value == nil {
-		t.Error("wrong get")
+	if err := client.Put([]byte("p"), []byte("v")); err != nil {
+		t.Error(err.Error())
+	}
+	if value, err := client.Get([]byte("p")); err != nil {
+		t.Error("wrong get: ", err.Error())
 	} else {
 		LOG.Debug("value: ", value)
 	}
 }
 
+func TestWrapError(t *testing.T) {
+	node := &Node{Ipaddr: "127.0.0.1:4567"}
+	cases := []struct {
+		err error
+		want error
+	}{
+		{rpc.ServerError(nrpc.ErrNotFound.Error()), ErrNotFound},
+		{rpc.ServerError(nrpc.ErrOverflow.Error()), ErrNotInteger},
+		{rpc.ServerError(nrpc.ErrTxnNotFound.Error()), ErrTxnAborted},
+		{rpc.ServerError("timeout occurred when: server write response"), ErrTimeout},
+		{rpc.ErrShutdown, ErrUnavailable},
+	}
+	for _, c := range cases {
+		if err := wrapError(node, c.err); !errors.Is(err, c.want) {
+			t.Errorf("wrapError(%v) = %v, want %v", c.err, err, c.want)
+		}
+	}
+	if err := wrapError(node, rpc.ServerError("leveldb: closed")); errors.Is(err, ErrUnavailable) {
+		t.Errorf("server error treated as unavailable: %v", err)
+	}
+}
 
+func TestRemoveNode(t *testing.T) {
+	nodes, fakes, closeAll := serveFakeNodes(t, 3)
+	defer closeAll()
+	c, err := NewClient(nodes, nil, 1)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer c.Close()
+	var removed *Node
+	for _, node := range c.nodes {
+		if node.Ipaddr == nodes[0] {
+			removed = node
+		}
+	}
+	c.RemoveNode(removed.Name)
 
+	// the node is told before its proxy is closed
+	fake := fakes[nodes[0]]
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	if len(fake.removed) != 1 || fake.removed[0] != nodes[0] {
+		t.Fatalf("removed node told %v", fake.removed)
+	}
+	if _, ok := c.nodes[removed.Name]; ok {
+		t.Fatal("removed node kept")
+	}
+}
 
+func TestCloseTwice(t *testing.T) {
+	nodes, _, closeAll := serveFakeNodes(t, 2)
+	defer closeAll()
+	c, err := NewClient(nodes, nil, 1)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer c.Close()
+	c.Close()
+}
@@ -0,0 +1,244 @@
+// Contains the implementation of connection pool
+// which keeps long-lived connections to a node
+
+/* BSD 3-Clause License
+
+Copyright (c) 2017, Guan Jiawen, Li Lundong
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice, this
+  list of conditions and the following disclaimer.
+
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+
+* Neither the name of the copyright holder nor the names of its
+  contributors may be used to endorse or promote products derived from
+  this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+
+package client
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+	"errors"
+	"context"
+	"net/rpc"
+	"github.com/shenaishiren/pentadb/opt"
+	nrpc "github.com/shenaishiren/pentadb/rpc"
+)
+
+var errPoolClosed = errors.New("connection pool is closed")
+
+type pooledConn struct {
+	client *rpc.Client
+
+	// number of calls in flight
+	inflight int
+
+	// when the last call finished
+	lastUsed time.Time
+}
+
+// A pool of long-lived connections to one node. Every connection is
+// a multiplexed rpc.Client, calls go to the least loaded connection and
+// a new connection is only dialed when all of them are busy.
+type connPool struct {
+	ipaddr string
+
+	size int
+
+	idleTimeout time.Duration
+
+	conns []*pooledConn
+
+	// number of connections being dialed
+	dialing int
+
+	// signaled when a dial finishes
+	dialed *sync.Cond
+
+	closed bool
+
+	// stop health checking
+	done chan struct{}
+
+	mu *sync.Mutex
+}
+
+func newConnPool(ipaddr string, options *opt.ClientOptions) *connPool {
+	mu := new(sync.Mutex)
+	pool := &connPool{
+		ipaddr:      ipaddr,
+		size:        options.GetPoolSize(),
+		idleTimeout: options.GetPoolIdleTimeout(),
+		dialed:      sync.NewCond(mu),
+		done:        make(chan struct{}),
+		mu:          mu,
+	}
+	go pool.healthCheck(options.GetHealthCheckInterval())
+	return pool
+}
+
+// take a connection, it must be handed back by `put`
+func (p *connPool) get(ctx context.Context) (*pooledConn, error) {
+	p.mu.Lock()
+	for {
+		if p.closed {
+			p.mu.Unlock()
+			return nil, errPoolClosed
+		}
+		var best *pooledConn
+		for _, pc := range p.conns {
+			if best == nil || pc.inflight < best.inflight {
+				best = pc
+			}
+		}
+		full := len(p.conns) + p.dialing >= p.size
+		if best != nil && (best.inflight == 0 || full) {
+			best.inflight++
+			p.mu.Unlock()
+			return best, nil
+		}
+		if !full {
+			break
+		}
+		// every slot is being dialed, wait for one of them
+		p.dialed.Wait()
+	}
+	p.dialing++
+	p.mu.Unlock()
+
+	// dial without holding the lock
+	dialCtx, cancel := context.WithTimeout(ctx, opt.DefaultTimeout)
+	client, err := nrpc.DialContext(dialCtx, opt.DefaultProtocol, p.ipaddr)
+	cancel()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.dialing--
+	p.dialed.Broadcast()
+	if err != nil {
+		return nil, err
+	}
+	if p.closed {
+		client.Close()
+		return nil, errPoolClosed
+	}
+	pc := &pooledConn{client: client, inflight: 1}
+	p.conns = append(p.conns, pc)
+	return pc, nil
+}
+
+// hand back a connection, `err` is the result of the call on it
+func (p *connPool) put(pc *pooledConn, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	pc.inflight--
+	pc.lastUsed = time.Now()
+	// the connection is broken, the next call dials a new one
+	if isBroken(err) {
+		p.remove(pc)
+	}
+}
+
+// remove a connection from pool and close it, lock must be held
+func (p *connPool) remove(pc *pooledConn) {
+	for i, c := range p.conns {
+		if c == pc {
+			p.conns = append(p.conns[:i], p.conns[i + 1:]...)
+			pc.client.Close()
+			return
+		}
+	}
+}
+
+// report whether the connection a call failed on can not be used anymore
+func isBroken(err error) bool {
+	if err == nil {
+		return false
+	}
+	if err == rpc.ErrShutdown || err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+	_, ok := err.(net.Error)
+	return ok
+}
+
+// close idle connections and ping the others until the pool is closed
+func (p *connPool) healthCheck(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+		}
+		var idle []*pooledConn
+		p.mu.Lock()
+		for _, pc := range append([]*pooledConn(nil), p.conns...) {
+			if pc.inflight > 0 {
+				continue
+			}
+			if time.Since(pc.lastUsed) > p.idleTimeout {
+				p.remove(pc)
+				continue
+			}
+			pc.inflight++
+			idle = append(idle, pc)
+		}
+		p.mu.Unlock()
+
+		for _, pc := range idle {
+			ctx, cancel := context.WithTimeout(context.Background(), opt.DefaultTimeout)
+			var pong []byte
+			err := nrpc.CallContext(ctx, pc.client, "Node.Ping", []byte("ping"), &pong)
+			cancel()
+			p.mu.Lock()
+			pc.inflight--
+			if isBroken(err) || err == context.DeadlineExceeded {
+				LOG.Warningf("connection to %s is broken: %s", p.ipaddr, err.Error())
+				p.remove(pc)
+			}
+			p.mu.Unlock()
+		}
+	}
+}
+
+// close all connections, calls in flight fail
+func (p *connPool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return
+	}
+	p.closed = true
+	p.dialed.Broadcast()
+	close(p.done)
+	for _, pc := range p.conns {
+		pc.client.Close()
+	}
+	p.conns = nil
+}
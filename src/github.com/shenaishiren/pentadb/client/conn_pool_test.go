@@ -0,0 +1,103 @@
+package client
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"context"
+	"net/rpc"
+
+	"github.com/shenaishiren/pentadb/opt"
+	nrpc "github.com/shenaishiren/pentadb/rpc"
+)
+
+type echoNode struct{}
+
+func (e *echoNode) Ping(payload []byte, result *[]byte) error {
+	*result = payload
+	return nil
+}
+
+// serve `echoNode` and record accepted connections
+func serveEcho(t *testing.T) (string, func() []net.Conn, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	server := rpc.NewServer()
+	server.RegisterName("Node", new(echoNode))
+	var mu sync.Mutex
+	var conns []net.Conn
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, conn)
+			mu.Unlock()
+			go server.ServeConn(conn)
+		}
+	}()
+	accepted := func() []net.Conn {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]net.Conn(nil), conns...)
+	}
+	return l.Addr().String(), accepted, func() { l.Close() }
+}
+
+func poolCall(p *connPool) error {
+	pc, err := p.get(context.Background())
+	if err != nil {
+		return err
+	}
+	var pong []byte
+	err = nrpc.CallContext(context.Background(), pc.client, "Node.Ping", []byte("ping"), &pong)
+	p.put(pc, err)
+	return err
+}
+
+func TestConnPool(t *testing.T) {
+	ipaddr, accepted, stop := serveEcho(t)
+	defer stop()
+	pool := newConnPool(ipaddr, &opt.ClientOptions{PoolSize: 2})
+	defer pool.close()
+
+	// sequential calls share one connection
+	for i := 0; i < 10; i++ {
+		if err := poolCall(pool); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	if n := len(accepted()); n != 1 {
+		t.Fatalf("dialed %d connections, want 1", n)
+	}
+	// concurrent calls never exceed the pool size
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			poolCall(pool)
+		}()
+	}
+	wg.Wait()
+	if n := len(pool.conns); n > 2 {
+		t.Fatalf("pool holds %d connections, want <= 2", n)
+	}
+	// the server drops every connection, the pool reconnects
+	for _, conn := range accepted() {
+		conn.Close()
+	}
+	failures := 0
+	for i := 0; i < 5; i++ {
+		if poolCall(pool) != nil {
+			failures++
+		}
+	}
+	if failures > 2 {
+		t.Fatalf("%d calls failed after reconnect", failures)
+	}
+}
@@ -0,0 +1,73 @@
+// Contains the atomic counters of Client
+
+/* BSD 3-Clause License
+
+Copyright (c) 2017, Guan Jiawen, Li Lundong
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice, this
+  list of conditions and the following disclaimer.
+
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+
+* Neither the name of the copyright holder nor the names of its
+  contributors may be used to endorse or promote products derived from
+  this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+
+
+package client
+
+import (
+	"fmt"
+	"math"
+	"context"
+)
+
+// Incr adds `delta` to the int64 counter at `key` on the node owning it
+// and returns the new value. Counters are stored as decimal strings,
+// so Get returns them readable, and a missing key counts as 0.
+// ErrNotInteger is returned if the value is not a counter.
+func (c *Client) Incr(key []byte, delta int64) (int64, error) {
+	return c.IncrContext(context.Background(), key, delta)
+}
+
+// IncrContext is like Incr, but gives up once ctx is done
+func (c *Client) IncrContext(ctx context.Context, key []byte, delta int64) (int64, error) {
+	node, err := c.locate(key)
+	if err != nil {
+		return 0, err
+	}
+	defer c.invalidate(key)
+	return node.Proxy.Incr(ctx, key, delta)
+}
+
+// Decr subtracts `delta` from the counter at `key`, see Incr
+func (c *Client) Decr(key []byte, delta int64) (int64, error) {
+	return c.DecrContext(context.Background(), key, delta)
+}
+
+// DecrContext is like Decr, but gives up once ctx is done
+func (c *Client) DecrContext(ctx context.Context, key []byte, delta int64) (int64, error) {
+	if delta == math.MinInt64 {
+		return 0, fmt.Errorf("%w: can not negate %d", ErrNotInteger, delta)
+	}
+	return c.IncrContext(ctx, key, -delta)
+}
@@ -0,0 +1,136 @@
+// Contains the errors returned by PentaDB Client
+
+/* BSD 3-Clause License
+
+Copyright (c) 2017, Guan Jiawen, Li Lundong
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice, this
+  list of conditions and the following disclaimer.
+
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+
+* Neither the name of the copyright holder nor the names of its
+  contributors may be used to endorse or promote products derived from
+  this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+
+package client
+
+import (
+	"net"
+	"context"
+	"fmt"
+	"errors"
+	"net/rpc"
+	nrpc "github.com/shenaishiren/pentadb/rpc"
+)
+
+// Errors returned by data methods of Client, they may be wrapped
+// with the node and the cause, so test them with `errors.Is`
+var (
+	// the key does not exist
+	ErrNotFound = errors.New("pentadb: key not found")
+
+	// the node can not be reached or the connection broke
+	ErrUnavailable = errors.New("pentadb: node unavailable")
+
+	// the circuit breaker of the node is open, it wraps ErrUnavailable.
+	// Calls failing with it are not retried.
+	ErrCircuitOpen = fmt.Errorf("%w: circuit breaker open", ErrUnavailable)
+
+	// the node did not answer in time
+	ErrTimeout = errors.New("pentadb: timeout")
+
+	// there is no node in hash ring
+	ErrNoNodes = errors.New("pentadb: no node in hash ring")
+
+	// a write batch spans several nodes, see ClientOptions.CrossShardTxn
+	ErrCrossShard = errors.New("pentadb: write batch spans multiple nodes")
+
+	// another transaction holds some of the keys
+	ErrConflict = errors.New("pentadb: transaction conflict")
+
+	// a node dropped a prepared transaction before it was committed,
+	// the transaction expired or the node restarted
+	ErrTxnAborted = errors.New("pentadb: transaction aborted by node")
+
+	// the value of a counter is not a decimal int64, or would overflow
+	ErrNotInteger = errors.New("pentadb: value is not an integer")
+
+	// a node no longer keeps the changes a watcher resumes from
+	ErrCompacted = errors.New("pentadb: revision compacted")
+
+	// the snapshot of a backup was released, or read for too long ago
+	ErrBackupNotFound = errors.New("pentadb: backup not found")
+
+	// a node cannot freeze for a snapshot now, because it is frozen
+	// already or has prepared transactions. Or it refuses a write to
+	// a key it is migrating to a new owner, the ring changed meanwhile,
+	// or to a key locked by a prepared transaction.
+	ErrBusy = errors.New("pentadb: node is busy")
+)
+
+// translate an error of rpc layer into one of the errors above
+func wrapError(node *Node, err error) error {
+	if err == nil {
+		return nil
+	}
+	if nrpc.IsError(err, nrpc.ErrNotFound) {
+		return ErrNotFound
+	}
+	if nrpc.IsError(err, nrpc.ErrNotInteger) || nrpc.IsError(err, nrpc.ErrOverflow) {
+		return fmt.Errorf("%w: node %s: %v", ErrNotInteger, node.Ipaddr, err)
+	}
+	if nrpc.IsError(err, nrpc.ErrCompacted) {
+		return fmt.Errorf("%w: node %s", ErrCompacted, node.Ipaddr)
+	}
+	if nrpc.IsError(err, nrpc.ErrBackupNotFound) {
+		return fmt.Errorf("%w: node %s", ErrBackupNotFound, node.Ipaddr)
+	}
+	if nrpc.IsError(err, nrpc.ErrBusy) {
+		return fmt.Errorf("%w: node %s", ErrBusy, node.Ipaddr)
+	}
+	if nrpc.IsError(err, nrpc.ErrTxnConflict) {
+		return fmt.Errorf("%w: node %s", ErrConflict, node.Ipaddr)
+	}
+	if nrpc.IsError(err, nrpc.ErrTxnNotFound) {
+		return fmt.Errorf("%w: node %s", ErrTxnAborted, node.Ipaddr)
+	}
+	// keep the context error, so both ErrTimeout and
+	// context.DeadlineExceeded can be tested
+	if err == context.DeadlineExceeded {
+		return fmt.Errorf("%w: node %s: %w", ErrTimeout, node.Ipaddr, err)
+	}
+	if err == context.Canceled {
+		return err
+	}
+	if nrpc.IsError(err, nrpc.ErrTimeout) || nrpc.IsError(err, nrpc.ErrDeadlineExceeded) {
+		return fmt.Errorf("%w: node %s: %v", ErrTimeout, node.Ipaddr, err)
+	}
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return fmt.Errorf("%w: node %s: %v", ErrTimeout, node.Ipaddr, err)
+	}
+	// the server handled the call but failed
+	if _, ok := err.(rpc.ServerError); ok {
+		return fmt.Errorf("node %s: %v", node.Ipaddr, err)
+	}
+	return fmt.Errorf("%w: node %s: %v", ErrUnavailable, node.Ipaddr, err)
+}
@@ -0,0 +1,259 @@
+// Contains the asynchronous calls of Client
+
+/* BSD 3-Clause License
+
+Copyright (c) 2017, Guan Jiawen, Li Lundong
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice, this
+  list of conditions and the following disclaimer.
+
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+
+* Neither the name of the copyright holder nor the names of its
+  contributors may be used to endorse or promote products derived from
+  this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+
+
+package client
+
+import (
+	"fmt"
+	"sync"
+	"context"
+	"net/rpc"
+	"github.com/shenaishiren/pentadb/args"
+)
+
+// The result of an asynchronous call, which is ready once Done is closed
+type Future struct {
+	done chan struct{}
+
+	value []byte
+
+	err error
+}
+
+func newFuture() *Future {
+	return &Future{done: make(chan struct{})}
+}
+
+func (f *Future) resolve(value []byte, err error) {
+	f.value, f.err = value, err
+	close(f.done)
+}
+
+func (f *Future) Done() <-chan struct{} { return f.done }
+
+// Wait blocks until the call finishes and returns its error
+func (f *Future) Wait() error {
+	<-f.done
+	return f.err
+}
+
+// WaitContext is like Wait, but gives up once ctx is done,
+// the call itself goes on
+func (f *Future) WaitContext(ctx context.Context) error {
+	select {
+	case <-f.done:
+		return f.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Value blocks until the call finishes, it is the value of a get
+func (f *Future) Value() ([]byte, error) {
+	<-f.done
+	return f.value, f.err
+}
+
+func failedFuture(err error) *Future {
+	future := newFuture()
+	future.resolve(nil, err)
+	return future
+}
+
+type pendingCall struct {
+	conn *pooledConn
+
+	future *Future
+
+	// of the breaker when the call was allowed
+	generation uint64
+}
+
+// Sends calls without waiting for them. Many calls share each pooled
+// connection, and one goroutine per node hands their results to the
+// futures as they come back.
+type asyncCaller struct {
+	node *Node
+
+	pool *connPool
+
+	breaker *breaker
+
+	// completed calls, large enough for every call in flight,
+	// net/rpc drops results it can not send
+	done chan *rpc.Call
+
+	// one token per call in flight
+	slots chan struct{}
+
+	// pending calls by their reply, which is unique per call
+	pending map[*[]byte]*pendingCall
+
+	stopped bool
+
+	stop chan struct{}
+
+	mu *sync.Mutex
+}
+
+func newAsyncCaller(node *Node, pool *connPool, breaker *breaker, maxInFlight int) *asyncCaller {
+	ac := &asyncCaller{
+		node:    node,
+		pool:    pool,
+		breaker: breaker,
+		done:    make(chan *rpc.Call, maxInFlight),
+		slots:   make(chan struct{}, maxInFlight),
+		pending: make(map[*[]byte]*pendingCall),
+		stop:    make(chan struct{}),
+		mu:      new(sync.Mutex),
+	}
+	go ac.dispatch()
+	return ac
+}
+
+// start `serviceMethod` on the node, blocks while too many calls are in flight
+func (ac *asyncCaller) call(serviceMethod string, args interface{}) *Future {
+	select {
+	case ac.slots <- struct{}{}:
+	case <-ac.stop:
+		return failedFuture(ac.unavailable(errPoolClosed))
+	}
+	generation, ok := ac.breaker.allow()
+	if !ok {
+		<-ac.slots
+		return failedFuture(fmt.Errorf("%w: node %s", ErrCircuitOpen, ac.node.Ipaddr))
+	}
+	conn, err := ac.pool.get(context.Background())
+	if err != nil {
+		<-ac.slots
+		err = ac.unavailable(err)
+		ac.breaker.done(generation, err)
+		return failedFuture(err)
+	}
+	future := newFuture()
+	reply := new([]byte)
+	ac.mu.Lock()
+	if ac.stopped {
+		ac.mu.Unlock()
+		ac.pool.put(conn, nil)
+		<-ac.slots
+		err := ac.unavailable(errPoolClosed)
+		ac.breaker.done(generation, err)
+		return failedFuture(err)
+	}
+	ac.pending[reply] = &pendingCall{conn: conn, future: future, generation: generation}
+	ac.mu.Unlock()
+
+	conn.client.Go(serviceMethod, args, reply, ac.done)
+	return future
+}
+
+// hand results to futures until closed
+func (ac *asyncCaller) dispatch() {
+	for {
+		select {
+		case call := <-ac.done:
+			reply := call.Reply.(*[]byte)
+			ac.mu.Lock()
+			pc, ok := ac.pending[reply]
+			delete(ac.pending, reply)
+			ac.mu.Unlock()
+			if !ok {
+				continue
+			}
+			ac.pool.put(pc.conn, call.Error)
+			<-ac.slots
+			err := wrapError(ac.node, call.Error)
+			ac.breaker.done(pc.generation, err)
+			pc.future.resolve(*reply, err)
+		case <-ac.stop:
+			// calls still pending are given up
+			ac.mu.Lock()
+			for reply, pc := range ac.pending {
+				delete(ac.pending, reply)
+				err := ac.unavailable(errPoolClosed)
+				ac.breaker.done(pc.generation, err)
+				pc.future.resolve(nil, err)
+			}
+			ac.mu.Unlock()
+			return
+		}
+	}
+}
+
+func (ac *asyncCaller) unavailable(err error) error {
+	return fmt.Errorf("%w: node %s: %w", ErrUnavailable, ac.node.Ipaddr, err)
+}
+
+func (ac *asyncCaller) close() {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	// no call is added once stopped, so the dispatcher gives up all
+	if !ac.stopped {
+		ac.stopped = true
+		close(ac.stop)
+	}
+}
+
+// PutAsync is like Put, but returns at once. Calls to a node are sent
+// in order over shared connections, up to ClientOptions.MaxInFlight
+// of them at a time, and may finish in any order.
+func (c *Client) PutAsync(key []byte, value []byte) *Future {
+	node, err := c.locate(key)
+	if err != nil {
+		return failedFuture(err)
+	}
+	kvArgs := &args.KVArgs{Key: key, Value: value}
+	return node.Proxy.async.call("Node.Put", kvArgs)
+}
+
+// GetAsync is like Get, but returns at once, see PutAsync.
+// Future.Value returns the value.
+func (c *Client) GetAsync(key []byte) *Future {
+	node, err := c.locate(key)
+	if err != nil {
+		return failedFuture(err)
+	}
+	return node.Proxy.async.call("Node.Get", &args.KeyArgs{Key: key})
+}
+
+// DeleteAsync is like Delete, but returns at once, see PutAsync
+func (c *Client) DeleteAsync(key []byte) *Future {
+	node, err := c.locate(key)
+	if err != nil {
+		return failedFuture(err)
+	}
+	return node.Proxy.async.call("Node.Delete", &args.KeyArgs{Key: key})
+}
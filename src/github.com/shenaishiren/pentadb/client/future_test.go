@@ -0,0 +1,39 @@
+package client
+
+import (
+	"fmt"
+	"testing"
+	"github.com/shenaishiren/pentadb/opt"
+)
+
+func TestAsyncCaller(t *testing.T) {
+	ipaddr, accepted, stop := serveEcho(t)
+	defer stop()
+	node := &Node{Name: "echo", Ipaddr: ipaddr}
+	pool := newConnPool(ipaddr, &opt.ClientOptions{PoolSize: 2})
+	defer pool.close()
+	ac := newAsyncCaller(node, pool, newBreaker(ipaddr, nil), 8)
+
+	// many more calls than slots are in flight without blocking forever
+	futures := make([]*Future, 1000)
+	for i := range futures {
+		futures[i] = ac.call("Node.Ping", []byte(fmt.Sprint(i)))
+	}
+	for i, future := range futures {
+		value, err := future.Value()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if string(value) != fmt.Sprint(i) {
+			t.Fatalf("future %d got %q", i, value)
+		}
+	}
+	if n := len(accepted()); n > 2 {
+		t.Fatalf("dialed %d connections, want <= 2", n)
+	}
+	// calls after close fail at once
+	ac.close()
+	if err := ac.call("Node.Ping", []byte("late")).Wait(); err == nil {
+		t.Fatal("call after close succeeded")
+	}
+}
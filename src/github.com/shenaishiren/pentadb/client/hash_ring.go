@@ -35,12 +35,17 @@ OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
 package client
 
 import (
+	"fmt"
 	"math/rand"
 	"math"
+	"sort"
 	"errors"
 	"bytes"
 	"strings"
 	"github.com/seiflotfy/cuckoofilter"
+	"github.com/shenaishiren/pentadb/args"
+	"github.com/shenaishiren/pentadb/keyhash"
+	"github.com/shenaishiren/pentadb/opt"
 )
 
 const (
@@ -62,10 +67,34 @@ type HashRing struct {
 	header *VNode                     // point to server skip-list
 	level int                         // the level of skip-list
 	length int                        // number of nodes
-	averageWeight float64             // total weight of nodes in hash ring
+	totalWeight int                   // total weight of nodes in hash ring
+	averageWeight float64             // average weight of nodes in hash ring
+	nodes map[string]*Node            // real nodes in hash ring, keyed by ipaddr
+	options *opt.ClientOptions        // options for proxies of new nodes
 	filter *cuckoofilter.CuckooFilter // cuckoo filter, ensure every node is unique
 }
 
+// A position on the ring, used to compare the ring before
+// and after a membership or weight change
+type ringPoint struct {
+	Hash uint32
+	Node *Node
+}
+
+// A virtual node as shown to users, see `VNodes`
+type VNodeInfo struct {
+	Hash uint32
+	Ipaddr string
+}
+
+// Keys whose hash falls into `Ranges` have to be moved
+// from node `From` to node `To`
+type Migration struct {
+	From *Node
+	To *Node
+	Ranges []args.HashRange
+}
+
 func NewVNode(node *Node, hash uint32, level int) *VNode {
 	return &VNode {
 		Hash:    hash,
@@ -74,12 +103,36 @@ func NewVNode(node *Node, hash uint32, level int) *VNode {
 	}
 }
 
+// Build a hash ring from the given nodes, unreachable nodes are skipped
+func BuildHashRing(nodes []string, weights map[string]int) (*HashRing, error) {
+	hr := NewHashRing()
+	if rNodes, _ := hr.init(nodes, weights); len(rNodes) == 0 {
+		return nil, errors.New("no reachable node")
+	}
+	return hr, nil
+}
+
+// Lay out the ring of nodes with the given weights like a client would,
+// without connecting to them, to find out which node owned a key
+func layoutHashRing(weights map[string]int) *HashRing {
+	hr := NewHashRing()
+	for ipaddr, weight := range weights {
+		hr.nodes[ipaddr] = &Node{Ipaddr: ipaddr, Weight: weight}
+		hr.totalWeight += weight
+	}
+	hr.updateAverageWeight()
+	hr.rebalance()
+	return hr
+}
+
 func NewHashRing() *HashRing {
 	return &HashRing{
 		rnd:            rand.New(rand.NewSource(0xdeadbeef)),
 		level:          1,
 		length:         0,
+		totalWeight:    0,
 		averageWeight:  0,
+		nodes:          make(map[string]*Node),
 		header:         NewVNode(nil,0, maxLevel),
 		filter:         cuckoofilter.NewCuckooFilter(100),
 	}
@@ -87,12 +140,24 @@ func NewHashRing() *HashRing {
 
 // Get the count of virtual nodes
 func (hr *HashRing) getVNodeCount(weight int) int {
+	if hr.averageWeight == 0 {
+		return 0
+	}
 	return int(math.Floor(float64(defaultFactor * weight) / hr.averageWeight))
 }
 
+// recalculate the average weight after the total weight
+// or the number of nodes changed
+func (hr *HashRing) updateAverageWeight() {
+	if len(hr.nodes) == 0 {
+		hr.averageWeight = 0
+		return
+	}
+	hr.averageWeight = float64(hr.totalWeight) / float64(len(hr.nodes))
+}
+
 // create a hash ring
 func (hr *HashRing) init(nodes []string, weights map[string]int) ([]*Node, error) {
-	nodesCount := len(nodes)
 	// check weights and initialize it
 	if len(weights) == 0 {
 		weights = make(map[string]int)
@@ -100,23 +165,22 @@ func (hr *HashRing) init(nodes []string, weights map[string]int) ([]*Node, error
 			weights[node] = defaultWeight
 		}
 	}
-	// calculate total weight
-	totalWeight := 0
-	for _, weight := range weights {
-		totalWeight += weight
-	}
-	hr.averageWeight = float64(totalWeight) / float64(nodesCount)
 	// generate ring
 	var rNodes []*Node
 	for _, node := range nodes {
-		weight := weights[node]
-		rNode := hr.addNode(node, weight)
+		weight, ok := weights[node]
+		if !ok {
+			weight = defaultWeight
+		}
+		rNode := hr.join(node, weight)
 		// initialization failed
 		if rNode == nil {
 			continue
 		}
 		rNodes = append(rNodes, rNode)
 	}
+	// place virtual nodes once all weights are known
+	hr.rebalance()
 	return rNodes, nil
 }
 
@@ -179,31 +243,90 @@ func (hr *HashRing) genKey(v ...string) []byte {
 	return b.Bytes()
 }
 
-func (hr *HashRing) addNode(nodeIpaddr string, weight int) *Node {
+// join a node without placing its virtual nodes,
+// the caller should rebalance the ring afterwards
+func (hr *HashRing) join(nodeIpaddr string, weight int) *Node {
 	// check whether exist or not
 	nodeIp := strings.Split(nodeIpaddr, ":")[0]
 	if hr.filter.Lookup([]byte(nodeIp)) {
 		return nil
 	}
-	rNode := NewNode(nodeIpaddr, weight)
+	rNode := newNode(nodeIpaddr, weight, hr.options)
 	if rNode == nil {
 		return nil
 	}
 	// add to bloom filter
 	hr.filter.Insert([]byte(nodeIp))
-	vNodeCount := hr.getVNodeCount(weight)
-	// four virtual nodes per group
-	for i := 0; i < vNodeCount / 4; i++ {
-		hashKey := Md5Hash(hr.genKey(nodeIpaddr, string(i)))
-		for j := 0; j < 4; j++ {
-			key := KemataHash(hashKey, j)
+	hr.nodes[nodeIpaddr] = rNode
+	hr.totalWeight += weight
+	hr.updateAverageWeight()
+	return rNode
+}
+
+func (hr *HashRing) addNode(nodeIpaddr string, weight int) *Node {
+	rNode := hr.join(nodeIpaddr, weight)
+	if rNode == nil {
+		return nil
+	}
+	// the average weight changed, so does the share of every node
+	hr.rebalance()
+	return rNode
+}
+
+// set the weight of an existing node, only the virtual nodes
+// that differ from the current layout are added or removed
+func (hr *HashRing) updateWeight(nodeIpaddr string, weight int) error {
+	rNode, ok := hr.nodes[nodeIpaddr]
+	if !ok {
+		return errors.New(fmt.Sprintf("node %s is not in hash ring", nodeIpaddr))
+	}
+	if weight <= 0 {
+		return errors.New(fmt.Sprintf("weight must be > 0, got %d", weight))
+	}
+	hr.totalWeight += weight - rNode.Weight
+	rNode.Weight = weight
+	hr.updateAverageWeight()
+	hr.rebalance()
+	return nil
+}
+
+// make every node own exactly as many virtual nodes as its weight demands
+func (hr *HashRing) rebalance() {
+	for _, rNode := range hr.nodes {
+		// four virtual nodes per group
+		hr.setGroups(rNode, hr.getVNodeCount(rNode.Weight) / 4)
+	}
+}
+
+// grow or shrink the virtual node groups of `rNode` to `groups`,
+// groups are numbered, so the same weight always yields the same positions
+func (hr *HashRing) setGroups(rNode *Node, groups int) {
+	for rNode.groups < groups {
+		for _, key := range hr.groupKeys(rNode, rNode.groups) {
 			hr.insertNode(rNode, key)
 		}
+		rNode.groups++
 	}
-	return rNode
+	for rNode.groups > groups {
+		rNode.groups--
+		for _, key := range hr.groupKeys(rNode, rNode.groups) {
+			hr.removeNode(rNode, key)
+		}
+	}
+}
+
+// hash values of the i-th group of virtual nodes
+func (hr *HashRing) groupKeys(rNode *Node, i int) []uint32 {
+	hashKey := Md5Hash(hr.genKey(rNode.Ipaddr, string(rune(i))))
+	keys := make([]uint32, 4)
+	for j := 0; j < 4; j++ {
+		keys[j] = KemataHash(hashKey, j)
+	}
+	return keys
 }
 
-func (hr *HashRing) removeNode(hash uint32) {
+// remove the virtual node of `rNode` whose hash is `hash`
+func (hr *HashRing) removeNode(rNode *Node, hash uint32) {
 	node := hr.header
 	update := make(map[int]*VNode)
 	for i := hr.level - 1; i >= 0; i-- {
@@ -212,9 +335,21 @@ func (hr *HashRing) removeNode(hash uint32) {
 		}
 		update[i] = node
 	}
-	// remove current server
-	for i := hr.level - 1; i >= 0; i-- {
-		update[i].Forward[i] = update[i].Forward[i].Forward[i]
+	// virtual nodes of different servers may share a hash
+	target := node.Forward[0]
+	for target != nil && target.Hash == hash && target.rNode != rNode {
+		target = target.Forward[0]
+	}
+	if target == nil || target.Hash != hash {
+		return
+	}
+	// unlink target on every level it appears
+	for i := 0; i < len(target.Forward); i++ {
+		prev := update[i]
+		for prev.Forward[i] != target {
+			prev = prev.Forward[i]
+		}
+		prev.Forward[i] = target.Forward[i]
 	}
 	// remove invalid level
 	for hr.level > 1 && hr.header.Forward[hr.level - 1] == nil {
@@ -228,34 +363,32 @@ func (hr *HashRing) deleteVnode(node *VNode) {
 	if node == nil {
 		return
 	}
-	hr.removeNode(node.Hash)
+	hr.removeNode(node.rNode, node.Hash)
 }
 
-func (hr *HashRing) deleteNode(nodeIpaddr string, weight int) {
+func (hr *HashRing) deleteNode(nodeIpaddr string) {
 	// if not exist, return at once
-	nodeIp := strings.Split(nodeIpaddr, ":")[0]
-	if !hr.filter.Lookup([]byte(nodeIp)) {
+	rNode, ok := hr.nodes[nodeIpaddr]
+	if !ok {
 		return
 	}
 	// delete node from cuckoo filter
+	nodeIp := strings.Split(nodeIpaddr, ":")[0]
 	hr.filter.Delete([]byte(nodeIp))
 
-	// do delete
-	vNodeCount := hr.getVNodeCount(weight)
-	for i := 0; i < vNodeCount / 4; i++ {
-		hashKey := Md5Hash(hr.genKey(nodeIpaddr, string(i)))
-		for j := 0; j < 4; j++ {
-			key := KemataHash(hashKey, j)
-			hr.removeNode(key)
-		}
-	}
+	// do delete, the caller closes the proxy
+	hr.setGroups(rNode, 0)
+	delete(hr.nodes, nodeIpaddr)
+	hr.totalWeight -= rNode.Weight
+	hr.updateAverageWeight()
+	hr.rebalance()
 }
 
 // find a proper server for data
 func (hr *HashRing) findProperNode(hashKey uint32) (*VNode, error) {
 	// the hashKey is hash value of data, instead of node's
 	if hr.header.Forward[0] == nil {
-		return nil, errors.New("no node in this hash ring")
+		return nil, ErrNoNodes
 	}
 	node := hr.header
 	for i := hr.level - 1; i >= 0; i-- {
@@ -263,13 +396,97 @@ func (hr *HashRing) findProperNode(hashKey uint32) (*VNode, error) {
 			node = node.Forward[i]
 		}
 	}
+	// the first virtual node whose hash >= hashKey owns the data
+	node = node.Forward[0]
 	// arrive the end, turn to head
-	if node.Forward[0] == nil {
+	if node == nil {
 		node = hr.header.Forward[0]
 	}
 	return node, nil
 }
 
+// Return the node which stores `key`
+func (hr *HashRing) Owner(key []byte) (*Node, error) {
+	vNode, err := hr.findProperNode(keyhash.Key(key))
+	if err != nil {
+		return nil, err
+	}
+	return vNode.rNode, nil
+}
+
+// Return at most `n` distinct nodes for `key`, walking clockwise
+// from its owner, the first one is the owner
+func (hr *HashRing) PreferenceList(key []byte, n int) ([]*Node, error) {
+	vNode, err := hr.findProperNode(keyhash.Key(key))
+	if err != nil {
+		return nil, err
+	}
+	if n > len(hr.nodes) {
+		n = len(hr.nodes)
+	}
+	var nodes []*Node
+	seen := make(map[*Node]bool)
+	for p := vNode; len(nodes) < n; p = p.Forward[0] {
+		// arrive the end, turn to head
+		if p == nil {
+			p = hr.header.Forward[0]
+		}
+		if !seen[p.rNode] {
+			seen[p.rNode] = true
+			nodes = append(nodes, p.rNode)
+		}
+	}
+	return nodes, nil
+}
+
+// Return the percentage of hash space owned by each node, keyed by ipaddr
+func (hr *HashRing) Ownership() map[string]float64 {
+	ownership := make(map[string]float64)
+	for ipaddr := range hr.nodes {
+		ownership[ipaddr] = 0
+	}
+	first := hr.header.Forward[0]
+	if first == nil {
+		return ownership
+	}
+	// find the last virtual node, the first one owns the range after it
+	last := first
+	for last.Forward[0] != nil {
+		last = last.Forward[0]
+	}
+	const space = float64(math.MaxUint32) + 1
+	prev := last
+	hr.Iter(func(v *VNode) {
+		// unsigned subtraction wraps around zero as the ring does
+		size := float64(v.Hash - prev.Hash)
+		if v == prev {
+			size = space
+		}
+		ownership[v.rNode.Ipaddr] += size / space * 100
+		prev = v
+	})
+	return ownership
+}
+
+// Return all virtual nodes in ring order
+func (hr *HashRing) VNodes() []VNodeInfo {
+	vNodes := make([]VNodeInfo, 0, hr.length)
+	hr.Iter(func(v *VNode) {
+		vNodes = append(vNodes, VNodeInfo{Hash: v.Hash, Ipaddr: v.rNode.Ipaddr})
+	})
+	return vNodes
+}
+
+// Return all real nodes in hash ring
+func (hr *HashRing) Nodes() []*Node {
+	nodes := make([]*Node, 0, len(hr.nodes))
+	for _, node := range hr.nodes {
+		nodes = append(nodes, node)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Ipaddr < nodes[j].Ipaddr })
+	return nodes
+}
+
 // for debug
 // iterate this ring
 func (hr *HashRing) Iter(f func(*VNode)) {
@@ -280,4 +497,87 @@ func (hr *HashRing) Iter(f func(*VNode)) {
 }
 
 // return the first virtual node in this ring
-func (hr *HashRing) First() *VNode { return hr.header.Forward[0] }
\ No newline at end of file
+func (hr *HashRing) First() *VNode { return hr.header.Forward[0] }
+
+// take a snapshot of the ring positions
+func (hr *HashRing) points() []ringPoint {
+	points := make([]ringPoint, 0, hr.length)
+	hr.Iter(func(v *VNode) {
+		points = append(points, ringPoint{Hash: v.Hash, Node: v.rNode})
+	})
+	return points
+}
+
+// the node owning `hash` in a snapshot, same rule as `findProperNode`
+func ownerOf(points []ringPoint, hash uint32) *Node {
+	i := sort.Search(len(points), func(i int) bool {
+		return points[i].Hash >= hash
+	})
+	if i == len(points) {
+		i = 0
+	}
+	return points[i].Node
+}
+
+// compare two snapshots of the ring and return the ranges
+// whose owner changed, grouped by source and destination
+func diffPoints(before, after []ringPoint) []*Migration {
+	if len(before) == 0 || len(after) == 0 {
+		return nil
+	}
+	// every position of both rings bounds a range that
+	// has one owner before and one owner after
+	var bounds []uint32
+	for _, p := range before {
+		bounds = append(bounds, p.Hash)
+	}
+	for _, p := range after {
+		bounds = append(bounds, p.Hash)
+	}
+	sort.Slice(bounds, func(i, j int) bool { return bounds[i] < bounds[j] })
+	j := 0
+	for i := range bounds {
+		if i == 0 || bounds[i] != bounds[j - 1] {
+			bounds[j] = bounds[i]
+			j++
+		}
+	}
+	bounds = bounds[:j]
+
+	type route struct{ from, to *Node }
+	var order []route
+	migrations := make(map[route]*Migration)
+	var last *args.HashRange
+	var lastRoute route
+	for i, end := range bounds {
+		// the first range wraps around zero
+		start := bounds[len(bounds) - 1]
+		if i > 0 {
+			start = bounds[i - 1]
+		}
+		r := route{ownerOf(before, end), ownerOf(after, end)}
+		if r.from == r.to {
+			last = nil
+			continue
+		}
+		// merge with the previous range when contiguous
+		if last != nil && lastRoute == r && last.End == start {
+			last.End = end
+			continue
+		}
+		m, ok := migrations[r]
+		if !ok {
+			m = &Migration{From: r.from, To: r.to}
+			migrations[r] = m
+			order = append(order, r)
+		}
+		m.Ranges = append(m.Ranges, args.HashRange{Start: start, End: end})
+		last = &m.Ranges[len(m.Ranges) - 1]
+		lastRoute = r
+	}
+	result := make([]*Migration, 0, len(order))
+	for _, r := range order {
+		result = append(result, migrations[r])
+	}
+	return result
+}
\ No newline at end of file
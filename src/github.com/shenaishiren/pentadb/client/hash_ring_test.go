@@ -1,6 +1,10 @@
 package client
 
-import "testing"
+import (
+	"fmt"
+	"net"
+	"testing"
+)
 
 func TestNewHashRing(t *testing.T) {
 	hashRing := NewHashRing()
@@ -15,7 +19,7 @@ func TestNewHashRing(t *testing.T) {
 		"127.0.0.1:5002": 1,
 	}
 	if rNodes, _ := hashRing.init(nodes, weights); len(rNodes) != 3 {
-		t.Errorf("wrong nodes: %d, %s", len(rNodes), rNodes)
+		t.Errorf("wrong nodes: %d, %v", len(rNodes), rNodes)
 	}
 	group := make(map[string]int)
 	hashRing.Iter(func (v *VNode) {
@@ -44,3 +48,128 @@ func TestNewHashRing(t *testing.T) {
 		t.Error("wrong delete function!")
 	}
 }
+
+// listen on distinct loopback ips, the hash ring only accepts one node per ip
+func listenNodes(t *testing.T, n int) ([]string, func()) {
+	var nodes []string
+	var listeners []net.Listener
+	closeAll := func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+	}
+	for i := 0; i < n; i++ {
+		l, err := net.Listen("tcp", fmt.Sprintf("127.0.0.%d:0", i + 2))
+		if err != nil {
+			closeAll()
+			t.Skip("loopback alias unavailable: ", err.Error())
+		}
+		listeners = append(listeners, l)
+		nodes = append(nodes, l.Addr().String())
+	}
+	return nodes, closeAll
+}
+
+func TestHashRing_UpdateWeight(t *testing.T) {
+	hashRing := NewHashRing()
+	nodes, closeAll := listenNodes(t, 3)
+	defer closeAll()
+	hashRing.init(nodes, nil)
+	if hashRing.length != 3 * defaultFactor {
+		t.Fatalf("wrong virtual nodes: %d", hashRing.length)
+	}
+	before := hashRing.points()
+	if err := hashRing.updateWeight(nodes[0], 2); err != nil {
+		t.Fatal(err.Error())
+	}
+	after := hashRing.points()
+	// average weight is 4/3, so 15 and 7 groups of four virtual nodes
+	counts := make(map[string]int)
+	hashRing.Iter(func(v *VNode) { counts[v.rNode.Ipaddr]++ })
+	if counts[nodes[0]] != 60 || counts[nodes[1]] != 28 || counts[nodes[2]] != 28 {
+		t.Errorf("wrong virtual node counts: %v", counts)
+	}
+	if hashRing.length != len(after) {
+		t.Errorf("wrong length: %d != %d", hashRing.length, len(after))
+	}
+	// a hash moves if and only if one migration covers it
+	migrations := diffPoints(before, after)
+	for i := 0; i < 10000; i++ {
+		hash := KemataHash(Md5Hash([]byte(fmt.Sprint(i))), 0)
+		from, to := ownerOf(before, hash), ownerOf(after, hash)
+		covered := 0
+		for _, m := range migrations {
+			for _, r := range m.Ranges {
+				if r.Contains(hash) {
+					covered++
+					if m.From != from || m.To != to {
+						t.Fatalf("hash %d moves %s -> %s, migration says %s -> %s",
+							hash, from.Ipaddr, to.Ipaddr, m.From.Ipaddr, m.To.Ipaddr)
+					}
+				}
+			}
+		}
+		if (from != to) != (covered == 1) || covered > 1 {
+			t.Fatalf("hash %d covered %d times, moved: %v", hash, covered, from != to)
+		}
+	}
+	// back to the original weight, back to the original layout
+	hashRing.updateWeight(nodes[0], 1)
+	if len(diffPoints(before, hashRing.points())) != 0 {
+		t.Error("layout differs after restoring weight")
+	}
+	// removing all nodes leaves an empty ring
+	for _, node := range nodes {
+		hashRing.deleteNode(node)
+	}
+	if hashRing.length != 0 || hashRing.First() != nil {
+		t.Errorf("ring not empty: %d", hashRing.length)
+	}
+}
+func TestHashRing_Inspect(t *testing.T) {
+	nodes, closeAll := listenNodes(t, 3)
+	defer closeAll()
+	hashRing, err := BuildHashRing(nodes, map[string]int{nodes[0]: 2})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	total := 0.0
+	for _, percent := range hashRing.Ownership() {
+		total += percent
+	}
+	if total < 99.999 || total > 100.001 {
+		t.Errorf("ownership sums to %f", total)
+	}
+	if len(hashRing.VNodes()) != hashRing.length {
+		t.Errorf("wrong virtual nodes: %d", len(hashRing.VNodes()))
+	}
+	key := []byte("test")
+	owner, _ := hashRing.Owner(key)
+	list, _ := hashRing.PreferenceList(key, 5)
+	if len(list) != 3 || list[0] != owner {
+		t.Fatalf("wrong preference list: %v", list)
+	}
+	if list[1] == list[0] || list[2] == list[0] || list[1] == list[2] {
+		t.Errorf("duplicate node in preference list: %v", list)
+	}
+}
+
+// a ring laid out without connecting agrees with the ring of a client
+func TestLayoutHashRing(t *testing.T) {
+	nodes, closeAll := listenNodes(t, 3)
+	defer closeAll()
+	weights := map[string]int{nodes[0]: 2, nodes[1]: 1, nodes[2]: 1}
+	hashRing, err := BuildHashRing(nodes, weights)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	layout := layoutHashRing(weights)
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprint("key", i))
+		owner, _ := hashRing.Owner(key)
+		laidOut, err := layout.Owner(key)
+		if err != nil || laidOut.Ipaddr != owner.Ipaddr {
+			t.Fatalf("%s owned by %s, laid out on %v %v", key, owner.Ipaddr, laidOut, err)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+// Contains the hedged reads of Client
+
+/* BSD 3-Clause License
+
+Copyright (c) 2017, Guan Jiawen, Li Lundong
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice, this
+  list of conditions and the following disclaimer.
+
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+
+* Neither the name of the copyright holder nor the names of its
+  contributors may be used to endorse or promote products derived from
+  this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+
+
+package client
+
+import (
+	"context"
+	"errors"
+	"time"
+	"github.com/shenaishiren/pentadb/args"
+)
+
+type hedgeResult struct {
+	reply *args.ValueReply
+
+	err error
+
+	hedge bool
+}
+
+// Read a key from its owner, and also from the next node of the
+// preference list if the owner has not answered within the hedge delay.
+// The owner stays authoritative, a reply of the other node only wins
+// if it found the key. The other node must hold a copy of every key of
+// the owner, see ClientOptions.HedgedReads.
+func (c *Client) hedgedGet(ctx context.Context, key []byte) (*args.ValueReply, error) {
+	c.mu.RLock()
+	nodes, err := c.hashRing.PreferenceList(key, 2)
+	c.mu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	if len(nodes) < 2 {
+		return nodes[0].Proxy.GetEntry(ctx, key)
+	}
+	// the loser is cancelled when returning
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan hedgeResult, 2)
+	get := func(node *Node, hedge bool) {
+		reply, err := node.Proxy.GetEntry(ctx, key)
+		results <- hedgeResult{reply: reply, err: err, hedge: hedge}
+	}
+	go get(nodes[0], false)
+	timer := time.NewTimer(nodes[0].Proxy.hedgeDelay(c.options.GetHedgePercentile()))
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			go get(nodes[1], true)
+		case result := <-results:
+			if !result.hedge || result.err == nil {
+				return result.reply, result.err
+			}
+			if !errors.Is(result.err, ErrNotFound) {
+				LOG.Warningf("hedged read from node %s failed: %s", nodes[1].Ipaddr, result.err.Error())
+			}
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package client
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+	"testing"
+	"net/rpc"
+
+	"github.com/shenaishiren/pentadb/args"
+	"github.com/shenaishiren/pentadb/opt"
+	nrpc "github.com/shenaishiren/pentadb/rpc"
+)
+
+// a node holding one value, answering after `delay`
+type fakeNode struct {
+	mu sync.Mutex
+
+	value []byte
+
+	delay time.Duration
+
+	// nodes it was told to remove
+	removed []string
+}
+
+func (f *fakeNode) set(value []byte, delay time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.value, f.delay = value, delay
+}
+
+func (f *fakeNode) Init(initArgs *args.InitArgs, result *[]byte) error {
+	return nil
+}
+
+func (f *fakeNode) GetEntry(keyArgs *args.KeyArgs, reply *args.ValueReply) error {
+	f.mu.Lock()
+	value, delay := f.value, f.delay
+	f.mu.Unlock()
+	time.Sleep(delay)
+	if value == nil {
+		return nrpc.ErrNotFound
+	}
+	reply.Value = value
+	return nil
+}
+
+func (f *fakeNode) RemoveNode(node string, result *[]byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.removed = append(f.removed, node)
+	return nil
+}
+
+func (f *fakeNode) Migrate(migrateArgs *args.MigrateArgs, result *[]byte) error {
+	return nil
+}
+
+func (f *fakeNode) Stats(statsArgs *args.StatsArgs, reply *args.StatsReply) error {
+	return nil
+}
+
+// serve a `fakeNode` on each of `n` loopback ips
+func serveFakeNodes(t *testing.T, n int) ([]string, map[string]*fakeNode, func()) {
+	var nodes []string
+	fakes := make(map[string]*fakeNode)
+	var listeners []net.Listener
+	closeAll := func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+	}
+	for i := 0; i < n; i++ {
+		l, err := net.Listen("tcp", fmt.Sprintf("127.0.0.%d:0", i + 2))
+		if err != nil {
+			closeAll()
+			t.Skip("loopback alias unavailable: ", err.Error())
+		}
+		listeners = append(listeners, l)
+		fake := new(fakeNode)
+		server := rpc.NewServer()
+		server.RegisterName("Node", fake)
+		go func(l net.Listener) {
+			for {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+				go server.ServeConn(conn)
+			}
+		}(l)
+		nodes = append(nodes, l.Addr().String())
+		fakes[l.Addr().String()] = fake
+	}
+	return nodes, fakes, closeAll
+}
+
+func TestHedgedReads(t *testing.T) {
+	nodes, fakes, closeAll := serveFakeNodes(t, 2)
+	defer closeAll()
+	if _, err := NewClientWithOptions(nodes, nil, 1, &opt.ClientOptions{HedgedReads: true}); err == nil {
+		t.Fatal("hedged reads accepted without replicas")
+	}
+
+	c, err := NewClient(nodes, nil, 1)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer c.Close()
+	key := []byte("k")
+	c.mu.RLock()
+	list, err := c.hashRing.PreferenceList(key, 2)
+	c.mu.RUnlock()
+	if err != nil || len(list) != 2 {
+		t.Fatalf("preference list %v, %v", list, err)
+	}
+	// the owner is slower than the hedge delay, the next node holds
+	// the value an earlier ring left there
+	fakes[list[0].Ipaddr].set([]byte("new"), 5 * opt.DefaultHedgeDelay)
+	fakes[list[1].Ipaddr].set([]byte("old"), 0)
+	if value, err := c.Get(key); err != nil || string(value) != "new" {
+		t.Fatalf("get = %q, %v, want the owner's value", value, err)
+	}
+}
@@ -0,0 +1,221 @@
+// Contains the implementation of Iterator which scans all nodes
+
+/* BSD 3-Clause License
+
+Copyright (c) 2017, Guan Jiawen, Li Lundong
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice, this
+  list of conditions and the following disclaimer.
+
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+
+* Neither the name of the copyright holder nor the names of its
+  contributors may be used to endorse or promote products derived from
+  this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+
+package client
+
+import (
+	"time"
+	"bytes"
+	"context"
+	"github.com/shenaishiren/pentadb/args"
+	"github.com/shenaishiren/pentadb/opt"
+)
+
+// pages of one node which are not consumed yet
+type nodeStream struct {
+	node *Node
+
+	kvs []args.KVArgs
+
+	// where the next page starts
+	next []byte
+
+	more bool
+}
+
+// Iterator walks the keys of a range on every node in key order.
+// Keys are hashed to nodes, so every node is asked for a page and
+// the pages are merged. It is not safe for concurrent use.
+type Iterator struct {
+	ctx context.Context
+
+	client *Client
+
+	scanArgs args.ScanArgs
+
+	// stop after this number of pairs, 0 means no limit
+	limit int
+
+	count int
+
+	streams []*nodeStream
+
+	started bool
+
+	key []byte
+
+	value []byte
+
+	expireAt int64
+
+	err error
+}
+
+// Scan keys in [start, end), nil means unbounded. At most `limit`
+// pairs are returned, 0 means no limit. Use `Cursor` as `start`
+// of the next call to fetch the next page.
+func (c *Client) Scan(start []byte, end []byte, limit int) *Iterator {
+	return c.ScanContext(context.Background(), start, end, nil, limit)
+}
+
+// Scan keys which have `prefix`
+func (c *Client) ScanPrefix(prefix []byte, limit int) *Iterator {
+	return c.ScanContext(context.Background(), nil, nil, prefix, limit)
+}
+
+// ScanContext scans keys in [start, end) which have `prefix`,
+// and gives up once ctx is done
+func (c *Client) ScanContext(ctx context.Context, start []byte, end []byte, prefix []byte, limit int) *Iterator {
+	it := &Iterator{
+		ctx:      ctx,
+		client:   c,
+		scanArgs: args.ScanArgs{Start: start, End: end, Prefix: prefix},
+		limit:    limit,
+	}
+	c.mu.RLock()
+	for _, node := range c.nodes {
+		it.streams = append(it.streams, &nodeStream{node: node, next: start, more: true})
+	}
+	c.mu.RUnlock()
+	return it
+}
+
+// fetch the next page of a node
+func (it *Iterator) fetch(stream *nodeStream) error {
+	scanArgs := it.scanArgs
+	scanArgs.Start = stream.next
+	scanArgs.Limit = opt.DefaultScanPageSize
+	if it.limit > 0 && it.limit - it.count < scanArgs.Limit {
+		// one more than needed tells whether the node has more
+		scanArgs.Limit = it.limit - it.count + 1
+	}
+	reply, err := stream.node.Proxy.Scan(it.ctx, &scanArgs)
+	if err != nil {
+		return err
+	}
+	stream.kvs = reply.KVs
+	stream.more = reply.More
+	if n := len(reply.KVs); n > 0 {
+		stream.next = append(append([]byte(nil), reply.KVs[n - 1].Key...), 0)
+	}
+	return nil
+}
+
+// Next moves to the next pair and reports whether there is one
+func (it *Iterator) Next() bool {
+	if it.err != nil || (it.limit > 0 && it.count >= it.limit) {
+		return false
+	}
+	// the first pages are fetched in parallel
+	if !it.started {
+		it.started = true
+		groups := make(map[*Node][]int)
+		for i, stream := range it.streams {
+			groups[stream.node] = []int{i}
+		}
+		errs := make([]error, len(it.streams))
+		fanOut(groups, func(node *Node, indexes []int) {
+			errs[indexes[0]] = it.fetch(it.streams[indexes[0]])
+		})
+		for _, err := range errs {
+			if err != nil {
+				it.err = err
+				return false
+			}
+		}
+	}
+	for {
+		var min *nodeStream
+		for _, stream := range it.streams {
+			if len(stream.kvs) == 0 && stream.more {
+				if it.err = it.fetch(stream); it.err != nil {
+					return false
+				}
+			}
+			if len(stream.kvs) == 0 {
+				continue
+			}
+			if min == nil || bytes.Compare(stream.kvs[0].Key, min.kvs[0].Key) < 0 {
+				min = stream
+			}
+		}
+		if min == nil {
+			return false
+		}
+		kv := min.kvs[0]
+		min.kvs = min.kvs[1:]
+		// a key being migrated may show up on two nodes
+		if it.key != nil && bytes.Equal(kv.Key, it.key) {
+			continue
+		}
+		it.key, it.value, it.expireAt = kv.Key, kv.Value, kv.ExpireAt
+		it.count++
+		return true
+	}
+}
+
+func (it *Iterator) Key() []byte { return it.key }
+
+func (it *Iterator) Value() []byte { return it.value }
+
+// ExpireAt returns when the pair expires, zero if it never does
+func (it *Iterator) ExpireAt() time.Time {
+	if it.expireAt == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, it.expireAt)
+}
+
+// Err returns the error which stopped the iteration
+func (it *Iterator) Err() error { return it.err }
+
+// Cursor returns where the next page starts, nil if all keys are read
+func (it *Iterator) Cursor() []byte {
+	if it.err != nil || !it.started {
+		return it.scanArgs.Start
+	}
+	exhausted := true
+	for _, stream := range it.streams {
+		if len(stream.kvs) > 0 || stream.more {
+			exhausted = false
+		}
+	}
+	if exhausted {
+		return nil
+	}
+	if it.key == nil {
+		return it.scanArgs.Start
+	}
+	return append(append([]byte(nil), it.key...), 0)
+}
@@ -0,0 +1,118 @@
+// Contains the latency histogram of NodeProxy
+
+/* BSD 3-Clause License
+
+Copyright (c) 2017, Guan Jiawen, Li Lundong
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice, this
+  list of conditions and the following disclaimer.
+
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+
+* Neither the name of the copyright holder nor the names of its
+  contributors may be used to endorse or promote products derived from
+  this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+
+
+package client
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	// the first bucket holds latencies up to 10 microseconds, every
+	// next one is 2^(1/4) times wider, the last one is about 3 minutes
+	latencyBase = 10 * time.Microsecond
+	latencyBucketsPerDouble = 4
+	latencyBuckets = 24 * latencyBucketsPerDouble
+
+	// counts are halved once there are more samples, so that
+	// old latencies fade out
+	latencyMaxSamples = 10000
+)
+
+// A histogram of recent call latencies of one node, with log-scaled buckets
+type latencyHistogram struct {
+	mu *sync.Mutex
+
+	counts [latencyBuckets]uint64
+
+	total uint64
+}
+
+func newLatencyHistogram() *latencyHistogram {
+	return &latencyHistogram{mu: new(sync.Mutex)}
+}
+
+func latencyBucket(d time.Duration) int {
+	if d <= latencyBase {
+		return 0
+	}
+	i := int(math.Ceil(math.Log2(float64(d) / float64(latencyBase)) * latencyBucketsPerDouble))
+	if i >= latencyBuckets {
+		return latencyBuckets - 1
+	}
+	return i
+}
+
+// the upper bound of bucket `i`
+func latencyBound(i int) time.Duration {
+	return time.Duration(float64(latencyBase) * math.Exp2(float64(i) / latencyBucketsPerDouble))
+}
+
+func (h *latencyHistogram) observe(d time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.counts[latencyBucket(d)]++
+	h.total++
+	if h.total > latencyMaxSamples {
+		h.total = 0
+		for i := range h.counts {
+			h.counts[i] /= 2
+			h.total += h.counts[i]
+		}
+	}
+}
+
+// Return the latency below which the fraction `p` of calls finished,
+// false if there are fewer than `minSamples` samples
+func (h *latencyHistogram) percentile(p float64, minSamples int) (time.Duration, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.total == 0 || h.total < uint64(minSamples) {
+		return 0, false
+	}
+	rank := uint64(math.Ceil(p * float64(h.total)))
+	var seen uint64
+	for i, count := range h.counts {
+		seen += count
+		if seen >= rank {
+			return latencyBound(i), true
+		}
+	}
+	return latencyBound(latencyBuckets - 1), true
+}
@@ -0,0 +1,37 @@
+package client
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLatencyHistogram(t *testing.T) {
+	h := newLatencyHistogram()
+	if _, ok := h.percentile(0.9, 1); ok {
+		t.Fatal("percentile of empty histogram")
+	}
+	// 90 fast calls and 10 slow ones
+	for i := 0; i < 90; i++ {
+		h.observe(time.Millisecond)
+	}
+	for i := 0; i < 10; i++ {
+		h.observe(100 * time.Millisecond)
+	}
+	if _, ok := h.percentile(0.9, 1000); ok {
+		t.Fatal("percentile with too few samples")
+	}
+	// bounds are at most 2^(1/4) times above the latency
+	if d, _ := h.percentile(0.9, 1); d < time.Millisecond || d > 1200 * time.Microsecond {
+		t.Fatalf("p90 %s, want about 1ms", d)
+	}
+	if d, _ := h.percentile(0.95, 1); d < 100 * time.Millisecond || d > 120 * time.Millisecond {
+		t.Fatalf("p95 %s, want about 100ms", d)
+	}
+	// old samples fade out
+	for i := 0; i < 2 * latencyMaxSamples; i++ {
+		h.observe(10 * time.Millisecond)
+	}
+	if d, _ := h.percentile(0.99, 1); d > 12 * time.Millisecond {
+		t.Fatalf("p99 %s after aging, want about 10ms", d)
+	}
+}
@@ -0,0 +1,208 @@
+// Contains the multi-key operations of PentaDB Client
+
+/* BSD 3-Clause License
+
+Copyright (c) 2017, Guan Jiawen, Li Lundong
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice, this
+  list of conditions and the following disclaimer.
+
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+
+* Neither the name of the copyright holder nor the names of its
+  contributors may be used to endorse or promote products derived from
+  this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+
+package client
+
+import (
+	"fmt"
+	"sync"
+	"errors"
+	"context"
+	"github.com/shenaishiren/pentadb/args"
+	"github.com/shenaishiren/pentadb/keyhash"
+)
+
+// Result of one key in a multi-key operation
+type Result struct {
+	Key []byte
+
+	// only set by MultiGet
+	Value []byte
+
+	// nil on success, ErrNotFound if MultiGet found nothing,
+	// otherwise the error of the node owning the key
+	Err error
+}
+
+func newResults(keys [][]byte) []Result {
+	results := make([]Result, len(keys))
+	for i, key := range keys {
+		results[i].Key = key
+	}
+	return results
+}
+
+// group the indexes of keys by the node owning them
+func (c *Client) groupByNode(keys [][]byte) (map[*Node][]int, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	groups := make(map[*Node][]int)
+	for i, key := range keys {
+		vNode, err := c.hashRing.findProperNode(keyhash.Key(key))
+		if err != nil {
+			return nil, err
+		}
+		groups[vNode.rNode] = append(groups[vNode.rNode], i)
+	}
+	return groups, nil
+}
+
+// run `f` for every node in parallel and wait for all of them
+func fanOut(groups map[*Node][]int, f func(node *Node, indexes []int)) {
+	var wg sync.WaitGroup
+	for node, indexes := range groups {
+		wg.Add(1)
+		go func(node *Node, indexes []int) {
+			defer wg.Done()
+			f(node, indexes)
+		}(node, indexes)
+	}
+	wg.Wait()
+}
+
+// MultiPut writes `values[i]` to `keys[i]` with one request per node,
+// the pairs stored on the same node are written atomically
+func (c *Client) MultiPut(keys [][]byte, values [][]byte) ([]Result, error) {
+	return c.MultiPutContext(context.Background(), keys, values)
+}
+
+// MultiPutContext is like MultiPut, but gives up once ctx is done
+func (c *Client) MultiPutContext(ctx context.Context, keys [][]byte, values [][]byte) ([]Result, error) {
+	if len(keys) != len(values) {
+		return nil, errors.New(fmt.Sprintf("%d keys but %d values", len(keys), len(values)))
+	}
+	groups, err := c.groupByNode(keys)
+	if err != nil {
+		return nil, err
+	}
+	defer c.invalidate(keys...)
+	results := newResults(keys)
+	fanOut(groups, func(node *Node, indexes []int) {
+		kvs := make([]args.KVArgs, len(indexes))
+		for j, i := range indexes {
+			kvs[j] = args.KVArgs{Key: keys[i], Value: values[i]}
+		}
+		err := node.Proxy.BatchPut(ctx, kvs)
+		for _, i := range indexes {
+			results[i].Err = err
+		}
+	})
+	return results, nil
+}
+
+// MultiPutKVs is like MultiPutContext, but the pairs may carry a TTL
+// or an absolute expiry
+func (c *Client) MultiPutKVs(ctx context.Context, kvs []args.KVArgs) ([]Result, error) {
+	keys := make([][]byte, len(kvs))
+	for i := range kvs {
+		keys[i] = kvs[i].Key
+	}
+	groups, err := c.groupByNode(keys)
+	if err != nil {
+		return nil, err
+	}
+	defer c.invalidate(keys...)
+	results := newResults(keys)
+	fanOut(groups, func(node *Node, indexes []int) {
+		nodeKVs := make([]args.KVArgs, len(indexes))
+		for j, i := range indexes {
+			nodeKVs[j] = kvs[i]
+		}
+		err := node.Proxy.BatchPut(ctx, nodeKVs)
+		for _, i := range indexes {
+			results[i].Err = err
+		}
+	})
+	return results, nil
+}
+
+// MultiGet reads keys with one request per node
+func (c *Client) MultiGet(keys [][]byte) ([]Result, error) {
+	return c.MultiGetContext(context.Background(), keys)
+}
+
+// MultiGetContext is like MultiGet, but gives up once ctx is done
+func (c *Client) MultiGetContext(ctx context.Context, keys [][]byte) ([]Result, error) {
+	groups, err := c.groupByNode(keys)
+	if err != nil {
+		return nil, err
+	}
+	results := newResults(keys)
+	fanOut(groups, func(node *Node, indexes []int) {
+		nodeKeys := make([][]byte, len(indexes))
+		for j, i := range indexes {
+			nodeKeys[j] = keys[i]
+		}
+		reply, err := node.Proxy.MultiGet(ctx, nodeKeys)
+		for j, i := range indexes {
+			switch {
+			case err != nil:
+				results[i].Err = err
+			case !reply.Found[j]:
+				results[i].Err = ErrNotFound
+			default:
+				results[i].Value = reply.Values[j]
+			}
+		}
+	})
+	return results, nil
+}
+
+// MultiDelete deletes keys with one request per node,
+// the keys stored on the same node are deleted atomically
+func (c *Client) MultiDelete(keys [][]byte) ([]Result, error) {
+	return c.MultiDeleteContext(context.Background(), keys)
+}
+
+// MultiDeleteContext is like MultiDelete, but gives up once ctx is done
+func (c *Client) MultiDeleteContext(ctx context.Context, keys [][]byte) ([]Result, error) {
+	groups, err := c.groupByNode(keys)
+	if err != nil {
+		return nil, err
+	}
+	defer c.invalidate(keys...)
+	results := newResults(keys)
+	fanOut(groups, func(node *Node, indexes []int) {
+		nodeKeys := make([][]byte, len(indexes))
+		for j, i := range indexes {
+			nodeKeys[j] = keys[i]
+		}
+		err := node.Proxy.BatchDelete(ctx, nodeKeys)
+		for _, i := range indexes {
+			results[i].Err = err
+		}
+	})
+	return results, nil
+}
@@ -41,6 +41,7 @@ import (
 	"time"
 
 	"github.com/satori/go.uuid"
+	"github.com/shenaishiren/pentadb/opt"
 )
 
 type Node struct {
@@ -59,9 +60,16 @@ type Node struct {
 
 	// Node Proxy
 	Proxy *NodeProxy
+
+	// number of virtual node groups placed on hash ring
+	groups int
 }
 
 func NewNode(ipaddr string, weight int) *Node {
+	return newNode(ipaddr, weight, nil)
+}
+
+func newNode(ipaddr string, weight int, options *opt.ClientOptions) *Node {
 	node := &Node{
 		Name:     uuid.NewV1().String(),
 		Ipaddr:   ipaddr,
@@ -70,7 +78,7 @@ func NewNode(ipaddr string, weight int) *Node {
 	}
 	// check whether this node is connectable or not
 	// TODO
-	proxy := NewNodeProxy(node)
+	proxy := newNodeProxy(node, options)
 	if proxy == nil {
 		return nil
 	}
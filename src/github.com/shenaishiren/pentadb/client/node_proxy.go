@@ -35,7 +35,11 @@ OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
 package client
 
 import (
+	"fmt"
+	"errors"
 	"sync"
+	"time"
+	"context"
 	"github.com/shenaishiren/pentadb/opt"
 	"github.com/shenaishiren/pentadb/args"
 	nrpc "github.com/shenaishiren/pentadb/rpc"
@@ -45,40 +49,119 @@ type NodeProxy struct {
 	// client-side node
 	node *Node
 
+	// long-lived connections to the node
+	pool *connPool
+
+	// calls whose results are returned as futures
+	async *asyncCaller
+
+	options *opt.ClientOptions
+
+	breaker *breaker
+
+	// latencies of Get
+	latency *latencyHistogram
+
 	mu *sync.Mutex
 }
 
 func NewNodeProxy(node *Node) *NodeProxy {
+	return newNodeProxy(node, nil)
+}
+
+func newNodeProxy(node *Node, options *opt.ClientOptions) *NodeProxy {
 	if !Reachable(node.Ipaddr, opt.DefaultTimeout) {
 		return nil
 	}
+	pool := newConnPool(node.Ipaddr, options)
+	breaker := newBreaker(node.Ipaddr, options)
 	return &NodeProxy{
 		node:          node,
+		pool:          pool,
+		async:         newAsyncCaller(node, pool, breaker, options.GetMaxInFlight()),
+		options:       options,
+		breaker:       breaker,
+		latency:       newLatencyHistogram(),
 		mu:            new(sync.Mutex),
 	}
 }
 
-func (np *NodeProxy) call(serviceMethod string, args interface{}, unreachableChan chan string) []byte {
-	client, err := nrpc.DialTimeout(opt.DefaultProtocol, np.node.Ipaddr, opt.DefaultTimeout)
-	if err != nil {
-		LOG.Errorf("node %s is unreachable: %s", np.node.Ipaddr, err.Error())
-		unreachableChan <- np.node.Name
-		return nil
+// build the header carrying how long the caller still waits
+func newHeader(ctx context.Context) args.Header {
+	var header args.Header
+	if deadline, ok := ctx.Deadline(); ok {
+		header.Timeout = time.Until(deadline)
 	}
-	// call
-	var result []byte
-	err = client.Call(serviceMethod, args, &result)
-	if err != nil {
-		LOG.Error("rpc call failed: ", err.Error())
-		return nil
+	return header
+}
+
+// call `serviceMethod` on the node, `reply` must be a pointer.
+// Failed attempts are retried by the retry policy of the options.
+func (np *NodeProxy) call(ctx context.Context, serviceMethod string, callArgs interface{}, reply interface{}) error {
+	carrier, hasHeader := callArgs.(interface{ GetHeader() *args.Header })
+	if hasHeader && carrier.GetHeader().RequestID == "" {
+		carrier.GetHeader().RequestID = newRequestID()
 	}
-	if err = client.Close(); err != nil {
-		LOG.Error("client close failed: ", err.Error())
+	maxAttempts := np.options.GetMaxAttempts()
+	for attempt := 1; ; attempt++ {
+		if hasHeader {
+			// the time left shrinks with every attempt
+			carrier.GetHeader().Timeout = newHeader(ctx).Timeout
+		}
+		sent, err := np.callOnce(ctx, serviceMethod, callArgs, reply)
+		if err == nil || attempt >= maxAttempts || !retryable(ctx, err, sent, serviceMethod) {
+			return err
+		}
+		select {
+		case <-time.After(backoff(np.options, attempt)):
+		case <-ctx.Done():
+			return wrapError(np.node, ctx.Err())
+		}
 	}
-	return result
 }
 
-func (np *NodeProxy) Init(nodeIpaddrs []string, replicas int, unreachableChan chan string) {
+// make one attempt, `sent` reports whether the request may have
+// reached the node
+func (np *NodeProxy) callOnce(ctx context.Context, serviceMethod string, callArgs interface{}, reply interface{}) (bool, error) {
+	// the deadline of ctx is already exceeded
+	if err := ctx.Err(); err != nil {
+		return false, wrapError(np.node, err)
+	}
+	generation, ok := np.breaker.allow()
+	if !ok {
+		return false, fmt.Errorf("%w: node %s", ErrCircuitOpen, np.node.Ipaddr)
+	}
+	sent, err := np.attempt(ctx, serviceMethod, callArgs, reply)
+	np.breaker.done(generation, err)
+	return sent, err
+}
+
+func (np *NodeProxy) attempt(ctx context.Context, serviceMethod string, callArgs interface{}, reply interface{}) (bool, error) {
+	conn, err := np.pool.get(ctx)
+	if err != nil {
+		// giving up dialing is not the fault of the node
+		if ctx.Err() != nil {
+			return false, wrapError(np.node, ctx.Err())
+		}
+		return false, fmt.Errorf("%w: node %s: %w", ErrUnavailable, np.node.Ipaddr, err)
+	}
+	err = nrpc.CallContext(ctx, conn.client, serviceMethod, callArgs, reply)
+	np.pool.put(conn, err)
+	return true, wrapError(np.node, err)
+}
+
+// State returns the state of the circuit breaker of the node
+func (np *NodeProxy) State() BreakerState {
+	return np.breaker.State()
+}
+
+// Close all connections to the node
+func (np *NodeProxy) Close() {
+	np.pool.close()
+	np.async.close()
+}
+
+func (np *NodeProxy) Init(nodeIpaddrs []string, replicas int) error {
 	var otherNodes []string
 	for _, node := range nodeIpaddrs {
 		if node != np.node.Ipaddr {
@@ -90,26 +173,176 @@ func (np *NodeProxy) Init(nodeIpaddrs []string, replicas int, unreachableChan ch
 		OtherNodes: otherNodes,
 		Replicas: replicas,
 	}
-	np.call("Node.Init", args, unreachableChan)
+	var result []byte
+	return np.call(context.Background(), "Node.Init", args, &result)
+}
+
+func (np *NodeProxy) AddNode(nodeIpaddr string) error {
+	var result []byte
+	return np.call(context.Background(), "Node.AddNode", nodeIpaddr, &result)
+}
+
+func (np *NodeProxy) RemoveNode(nodeIpaddr string) error {
+	var result []byte
+	return np.call(context.Background(), "Node.RemoveNode", nodeIpaddr, &result)
+}
+
+func (np *NodeProxy) Migrate(target string, ranges []args.HashRange, since int64) error {
+	migrateArgs := &args.MigrateArgs{Target: target, Ranges: ranges, Since: since}
+	var result []byte
+	return np.call(context.Background(), "Node.Migrate", migrateArgs, &result)
+}
+
+// a zero ttl keeps the pair forever
+func (np *NodeProxy) Put(ctx context.Context, key []byte, value []byte, ttl time.Duration) error {
+	kvArgs := &args.KVArgs{Header: newHeader(ctx), Key: key, Value: value, TTL: ttl}
+	var result []byte
+	return np.call(ctx, "Node.Put", kvArgs, &result)
+}
+
+func (np *NodeProxy) Get(ctx context.Context, key []byte) ([]byte, error) {
+	reply, err := np.GetEntry(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return reply.Value, nil
+}
+
+// GetEntry is like Get, but also returns when the value expires
+func (np *NodeProxy) GetEntry(ctx context.Context, key []byte) (*args.ValueReply, error) {
+	keyArgs := &args.KeyArgs{Header: newHeader(ctx), Key: key}
+	reply := new(args.ValueReply)
+	start := time.Now()
+	err := np.call(ctx, "Node.GetEntry", keyArgs, reply)
+	if err == nil || errors.Is(err, ErrNotFound) {
+		np.latency.observe(time.Since(start))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return reply, nil
 }
 
-func (np *NodeProxy) AddNode(nodeIpaddr string, unreachableChan chan string) {
-	np.call("Node.AddNode", nodeIpaddr, unreachableChan)
+// Latency returns the latency below which the fraction `p` of recent
+// Get calls finished, false if too few calls were made yet
+func (np *NodeProxy) Latency(p float64) (time.Duration, bool) {
+	return np.latency.percentile(p, opt.DefaultHedgeMinSamples)
 }
 
-func (np *NodeProxy) RemoveNode(nodeIpaddr string, unreachableChan chan string) {
-	np.call("Node.RemoveNode", nodeIpaddr, unreachableChan)
+func (np *NodeProxy) hedgeDelay(p float64) time.Duration {
+	if d, ok := np.Latency(p); ok {
+		return d
+	}
+	return opt.DefaultHedgeDelay
 }
 
-func (np *NodeProxy) Put(key []byte, value []byte, unreachableChan chan string) {
-	kvArgs := &args.KVArgs{Key:key, Value: value}
-	np.call("Node.Put", kvArgs, unreachableChan)
+func (np *NodeProxy) Delete(ctx context.Context, key []byte) error {
+	keyArgs := &args.KeyArgs{Header: newHeader(ctx), Key: key}
+	var result []byte
+	return np.call(ctx, "Node.Delete", keyArgs, &result)
 }
 
-func (np *NodeProxy) Get(key []byte, unreachableChan chan string) []byte {
-	return np.call("Node.Get", key, unreachableChan)
+// Write all pairs atomically
+func (np *NodeProxy) BatchPut(ctx context.Context, kvs []args.KVArgs) error {
+	kvArrayArgs := &args.KVArrayArgs{Header: newHeader(ctx), KVs: kvs}
+	var result []byte
+	return np.call(ctx, "Node.BatchPut", kvArrayArgs, &result)
 }
 
-func (np *NodeProxy) Delete(key []byte, unreachableChan chan string) {
-	np.call("Node.Delete", key, unreachableChan)
-}
\ No newline at end of file
+// Read all keys from one snapshot
+func (np *NodeProxy) MultiGet(ctx context.Context, keys [][]byte) (*args.ValueArrayReply, error) {
+	keyArrayArgs := &args.KeyArrayArgs{Header: newHeader(ctx), Keys: keys}
+	reply := new(args.ValueArrayReply)
+	if err := np.call(ctx, "Node.MultiGet", keyArrayArgs, reply); err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+// Delete all keys atomically
+func (np *NodeProxy) BatchDelete(ctx context.Context, keys [][]byte) error {
+	keyArrayArgs := &args.KeyArrayArgs{Header: newHeader(ctx), Keys: keys}
+	var result []byte
+	return np.call(ctx, "Node.BatchDelete", keyArrayArgs, &result)
+}
+
+// Apply puts and deletes atomically
+func (np *NodeProxy) Write(ctx context.Context, ops []args.BatchOp) error {
+	batchArgs := &args.BatchArgs{Header: newHeader(ctx), Ops: ops}
+	var result []byte
+	return np.call(ctx, "Node.Write", batchArgs, &result)
+}
+
+func (np *NodeProxy) Prepare(ctx context.Context, txnID string, ops []args.BatchOp) error {
+	txnArgs := &args.TxnArgs{Header: newHeader(ctx), TxnID: txnID, Ops: ops}
+	var result []byte
+	return np.call(ctx, "Node.Prepare", txnArgs, &result)
+}
+
+func (np *NodeProxy) Commit(ctx context.Context, txnID string) error {
+	txnArgs := &args.TxnArgs{Header: newHeader(ctx), TxnID: txnID}
+	var result []byte
+	return np.call(ctx, "Node.Commit", txnArgs, &result)
+}
+
+func (np *NodeProxy) Abort(ctx context.Context, txnID string) error {
+	txnArgs := &args.TxnArgs{Header: newHeader(ctx), TxnID: txnID}
+	var result []byte
+	return np.call(ctx, "Node.Abort", txnArgs, &result)
+}
+
+// Read a page of a range in key order
+func (np *NodeProxy) Scan(ctx context.Context, scanArgs *args.ScanArgs) (*args.ScanReply, error) {
+	scanArgs.Header = newHeader(ctx)
+	reply := new(args.ScanReply)
+	if err := np.call(ctx, "Node.Scan", scanArgs, reply); err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+// Apply a conditional write, report whether the condition held
+func (np *NodeProxy) CompareAndSwap(ctx context.Context, casArgs *args.CASArgs) (bool, error) {
+	casArgs.Header = newHeader(ctx)
+	var swapped bool
+	if err := np.call(ctx, "Node.CompareAndSwap", casArgs, &swapped); err != nil {
+		return false, err
+	}
+	return swapped, nil
+}
+
+func (np *NodeProxy) Watch(ctx context.Context, watchArgs *args.WatchArgs) (*args.WatchReply, error) {
+	watchArgs.Header = newHeader(ctx)
+	reply := new(args.WatchReply)
+	if err := np.call(ctx, "Node.Watch", watchArgs, reply); err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+func (np *NodeProxy) ReadChanges(ctx context.Context, fromSeq int64, limit int) (*args.ChangesReply, error) {
+	changesArgs := &args.ChangesArgs{Header: newHeader(ctx), FromSeq: fromSeq, Limit: limit}
+	reply := new(args.ChangesReply)
+	if err := np.call(ctx, "Node.ReadChanges", changesArgs, reply); err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+func (np *NodeProxy) Stats(ctx context.Context) (*args.StatsReply, error) {
+	statsArgs := &args.StatsArgs{Header: newHeader(ctx)}
+	reply := new(args.StatsReply)
+	if err := np.call(ctx, "Node.Stats", statsArgs, reply); err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+func (np *NodeProxy) Incr(ctx context.Context, key []byte, delta int64) (int64, error) {
+	incrArgs := &args.IncrArgs{Header: newHeader(ctx), Key: key, Delta: delta}
+	var result int64
+	if err := np.call(ctx, "Node.Incr", incrArgs, &result); err != nil {
+		return 0, err
+	}
+	return result, nil
+}
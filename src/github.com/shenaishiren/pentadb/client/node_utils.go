@@ -1,28 +1,17 @@
 package client
 
 import (
-	"crypto/md5"
 	"time"
 	"net"
+	"github.com/shenaishiren/pentadb/keyhash"
 )
 
 func Md5Hash(key []byte) []byte {
-	md := md5.New()
-	md.Write(key)
-	return md.Sum(nil)
+	return keyhash.Md5Hash(key)
 }
 
 func KemataHash(digest []byte, i int) uint32 {
-	// calculate the hash value
-	// each four bytes constitute a 32-bit integer
-	// then add the four 32-bit integers to the final hash value
-	var hash uint32 = 0
-	hash += (uint32(digest[(i << 2) + 3] & 0xff) << 24) |
-		(uint32(digest[(i << 2) + 2] & 0xff) << 16) |
-		(uint32(digest[(i << 2) + 1] & 0xff) << 8) |
-		uint32(digest[i << 2] & 0xff)
-
-	return hash
+	return keyhash.KemataHash(digest, i)
 }
 
 func Reachable(ipaddr string, timeout time.Duration) bool {
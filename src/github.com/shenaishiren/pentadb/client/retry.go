@@ -0,0 +1,110 @@
+// Contains the retry policy of NodeProxy
+
+/* BSD 3-Clause License
+
+Copyright (c) 2017, Guan Jiawen, Li Lundong
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice, this
+  list of conditions and the following disclaimer.
+
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+
+* Neither the name of the copyright holder nor the names of its
+  contributors may be used to endorse or promote products derived from
+  this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+
+
+package client
+
+import (
+	"time"
+	"errors"
+	"context"
+	"math/rand"
+	"github.com/satori/go.uuid"
+	"github.com/shenaishiren/pentadb/opt"
+)
+
+// Calls which may be repeated even if the node might have handled
+// them already. Writes set values rather than change them, and
+// Incr and CompareAndSwap are answered from the cache of the node
+// when their request id is seen again. Calls missing here are only
+// retried if they never reached the node.
+var retrySafe = map[string]bool{
+	"Node.Ping":           true,
+	"Node.Put":            true,
+	"Node.Get":            true,
+	"Node.GetEntry":       true,
+	"Node.Delete":         true,
+	"Node.BatchPut":       true,
+	"Node.MultiGet":       true,
+	"Node.BatchDelete":    true,
+	"Node.Write":          true,
+	"Node.Prepare":        true,
+	"Node.Abort":          true,
+	"Node.Scan":           true,
+	"Node.Watch":          true,
+	"Node.ReadChanges":    true,
+	"Node.CompareAndSwap": true,
+	"Node.Incr":           true,
+	"Node.Stats":          true,
+	"Node.ReadBackup":     true,
+	"Node.ReleaseBackup":  true,
+	"Node.Thaw":           true,
+	"Node.RestorePairs":   true,
+}
+
+func newRequestID() string {
+	return uuid.NewV1().String()
+}
+
+// whether a failed attempt of `serviceMethod` is worth another one
+func retryable(ctx context.Context, err error, sent bool, serviceMethod string) bool {
+	// the caller gave up
+	if ctx.Err() != nil || errors.Is(err, errPoolClosed) {
+		return false
+	}
+	// fail fast, the breaker stays open longer than any backoff
+	if errors.Is(err, ErrCircuitOpen) {
+		return false
+	}
+	// the node answered, it would answer the same again
+	if !errors.Is(err, ErrUnavailable) && !errors.Is(err, ErrTimeout) {
+		return false
+	}
+	return !sent || retrySafe[serviceMethod]
+}
+
+// wait before retrying after `attempt` attempts
+func backoff(options *opt.ClientOptions, attempt int) time.Duration {
+	d := options.GetRetryBackoff()
+	for i := 1; i < attempt && d < options.GetMaxRetryBackoff(); i++ {
+		d *= 2
+	}
+	if d > options.GetMaxRetryBackoff() {
+		d = options.GetMaxRetryBackoff()
+	}
+	if jitter := time.Duration(float64(d) * options.GetRetryJitter()); jitter > 0 {
+		d -= time.Duration(rand.Int63n(int64(jitter) + 1))
+	}
+	return d
+}
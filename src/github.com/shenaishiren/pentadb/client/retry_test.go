@@ -0,0 +1,75 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+	"github.com/shenaishiren/pentadb/opt"
+)
+
+func TestRetryable(t *testing.T) {
+	ctx := context.Background()
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	unavailable := fmt.Errorf("%w: node x", ErrUnavailable)
+	cases := []struct {
+		ctx    context.Context
+		err    error
+		sent   bool
+		method string
+		want   bool
+	}{
+		{ctx, unavailable, false, "Node.Migrate", true},
+		{ctx, unavailable, true, "Node.Migrate", false},
+		{ctx, unavailable, true, "Node.Incr", true},
+		{ctx, fmt.Errorf("%w: node x", ErrTimeout), true, "Node.Put", true},
+		{ctx, ErrNotFound, true, "Node.Get", false},
+		{ctx, fmt.Errorf("%w: %w", ErrUnavailable, errPoolClosed), false, "Node.Get", false},
+		{canceled, unavailable, false, "Node.Get", false},
+		{ctx, fmt.Errorf("%w: node x", ErrCircuitOpen), false, "Node.Get", false},
+	}
+	for i, c := range cases {
+		if got := retryable(c.ctx, c.err, c.sent, c.method); got != c.want {
+			t.Errorf("case %d: retryable = %v, want %v", i, got, c.want)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	options := &opt.ClientOptions{RetryBackoff: 10 * time.Millisecond, MaxRetryBackoff: 50 * time.Millisecond, RetryJitter: -1}
+	want := []time.Duration{10, 20, 40, 50, 50}
+	for i, w := range want {
+		if d := backoff(options, i + 1); d != w * time.Millisecond {
+			t.Errorf("attempt %d: backoff %s, want %s", i + 1, d, w * time.Millisecond)
+		}
+	}
+	options.RetryJitter = 0.5
+	for i := 0; i < 100; i++ {
+		if d := backoff(options, 1); d < 5 * time.Millisecond || d > 10 * time.Millisecond {
+			t.Fatalf("jittered backoff %s out of range", d)
+		}
+	}
+}
+
+func TestRetryCircuitOpen(t *testing.T) {
+	addr, _, closeEcho := serveEcho(t)
+	defer closeEcho()
+	options := &opt.ClientOptions{MaxAttempts: 5, RetryBackoff: time.Second, BreakerThreshold: 1, BreakerOpenTimeout: time.Minute}
+	np := newNodeProxy(&Node{Ipaddr: addr}, options)
+	defer np.Close()
+	generation, _ := np.breaker.allow()
+	np.breaker.done(generation, fmt.Errorf("%w: node x", ErrUnavailable))
+
+	start := time.Now()
+	var pong []byte
+	err := np.call(context.Background(), "Node.Ping", []byte("ping"), &pong)
+	if !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("call on an open breaker: %v", err)
+	}
+	// no backoff, so no second attempt
+	if elapsed := time.Since(start); elapsed >= options.RetryBackoff {
+		t.Fatalf("call on an open breaker took %s", elapsed)
+	}
+}
@@ -0,0 +1,314 @@
+// Contains the consistent snapshots of a whole cluster
+
+/* BSD 3-Clause License
+
+Copyright (c) 2017, Guan Jiawen, Li Lundong
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice, this
+  list of conditions and the following disclaimer.
+
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+
+* Neither the name of the copyright holder nor the names of its
+  contributors may be used to endorse or promote products derived from
+  this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package client
+
+import (
+	"os"
+	"sync"
+	"time"
+	"bytes"
+	"errors"
+	"context"
+	"strings"
+	"encoding/json"
+	"path/filepath"
+	"github.com/shenaishiren/pentadb/opt"
+	"github.com/shenaishiren/pentadb/args"
+	"github.com/shenaishiren/pentadb/archive"
+)
+
+// name of the manifest in a snapshot directory, written last
+const manifestName = "manifest.json"
+
+// A snapshot of a cluster, the ring it was taken from and one
+// archive per node, all taken at the same write barrier
+type SnapshotManifest struct {
+	Time time.Time
+
+	Nodes []SnapshotNode
+}
+
+type SnapshotNode struct {
+	Ipaddr string
+
+	Weight int
+
+	// file name of the archive in the snapshot directory
+	Archive string
+
+	Pairs int64
+
+	// sha256 in hex of the archive
+	Checksum string
+}
+
+// Snapshot writes a consistent snapshot of the cluster into `dir`,
+// a local directory. Every node stops writes until all nodes have
+// taken their snapshot, then the snapshots are read while writes go on.
+func (c *Client) Snapshot(ctx context.Context, dir string) (*SnapshotManifest, error) {
+	if _, err := os.Stat(filepath.Join(dir, manifestName)); err == nil {
+		return nil, errors.New("a snapshot exists already in " + dir)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	c.mu.RLock()
+	var nodes []*Node
+	for _, node := range c.nodes {
+		nodes = append(nodes, node)
+	}
+	c.mu.RUnlock()
+
+	ids, err := c.freeze(ctx, nodes)
+	if err != nil {
+		return nil, err
+	}
+	manifest := &SnapshotManifest{Time: time.Now(), Nodes: make([]SnapshotNode, len(nodes))}
+	errs := make([]error, len(nodes))
+	var wg sync.WaitGroup
+	for i, node := range nodes {
+		wg.Add(1)
+		go func(i int, node *Node) {
+			defer wg.Done()
+			name := strings.Replace(node.Ipaddr, ":", "_", -1) + ".pentadb"
+			summary, err := node.Proxy.readBackupFile(ctx, ids[i], filepath.Join(dir, name))
+			manifest.Nodes[i] = SnapshotNode{
+				Ipaddr:   node.Ipaddr,
+				Weight:   node.Weight,
+				Archive:  name,
+				Pairs:    summary.Pairs,
+				Checksum: summary.Checksum,
+			}
+			errs[i] = err
+		}(i, node)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFileAtomic(filepath.Join(dir, manifestName), data); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// Freeze all nodes, then thaw them, and return the ids of the snapshots
+// taken. Nodes busy with transactions are tried again later, and so are
+// all nodes if one thawed by itself before the others froze, since its
+// snapshot is then not taken at the same barrier.
+func (c *Client) freeze(ctx context.Context, nodes []*Node) ([]string, error) {
+	for attempt := 1; ; attempt++ {
+		ids := make([]string, len(nodes))
+		errs := make([]error, len(nodes))
+		var wg sync.WaitGroup
+		for i, node := range nodes {
+			wg.Add(1)
+			go func(i int, node *Node) {
+				defer wg.Done()
+				ids[i], errs[i] = node.Proxy.freeze(ctx)
+			}(i, node)
+		}
+		wg.Wait()
+		// writes go on everywhere once all nodes are frozen, or
+		// as soon as one failed to
+		var firstErr error
+		for i, node := range nodes {
+			if errs[i] == nil {
+				if err := node.Proxy.thaw(ids[i]); err != nil {
+					LOG.Warningf("thaw node %s: %s", node.Ipaddr, err.Error())
+					if firstErr == nil {
+						firstErr = err
+					}
+				}
+				continue
+			}
+			if firstErr == nil || errors.Is(firstErr, ErrBusy) {
+				firstErr = errs[i]
+			}
+		}
+		if firstErr == nil {
+			return ids, nil
+		}
+		for i, node := range nodes {
+			if errs[i] == nil {
+				node.Proxy.releaseBackup(ids[i])
+			}
+		}
+		if !errors.Is(firstErr, ErrBusy) || attempt >= opt.DefaultFreezeAttempts {
+			return nil, firstErr
+		}
+		select {
+		case <-time.After(backoff(c.options, attempt)):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// ReadSnapshotManifest reads the manifest of a snapshot written by Snapshot
+func ReadSnapshotManifest(dir string) (*SnapshotManifest, error) {
+	data, err := os.ReadFile(filepath.Join(dir, manifestName))
+	if err != nil {
+		return nil, err
+	}
+	manifest := new(SnapshotManifest)
+	if err := json.Unmarshal(data, manifest); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// Restore writes the pairs of a snapshot into the cluster of the client,
+// which may have other nodes than the snapshotted one. All archives are
+// verified before anything is written. Pairs keep their expiries, but
+// revisions start anew, so watchers cannot resume across a restore.
+// Keys the cluster holds already are overwritten or kept, never removed.
+func (c *Client) Restore(ctx context.Context, dir string) (*SnapshotManifest, error) {
+	manifest, err := ReadSnapshotManifest(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, node := range manifest.Nodes {
+		if err := verifyArchive(filepath.Join(dir, node.Archive), node); err != nil {
+			return nil, err
+		}
+	}
+	// a key may be left on a node which no longer owns it,
+	// only the copy of its owner at snapshot time is current
+	weights := make(map[string]int)
+	for _, node := range manifest.Nodes {
+		weights[node.Ipaddr] = node.Weight
+		if node.Weight <= 0 {
+			weights[node.Ipaddr] = defaultWeight
+		}
+	}
+	ring := layoutHashRing(weights)
+	for _, node := range manifest.Nodes {
+		if err := c.restoreArchive(ctx, filepath.Join(dir, node.Archive), node.Ipaddr, ring); err != nil {
+			return nil, err
+		}
+	}
+	return manifest, nil
+}
+
+func verifyArchive(path string, node SnapshotNode) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	summary, err := archive.Verify(f)
+	if err != nil {
+		return errors.New(path + ": " + err.Error())
+	}
+	if summary.Pairs != node.Pairs || summary.Checksum != node.Checksum {
+		return errors.New(path + ": " + archive.ErrChecksum.Error())
+	}
+	return nil
+}
+
+// send the user pairs of the archive of node `ipaddr` to their owners
+// in batches, skipping pairs owned by another node in `ring`
+func (c *Client) restoreArchive(ctx context.Context, path string, ipaddr string, ring *HashRing) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r, err := archive.NewReader(f)
+	if err != nil {
+		return err
+	}
+	pending := make(map[*Node][]args.KVArgs)
+	flush := func(node *Node) error {
+		kvs := pending[node]
+		delete(pending, node)
+		return node.Proxy.restorePairs(ctx, kvs)
+	}
+	skipped := 0
+	for r.Next() {
+		if bytes.HasPrefix(r.Key(), []byte(args.InternalPrefix)) {
+			continue
+		}
+		owner, err := ring.Owner(r.Key())
+		if err != nil {
+			return err
+		}
+		if owner.Ipaddr != ipaddr {
+			skipped++
+			continue
+		}
+		node, err := c.locate(r.Key())
+		if err != nil {
+			return err
+		}
+		// Key and Value are only valid until Next
+		pending[node] = append(pending[node], args.KVArgs{
+			Key:   append([]byte(nil), r.Key()...),
+			Value: append([]byte(nil), r.Value()...),
+		})
+		if len(pending[node]) >= opt.DefaultBackupPageSize {
+			if err := flush(node); err != nil {
+				return err
+			}
+		}
+	}
+	if err := r.Err(); err != nil {
+		return err
+	}
+	for node := range pending {
+		if err := flush(node); err != nil {
+			return err
+		}
+	}
+	if skipped > 0 {
+		LOG.Warningf("skipped %d pairs of %s owned by other nodes", skipped, path)
+	}
+	return nil
+}
+
+// write a file through a temporary one, so it is complete or missing
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,268 @@
+// Contains the watchers of key changes of Client
+
+/* BSD 3-Clause License
+
+Copyright (c) 2017, Guan Jiawen, Li Lundong
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice, this
+  list of conditions and the following disclaimer.
+
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+
+* Neither the name of the copyright holder nor the names of its
+  contributors may be used to endorse or promote products derived from
+  this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+
+
+package client
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+	"github.com/shenaishiren/pentadb/args"
+	"github.com/shenaishiren/pentadb/opt"
+)
+
+type EventType int
+
+const (
+	EventPut EventType = iota
+	EventDelete
+)
+
+// A change of one key. Revisions count per node, so an event is
+// identified by its node together with its revision.
+type Event struct {
+	Type EventType
+
+	Key []byte
+
+	// the new value of a put
+	Value []byte
+
+	// address of the node where the change happened
+	Node string
+
+	// sequence number in the change log of the node
+	Revision int64
+
+	// when the node applied the change
+	Time time.Time
+}
+
+// A Watcher streams changes from all nodes. Changes of one node
+// come in order, there is no order across nodes.
+type Watcher struct {
+	events chan Event
+
+	ctx context.Context
+
+	cancel context.CancelFunc
+
+	mu *sync.Mutex
+
+	// the last revision seen of each node
+	revisions map[string]int64
+
+	err error
+}
+
+// fetch the changes of a node after a revision,
+// also return the revision read up to
+type fetchFunc func(ctx context.Context, node *Node, after int64) ([]args.Event, int64, error)
+
+// Watch streams the changes of keys starting with `prefix`
+// made from now on, until the watcher is closed
+func (c *Client) Watch(prefix []byte) *Watcher {
+	return c.WatchFrom(prefix, nil)
+}
+
+// WatchFrom is like Watch, but resumes after the revisions returned by
+// Watcher.Revisions. Nodes missing from `revisions` are watched from now.
+// The watcher stops with ErrCompacted if a node has forgotten the changes.
+func (c *Client) WatchFrom(prefix []byte, revisions map[string]int64) *Watcher {
+	return c.watch(prefix, revisions, false)
+}
+
+func (c *Client) watch(prefix []byte, revisions map[string]int64, keysOnly bool) *Watcher {
+	return c.newWatcher(revisions, func(ctx context.Context, node *Node, after int64) ([]args.Event, int64, error) {
+		ctx, cancel := context.WithTimeout(ctx, opt.DefaultWatchWait + opt.DefaultTimeout)
+		defer cancel()
+		watchArgs := &args.WatchArgs{Prefix: prefix, After: after, KeysOnly: keysOnly}
+		reply, err := node.Proxy.Watch(ctx, watchArgs)
+		if err != nil {
+			return nil, 0, err
+		}
+		return reply.Events, reply.Revision, nil
+	})
+}
+
+// TailChanges streams the change logs of all nodes merged into one,
+// resuming after the revisions returned by Watcher.Revisions. Nodes
+// missing from `from` are read from their oldest change kept.
+// Unlike Watch, it polls and reads changes of every key.
+func (c *Client) TailChanges(from map[string]int64) *Watcher {
+	return c.newWatcher(from, func(ctx context.Context, node *Node, after int64) ([]args.Event, int64, error) {
+		readCtx, cancel := context.WithTimeout(ctx, opt.DefaultTimeout)
+		defer cancel()
+		reply, err := node.Proxy.ReadChanges(readCtx, after + 1, opt.DefaultWatchBatchSize)
+		if err != nil {
+			return nil, 0, err
+		}
+		if len(reply.Events) == 0 {
+			// caught up, wait for more changes
+			select {
+			case <-ctx.Done():
+			case <-time.After(opt.DefaultChangePollInterval):
+			}
+		}
+		return reply.Events, reply.LastSeq, nil
+	})
+}
+
+func (c *Client) newWatcher(revisions map[string]int64, fetch fetchFunc) *Watcher {
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &Watcher{
+		events:    make(chan Event),
+		ctx:       ctx,
+		cancel:    cancel,
+		mu:        new(sync.Mutex),
+		revisions: make(map[string]int64),
+	}
+	// nodes joining later are not watched
+	c.mu.RLock()
+	var nodes []*Node
+	for _, node := range c.nodes {
+		nodes = append(nodes, node)
+	}
+	c.mu.RUnlock()
+
+	// changes made after Watch returns must not be missed,
+	// so wait until every node was asked once
+	var wg, ready sync.WaitGroup
+	for _, node := range nodes {
+		after, ok := revisions[node.Ipaddr]
+		if !ok {
+			after = -1
+		}
+		wg.Add(1)
+		ready.Add(1)
+		go func(node *Node) {
+			defer wg.Done()
+			w.watchNode(node, after, fetch, ready.Done)
+		}(node)
+	}
+	ready.Wait()
+	go func() {
+		wg.Wait()
+		close(w.events)
+	}()
+	return w
+}
+
+// poll a node until the watcher is closed
+func (w *Watcher) watchNode(node *Node, after int64, fetch fetchFunc, ready func()) {
+	once := new(sync.Once)
+	defer once.Do(ready)
+	for w.ctx.Err() == nil {
+		events, seen, err := fetch(w.ctx, node, after)
+		once.Do(ready)
+		if errors.Is(err, ErrCompacted) {
+			w.fail(err)
+			return
+		}
+		if err != nil {
+			// the node is down or restarting, try again later
+			select {
+			case <-w.ctx.Done():
+			case <-time.After(opt.DefaultTimeout):
+			}
+			continue
+		}
+		for _, event := range events {
+			// count the event as seen before handing it over,
+			// and take it back if it is never received
+			w.seen(node.Ipaddr, event.Revision)
+			select {
+			case w.events <- Event{
+				Type:     EventType(event.Type),
+				Key:      event.Key,
+				Value:    event.Value,
+				Node:     node.Ipaddr,
+				Revision: event.Revision,
+				Time:     time.Unix(0, event.Time),
+			}:
+			case <-w.ctx.Done():
+				w.seen(node.Ipaddr, after)
+				return
+			}
+			after = event.Revision
+		}
+		after = seen
+		w.seen(node.Ipaddr, after)
+	}
+}
+
+func (w *Watcher) seen(node string, revision int64) {
+	w.mu.Lock()
+	w.revisions[node] = revision
+	w.mu.Unlock()
+}
+
+// stop the watcher with an error, the first one is kept
+func (w *Watcher) fail(err error) {
+	w.mu.Lock()
+	if w.err == nil {
+		w.err = err
+	}
+	w.mu.Unlock()
+	w.cancel()
+}
+
+// Events is closed when the watcher stops, see Err
+func (w *Watcher) Events() <-chan Event { return w.events }
+
+// Revisions returns the last revision seen of each node, pass them
+// to WatchFrom to resume. They are exact once Events is closed.
+func (w *Watcher) Revisions() map[string]int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	revisions := make(map[string]int64, len(w.revisions))
+	for node, revision := range w.revisions {
+		revisions[node] = revision
+	}
+	return revisions
+}
+
+// Err returns why the watcher stopped, nil if it was closed
+func (w *Watcher) Err() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+func (w *Watcher) Close() {
+	w.cancel()
+}
@@ -0,0 +1,143 @@
+// Contains the implementation of atomic write batch
+
+/* BSD 3-Clause License
+
+Copyright (c) 2017, Guan Jiawen, Li Lundong
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice, this
+  list of conditions and the following disclaimer.
+
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+
+* Neither the name of the copyright holder nor the names of its
+  contributors may be used to endorse or promote products derived from
+  this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+
+package client
+
+import (
+	"fmt"
+	"sync"
+	"context"
+	"github.com/satori/go.uuid"
+	"github.com/shenaishiren/pentadb/args"
+)
+
+// WriteBatch collects puts and deletes which are applied all or none.
+// A batch whose keys live on one node is written atomically by that
+// node, other batches need ClientOptions.CrossShardTxn.
+type WriteBatch struct {
+	ops []args.BatchOp
+}
+
+func NewWriteBatch() *WriteBatch {
+	return new(WriteBatch)
+}
+
+func (b *WriteBatch) Put(key []byte, value []byte) {
+	b.ops = append(b.ops, args.BatchOp{Type: args.OpPut, Key: key, Value: value})
+}
+
+func (b *WriteBatch) Delete(key []byte) {
+	b.ops = append(b.ops, args.BatchOp{Type: args.OpDelete, Key: key})
+}
+
+// number of operations in batch
+func (b *WriteBatch) Len() int {
+	return len(b.ops)
+}
+
+func (b *WriteBatch) Reset() {
+	b.ops = b.ops[:0]
+}
+
+func (c *Client) Write(b *WriteBatch) error {
+	return c.WriteContext(context.Background(), b)
+}
+
+// WriteContext is like Write, but gives up once ctx is done
+func (c *Client) WriteContext(ctx context.Context, b *WriteBatch) error {
+	if b.Len() == 0 {
+		return nil
+	}
+	keys := make([][]byte, len(b.ops))
+	for i, op := range b.ops {
+		keys[i] = op.Key
+	}
+	groups, err := c.groupByNode(keys)
+	if err != nil {
+		return err
+	}
+	defer c.invalidate(keys...)
+	if len(groups) == 1 {
+		for node := range groups {
+			return node.Proxy.Write(ctx, b.ops)
+		}
+	}
+	if !c.options.GetCrossShardTxn() {
+		return fmt.Errorf("%w: %d nodes", ErrCrossShard, len(groups))
+	}
+	return c.commitTxn(ctx, b.ops, groups)
+}
+
+// apply ops on several nodes by two-phase commit. Prepared state is
+// kept in memory of nodes, so a node crashing between the phases can
+// leave the transaction partially applied.
+func (c *Client) commitTxn(ctx context.Context, ops []args.BatchOp, groups map[*Node][]int) error {
+	txnID := uuid.NewV1().String()
+	var mu sync.Mutex
+	var prepareErr error
+	fanOut(groups, func(node *Node, indexes []int) {
+		nodeOps := make([]args.BatchOp, len(indexes))
+		for j, i := range indexes {
+			nodeOps[j] = ops[i]
+		}
+		if err := node.Proxy.Prepare(ctx, txnID, nodeOps); err != nil {
+			mu.Lock()
+			if prepareErr == nil {
+				prepareErr = err
+			}
+			mu.Unlock()
+		}
+	})
+	// abort without ctx, the nodes should release locks anyway
+	if prepareErr != nil {
+		fanOut(groups, func(node *Node, indexes []int) {
+			node.Proxy.Abort(context.Background(), txnID)
+		})
+		return prepareErr
+	}
+	// every node voted yes, commit must not be given up halfway. A node
+	// answering ErrTxnAborted has dropped its part, which others may
+	// have applied already, so it fails the transaction like any error.
+	var commitErr error
+	fanOut(groups, func(node *Node, indexes []int) {
+		if err := node.Proxy.Commit(context.Background(), txnID); err != nil {
+			mu.Lock()
+			if commitErr == nil {
+				commitErr = fmt.Errorf("transaction %s partially committed: %w", txnID, err)
+			}
+			mu.Unlock()
+		}
+	})
+	return commitErr
+}
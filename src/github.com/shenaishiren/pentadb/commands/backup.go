@@ -0,0 +1,339 @@
+// Contains the backup, snapshot and restore commands
+
+/* BSD 3-Clause License
+
+Copyright (c) 2017, Guan Jiawen, Li Lundong
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice, this
+  list of conditions and the following disclaimer.
+
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+
+* Neither the name of the copyright holder nor the names of its
+  contributors may be used to endorse or promote products derived from
+  this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"os"
+	"io"
+	"fmt"
+	"flag"
+	"time"
+	"bufio"
+	"errors"
+	"context"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/shenaishiren/pentadb/opt"
+	"github.com/shenaishiren/pentadb/archive"
+	"github.com/shenaishiren/pentadb/client"
+)
+
+var backupHelpPrompt = `Usage: pentadb backup --node <node> (--dir <dir> | --out <file>) [options]
+
+Back up a snapshot of a running node, writes go on meanwhile
+
+Options:
+	--help           		Display this help message and exit
+	--node <node>    		The node address, e.g. 10.0.0.1:4567
+	--dir <dir>      		Write the archive into a directory on the node
+	--out <file>     		Stream the archive into a local file, - for stdout
+`
+
+var snapshotHelpPrompt = `Usage: pentadb snapshot --nodes <nodes> --dir <dir> [options]
+
+Take a consistent snapshot of a whole cluster into a local directory.
+Writes stop on every node until all of them have taken their snapshot.
+
+Options:
+	--help           		Display this help message and exit
+	--nodes <nodes>  		Comma separated node addresses, e.g. 10.0.0.1:4567,10.0.0.2:4567
+	--weights <weights>		Comma separated node weights, e.g. 10.0.0.1:4567=2
+	--dir <dir>      		The directory to create the snapshot in
+`
+
+var restoreHelpPrompt = `Usage: pentadb restore --archive <file> --path <path> [options]
+       pentadb restore --snapshot <dir> --nodes <nodes> [options]
+
+Rebuild the LevelDB store of a node from a backup archive, the node
+must not be running on the path. Or write a cluster snapshot into a
+running cluster, which may have a different number of nodes. Keys the
+cluster already holds are not removed, restore into an empty cluster
+to get exactly the snapshot.
+
+Options:
+	--help           		Display this help message and exit
+	--archive <file> 		The archive to restore, - for stdin
+	--path <path>    		The path of the LevelDB store to create
+	--checksum <sum> 		The sha256 the archive must have, as reported by backup
+	--force          		Replace an existing store, it is kept as <path>.replaced-<time>
+	--snapshot <dir> 		The cluster snapshot to restore
+	--nodes <nodes>  		Comma separated addresses of the nodes to restore into
+	--weights <weights>		Comma separated node weights, e.g. 10.0.0.1:4567=2
+`
+
+// pairs written in one batch while restoring
+const restoreBatchSize = 1024
+
+func backupCommand(arguments []string) {
+	var (
+		help bool
+		node string
+		dir string
+		out string
+	)
+	flags := flag.NewFlagSet("backup", flag.ExitOnError)
+	flags.BoolVar(&help, "help", false, "Display this help message and exit")
+	flags.StringVar(&node, "node", "", "The node address")
+	flags.StringVar(&dir, "dir", "", "Write the archive into a directory on the node")
+	flags.StringVar(&out, "out", "", "Stream the archive into a local file")
+	flags.Usage = func() {
+		fmt.Println(backupHelpPrompt)
+	}
+	flags.Parse(arguments)
+
+	if help || node == "" || (dir == "") == (out == "") {
+		fmt.Print(backupHelpPrompt)
+		return
+	}
+	proxy := client.NewNodeProxy(&client.Node{Name: node, Ipaddr: node})
+	if proxy == nil {
+		LOG.Errorf("node %s is unreachable", node)
+		os.Exit(1)
+	}
+	defer proxy.Close()
+
+	if dir != "" {
+		reply, err := proxy.Backup(context.Background(), dir)
+		if err != nil {
+			LOG.Error("backup failed: ", err.Error())
+			os.Exit(1)
+		}
+		fmt.Fprintf(os.Stderr, "%s: %d pairs, sha256 %s\n", reply.Path, reply.Pairs, reply.Checksum)
+		return
+	}
+	if err := streamBackup(proxy, out); err != nil {
+		LOG.Error("backup failed: ", err.Error())
+		os.Exit(1)
+	}
+}
+
+func streamBackup(proxy *client.NodeProxy, out string) error {
+	if out == "-" {
+		summary, err := proxy.BackupTo(context.Background(), os.Stdout)
+		if err == nil {
+			fmt.Fprintln(os.Stderr, summary)
+		}
+		return err
+	}
+	summary, err := proxy.BackupToFile(context.Background(), out)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "%s: %s\n", out, summary)
+	return nil
+}
+
+// connect a client to the nodes of a cluster, exit on failure
+func dialCluster(nodes string, weights string) *client.Client {
+	weightDict, err := parseWeights(weights)
+	if err != nil {
+		LOG.Error(err.Error())
+		os.Exit(1)
+	}
+	c, err := client.NewClient(parseNodes(nodes), weightDict, opt.DefaultReplicas)
+	if err != nil {
+		LOG.Error("connect to cluster failed: ", err.Error())
+		os.Exit(1)
+	}
+	return c
+}
+
+func snapshotCommand(arguments []string) {
+	var (
+		help bool
+		nodes string
+		weights string
+		dir string
+	)
+	flags := flag.NewFlagSet("snapshot", flag.ExitOnError)
+	flags.BoolVar(&help, "help", false, "Display this help message and exit")
+	flags.StringVar(&nodes, "nodes", "", "Comma separated node addresses")
+	flags.StringVar(&weights, "weights", "", "Comma separated node weights")
+	flags.StringVar(&dir, "dir", "", "The directory to create the snapshot in")
+	flags.Usage = func() {
+		fmt.Println(snapshotHelpPrompt)
+	}
+	flags.Parse(arguments)
+
+	if help || nodes == "" || dir == "" {
+		fmt.Print(snapshotHelpPrompt)
+		return
+	}
+	c := dialCluster(nodes, weights)
+	defer c.Close()
+	manifest, err := c.Snapshot(context.Background(), dir)
+	if err != nil {
+		LOG.Error("snapshot failed: ", err.Error())
+		os.Exit(1)
+	}
+	for _, node := range manifest.Nodes {
+		fmt.Fprintf(os.Stderr, "%s: %d pairs, sha256 %s\n", node.Ipaddr, node.Pairs, node.Checksum)
+	}
+}
+
+func restoreCommand(arguments []string) {
+	var (
+		help bool
+		archivePath string
+		path string
+		checksum string
+		force bool
+		snapshot string
+		nodes string
+		weights string
+	)
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	flags.BoolVar(&help, "help", false, "Display this help message and exit")
+	flags.StringVar(&archivePath, "archive", "", "The archive to restore")
+	flags.StringVar(&path, "path", "", "The path of the LevelDB store to create")
+	flags.StringVar(&checksum, "checksum", "", "The sha256 the archive must have")
+	flags.BoolVar(&force, "force", false, "Replace an existing store")
+	flags.StringVar(&snapshot, "snapshot", "", "The cluster snapshot to restore")
+	flags.StringVar(&nodes, "nodes", "", "Comma separated addresses of the nodes to restore into")
+	flags.StringVar(&weights, "weights", "", "Comma separated node weights")
+	flags.Usage = func() {
+		fmt.Println(restoreHelpPrompt)
+	}
+	flags.Parse(arguments)
+
+	if help {
+		fmt.Print(restoreHelpPrompt)
+		return
+	}
+	if snapshot != "" && nodes != "" {
+		c := dialCluster(nodes, weights)
+		defer c.Close()
+		manifest, err := c.Restore(context.Background(), snapshot)
+		if err != nil {
+			LOG.Error("restore failed: ", err.Error())
+			os.Exit(1)
+		}
+		fmt.Fprintf(os.Stderr, "restored the snapshot of %d nodes taken at %s\n", len(manifest.Nodes), manifest.Time)
+		return
+	}
+	if archivePath == "" || path == "" {
+		fmt.Print(restoreHelpPrompt)
+		return
+	}
+	var in io.Reader = os.Stdin
+	if archivePath != "-" {
+		f, err := os.Open(archivePath)
+		if err != nil {
+			LOG.Error("open archive error: ", err.Error())
+			os.Exit(1)
+		}
+		defer f.Close()
+		in = f
+	}
+	summary, err := restore(bufio.NewReader(in), path, checksum, force)
+	if err != nil {
+		LOG.Error("restore failed: ", err.Error())
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stderr, "restored %s into %s\n", summary, path)
+}
+
+// Load the archive into a new store next to `path` and move it into
+// place only once the checksum is verified
+func restore(r io.Reader, path string, checksum string, force bool) (archive.Summary, error) {
+	existing, err := os.ReadDir(path)
+	if err != nil && !os.IsNotExist(err) {
+		return archive.Summary{}, err
+	}
+	if len(existing) > 0 {
+		if !force {
+			return archive.Summary{}, errors.New(fmt.Sprintf("%s is not empty, use --force to replace it", path))
+		}
+		// fails if a node is running on it
+		db, err := leveldb.OpenFile(path, nil)
+		if err != nil {
+			return archive.Summary{}, err
+		}
+		db.Close()
+	}
+
+	tmp := path + ".restoring"
+	if err := os.RemoveAll(tmp); err != nil {
+		return archive.Summary{}, err
+	}
+	summary, err := load(r, tmp)
+	if err == nil && checksum != "" && summary.Checksum != checksum {
+		err = archive.ErrChecksum
+	}
+	if err != nil {
+		os.RemoveAll(tmp)
+		return summary, err
+	}
+
+	if len(existing) > 0 {
+		old := path + ".replaced-" + time.Now().UTC().Format("20060102T150405Z")
+		if err := os.Rename(path, old); err != nil {
+			return summary, err
+		}
+		LOG.Infof("the replaced store is kept in %s", old)
+	} else if err := os.RemoveAll(path); err != nil {
+		return summary, err
+	}
+	return summary, os.Rename(tmp, path)
+}
+
+// write the pairs of an archive into a new store at `path`
+func load(r io.Reader, path string) (archive.Summary, error) {
+	ar, err := archive.NewReader(r)
+	if err != nil {
+		return archive.Summary{}, err
+	}
+	db, err := leveldb.OpenFile(path, nil)
+	if err != nil {
+		return archive.Summary{}, err
+	}
+	defer db.Close()
+
+	batch := new(leveldb.Batch)
+	for ar.Next() {
+		batch.Put(ar.Key(), ar.Value())
+		if batch.Len() >= restoreBatchSize {
+			if err := db.Write(batch, nil); err != nil {
+				return archive.Summary{}, err
+			}
+			batch.Reset()
+		}
+	}
+	if err := ar.Err(); err != nil {
+		return archive.Summary{}, err
+	}
+	if err := db.Write(batch, nil); err != nil {
+		return archive.Summary{}, err
+	}
+	return ar.Summary(), db.Close()
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"os"
+	"bytes"
+	"testing"
+	"path/filepath"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/shenaishiren/pentadb/archive"
+)
+
+func testArchive(t *testing.T, value string) ([]byte, archive.Summary) {
+	var buf bytes.Buffer
+	w, err := archive.NewWriter(&buf)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	w.Add([]byte("a"), []byte(value))
+	summary, err := w.Close()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return buf.Bytes(), summary
+}
+
+func readStore(t *testing.T, path string) string {
+	db, err := leveldb.OpenFile(path, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer db.Close()
+	value, err := db.Get([]byte("a"), nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return string(value)
+}
+
+func TestRestore(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "store")
+	first, summary := testArchive(t, "1")
+	if _, err := restore(bytes.NewReader(first), path, summary.Checksum, false); err != nil {
+		t.Fatal(err.Error())
+	}
+	second, summary := testArchive(t, "2")
+	if _, err := restore(bytes.NewReader(second), path, summary.Checksum, false); err == nil {
+		t.Fatal("existing store replaced without --force")
+	}
+	// a checksum mismatch leaves the store as it was
+	if _, err := restore(bytes.NewReader(second), path, "bad", true); err != archive.ErrChecksum {
+		t.Fatalf("restore with a wrong checksum: %v", err)
+	}
+	if value := readStore(t, path); value != "1" {
+		t.Fatalf("a = %q after a failed restore", value)
+	}
+	if _, err := os.Stat(path + ".restoring"); !os.IsNotExist(err) {
+		t.Fatalf("partial store left: %v", err)
+	}
+
+	if _, err := restore(bytes.NewReader(second), path, summary.Checksum, true); err != nil {
+		t.Fatal(err.Error())
+	}
+	if value := readStore(t, path); value != "2" {
+		t.Fatalf("a = %q after a forced restore", value)
+	}
+	// the replaced store is kept
+	replaced, _ := filepath.Glob(path + ".replaced-*")
+	if len(replaced) != 1 || readStore(t, replaced[0]) != "1" {
+		t.Fatalf("replaced stores %v", replaced)
+	}
+}
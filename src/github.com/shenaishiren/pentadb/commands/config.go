@@ -0,0 +1,357 @@
+// Contains the configuration file and environment overrides of the server
+
+/* BSD 3-Clause License
+
+Copyright (c) 2017, Guan Jiawen, Li Lundong
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice, this
+  list of conditions and the following disclaimer.
+
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+
+* Neither the name of the copyright holder nor the names of its
+  contributors may be used to endorse or promote products derived from
+  this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"os"
+	"io"
+	"fmt"
+	"net"
+	"time"
+	"bufio"
+	"errors"
+	"strconv"
+	"strings"
+	"github.com/shenaishiren/pentadb/opt"
+)
+
+// Configuration of the server. It is read from a TOML file, then
+// overridden by PENTADB_<SECTION>_<KEY> environment variables and
+// lastly by the command line flags. For example:
+//
+//	[server]
+//	listen = "0.0.0.0:4567"
+//	path = "/var/lib/pentadb"
+//
+//	[cluster]
+//	self = "10.0.0.1:4567"
+//	peers = ["10.0.0.2:4567", "10.0.0.3:4567"]
+//	replicas = 1
+//
+//	[log]
+//	file = "/var/log/pentadb.log"
+//	color = false
+//
+//	[timeouts]
+//	idle = "5m"
+//	shutdown = "10s"
+//
+//	[leveldb]
+//	block_cache_size = 33554432
+//	bloom_bits_per_key = 10
+//	compression = "none"
+type Config struct {
+	Listen string
+
+	Path string
+
+	// the address peers and clients know the node by
+	Self string
+
+	// the other nodes of the cluster, clients calling Init replace them
+	Peers []string
+
+	Replicas int
+
+	// empty means standard output
+	LogFile string
+
+	LogColor bool
+
+	Options opt.ServerOptions
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		Listen:   ":4567",
+		Path:     opt.DeafultPath,
+		Replicas: opt.DefaultReplicas,
+		LogColor: true,
+	}
+}
+
+// setters of the config keys, named section.key
+var configKeys = map[string]func(c *Config, value string) error{
+	"server.listen": func(c *Config, value string) error {
+		if _, _, err := net.SplitHostPort(value); err != nil {
+			return err
+		}
+		c.Listen = value
+		return nil
+	},
+	"server.path": func(c *Config, value string) error {
+		c.Path = value
+		return nil
+	},
+	"server.change_log_size": intSetter(func(c *Config) *int { return &c.Options.ChangeLogSize }),
+	"cluster.self": func(c *Config, value string) error {
+		c.Self = value
+		return nil
+	},
+	"cluster.peers": func(c *Config, value string) error {
+		c.Peers = nil
+		for _, peer := range strings.Split(value, ",") {
+			if peer = strings.TrimSpace(peer); peer != "" {
+				c.Peers = append(c.Peers, peer)
+			}
+		}
+		return nil
+	},
+	"cluster.replicas": intSetter(func(c *Config) *int { return &c.Replicas }),
+	"log.file": func(c *Config, value string) error {
+		c.LogFile = value
+		return nil
+	},
+	"log.color": func(c *Config, value string) (err error) {
+		c.LogColor, err = strconv.ParseBool(value)
+		return err
+	},
+	"timeouts.idle":           durationSetter(func(c *Config) *time.Duration { return &c.Options.IdleTimeout }),
+	"timeouts.shutdown":       durationSetter(func(c *Config) *time.Duration { return &c.Options.ShutdownTimeout }),
+	"timeouts.txn":            durationSetter(func(c *Config) *time.Duration { return &c.Options.TxnTimeout }),
+	"timeouts.watch":          durationSetter(func(c *Config) *time.Duration { return &c.Options.WatchWait }),
+	"timeouts.sweep_interval": durationSetter(func(c *Config) *time.Duration { return &c.Options.SweepInterval }),
+	"leveldb.block_cache_size":      intSetter(func(c *Config) *int { return &c.Options.BlockCacheSize }),
+	"leveldb.write_buffer_size":     intSetter(func(c *Config) *int { return &c.Options.WriteBufferSize }),
+	"leveldb.bloom_bits_per_key":    intSetter(func(c *Config) *int { return &c.Options.BloomBitsPerKey }),
+	"leveldb.compaction_table_size": intSetter(func(c *Config) *int { return &c.Options.CompactionTableSize }),
+	"leveldb.open_files_cache_capacity": intSetter(func(c *Config) *int { return &c.Options.OpenFilesCacheCapacity }),
+	"leveldb.compression": func(c *Config, value string) error {
+		switch value {
+		case "snappy":
+			c.Options.NoCompression = false
+		case "none":
+			c.Options.NoCompression = true
+		default:
+			return errors.New(fmt.Sprintf("unknown compression %q, want snappy or none", value))
+		}
+		return nil
+	},
+}
+
+func intSetter(field func(c *Config) *int) func(c *Config, value string) error {
+	return func(c *Config, value string) error {
+		i, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		if i < 0 {
+			return errors.New(fmt.Sprintf("%d is negative", i))
+		}
+		*field(c) = i
+		return nil
+	}
+}
+
+func durationSetter(field func(c *Config) *time.Duration) func(c *Config, value string) error {
+	return func(c *Config, value string) error {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		*field(c) = d
+		return nil
+	}
+}
+
+func (c *Config) set(key string, value string) error {
+	setter, ok := configKeys[key]
+	if !ok {
+		return errors.New(fmt.Sprintf("unknown key %s", key))
+	}
+	if err := setter(c, value); err != nil {
+		return errors.New(fmt.Sprintf("%s: %s", key, err.Error()))
+	}
+	return nil
+}
+
+// replace the port of the listen address
+func (c *Config) setPort(port string) {
+	host, _, _ := net.SplitHostPort(c.Listen)
+	c.Listen = net.JoinHostPort(host, port)
+}
+
+func (c *Config) LoadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	values, err := parseTOML(f)
+	if err != nil {
+		return errors.New(fmt.Sprintf("%s: %s", path, err.Error()))
+	}
+	for _, kv := range values {
+		if err := c.set(kv[0], kv[1]); err != nil {
+			return errors.New(fmt.Sprintf("%s: %s", path, err.Error()))
+		}
+	}
+	return nil
+}
+
+// LoadEnv applies PENTADB_<SECTION>_<KEY> variables, and PENTADB_PORT
+// and PENTADB_PATH which entry.sh has always used
+func (c *Config) LoadEnv() error {
+	if port := os.Getenv("PENTADB_PORT"); port != "" {
+		c.setPort(port)
+	}
+	if path := os.Getenv("PENTADB_PATH"); path != "" {
+		c.Path = path
+	}
+	for key := range configKeys {
+		name := "PENTADB_" + strings.ToUpper(strings.Replace(key, ".", "_", 1))
+		if value, ok := os.LookupEnv(name); ok {
+			if err := c.set(key, value); err != nil {
+				return errors.New(fmt.Sprintf("%s: %s", name, err.Error()))
+			}
+		}
+	}
+	return nil
+}
+
+// Parse the subset of TOML used by config files: [section] headers,
+// key = value lines and # comments. Values are strings, integers,
+// booleans or arrays of them, arrays are returned comma separated.
+func parseTOML(r io.Reader) ([][2]string, error) {
+	var values [][2]string
+	section := ""
+	scanner := bufio.NewScanner(r)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(stripComment(scanner.Text()))
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") {
+				return nil, errors.New(fmt.Sprintf("line %d: bad section header", lineNo))
+			}
+			section = strings.TrimSpace(line[1:len(line) - 1])
+			continue
+		}
+		i := strings.Index(line, "=")
+		if i < 0 {
+			return nil, errors.New(fmt.Sprintf("line %d: want key = value", lineNo))
+		}
+		key := strings.TrimSpace(line[:i])
+		raw := strings.TrimSpace(line[i + 1:])
+		// arrays may span lines
+		for strings.HasPrefix(raw, "[") && !strings.HasSuffix(raw, "]") && scanner.Scan() {
+			lineNo++
+			raw += " " + strings.TrimSpace(stripComment(scanner.Text()))
+		}
+		value, err := parseValue(raw)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("line %d: %s", lineNo, err.Error()))
+		}
+		if section != "" {
+			key = section + "." + key
+		}
+		values = append(values, [2]string{key, value})
+	}
+	return values, scanner.Err()
+}
+
+// drop a comment which is not inside a string
+func stripComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		switch {
+		case quote != 0 && line[i] == '\\' && quote == '"':
+			i++
+		case quote != 0 && line[i] == quote:
+			quote = 0
+		case quote == 0 && (line[i] == '"' || line[i] == '\''):
+			quote = line[i]
+		case quote == 0 && line[i] == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
+
+func parseValue(raw string) (string, error) {
+	switch {
+	case raw == "":
+		return "", errors.New("missing value")
+	case strings.HasPrefix(raw, "["):
+		if !strings.HasSuffix(raw, "]") {
+			return "", errors.New("unterminated array")
+		}
+		var items []string
+		for _, item := range splitArray(raw[1:len(raw) - 1]) {
+			if item = strings.TrimSpace(item); item == "" {
+				continue
+			}
+			value, err := parseValue(item)
+			if err != nil {
+				return "", err
+			}
+			items = append(items, value)
+		}
+		return strings.Join(items, ","), nil
+	case strings.HasPrefix(raw, "\""):
+		return strconv.Unquote(raw)
+	case strings.HasPrefix(raw, "'"):
+		if len(raw) < 2 || !strings.HasSuffix(raw, "'") {
+			return "", errors.New("unterminated string")
+		}
+		return raw[1:len(raw) - 1], nil
+	}
+	// integers and booleans, TOML allows underscores in numbers
+	return strings.Replace(raw, "_", "", -1), nil
+}
+
+// split array items on commas outside strings
+func splitArray(s string) []string {
+	var items []string
+	var quote byte
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case quote != 0 && s[i] == '\\' && quote == '"':
+			i++
+		case quote != 0 && s[i] == quote:
+			quote = 0
+		case quote == 0 && (s[i] == '"' || s[i] == '\''):
+			quote = s[i]
+		case quote == 0 && s[i] == ',':
+			items = append(items, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(items, s[start:])
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"os"
+	"time"
+	"testing"
+	"path/filepath"
+)
+
+const testConfig = `
+# a node of a three node cluster
+[server]
+listen = "127.0.0.1:4567"
+path = '/var/lib/pentadb' # literal string
+
+[cluster]
+peers = [
+	"127.0.0.2:4567",  # one per line
+	"127.0.0.3:4567",
+]
+replicas = 2
+
+[log]
+color = false
+
+[timeouts]
+shutdown = "30s"
+
+[leveldb]
+block_cache_size = 33_554_432
+compression = "none"
+`
+
+func TestLoadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pentadb.toml")
+	if err := os.WriteFile(path, []byte(testConfig), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	t.Setenv("PENTADB_PORT", "5000")
+	t.Setenv("PENTADB_LEVELDB_BLOOM_BITS_PER_KEY", "10")
+
+	config := defaultConfig()
+	if err := config.LoadFile(path); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := config.LoadEnv(); err != nil {
+		t.Fatal(err.Error())
+	}
+	if config.Listen != "127.0.0.1:5000" || config.Path != "/var/lib/pentadb" {
+		t.Fatalf("listen %s path %s", config.Listen, config.Path)
+	}
+	if len(config.Peers) != 2 || config.Peers[1] != "127.0.0.3:4567" || config.Replicas != 2 {
+		t.Fatalf("peers %v replicas %d", config.Peers, config.Replicas)
+	}
+	if config.LogColor || config.Options.ShutdownTimeout != 30 * time.Second {
+		t.Fatalf("color %v shutdown %s", config.LogColor, config.Options.ShutdownTimeout)
+	}
+	options := config.Options
+	if options.BlockCacheSize != 33554432 || !options.NoCompression || options.BloomBitsPerKey != 10 {
+		t.Fatalf("leveldb options %+v", options)
+	}
+
+	// typos are reported instead of ignored
+	os.WriteFile(path, []byte("[leveldb]\nblock_cache = 1\n"), 0644)
+	if err := defaultConfig().LoadFile(path); err == nil {
+		t.Fatal("unknown key accepted")
+	}
+}
@@ -0,0 +1,362 @@
+// Contains the implementation of dump-command and load-command
+
+/* BSD 3-Clause License
+
+Copyright (c) 2017, Guan Jiawen, Li Lundong
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice, this
+  list of conditions and the following disclaimer.
+
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+
+* Neither the name of the copyright holder nor the names of its
+  contributors may be used to endorse or promote products derived from
+  this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+
+package main
+
+import (
+	"os"
+	"io"
+	"fmt"
+	"flag"
+	"time"
+	"errors"
+	"context"
+	"strconv"
+	"strings"
+	"github.com/shenaishiren/pentadb/args"
+	"github.com/shenaishiren/pentadb/dump"
+	"github.com/shenaishiren/pentadb/client"
+)
+
+var dumpHelpPrompt = `Usage: pentadb dump --nodes <nodes> --out <file> [options]
+
+Export every pair of a cluster into a portable file, writes go on
+meanwhile. The dump is not a consistent snapshot, see snapshot for one.
+
+Options:
+	--help           		Display this help message and exit
+	--nodes <nodes>  		Comma separated node addresses, e.g. 10.0.0.1:4567,10.0.0.2:4567
+	--weights <weights>		Comma separated node weights, e.g. 10.0.0.1:4567=2
+	--out <file>     		The file to write, - for stdout
+	--format <format>		json (one pair per line, base64 encoded, and a trailer) or binary (default: json)
+	--prefix <prefix>		Only dump keys with this prefix
+`
+
+var loadHelpPrompt = fmt.Sprintf(`Usage: pentadb load --nodes <nodes> --in <file> [options]
+
+Import a file written by dump into a cluster, which may have other
+nodes than the dumped one. Existing keys are overwritten. A file cut
+short fails the load, pairs before the cut may be written already.
+
+Options:
+	--help           		Display this help message and exit
+	--nodes <nodes>  		Comma separated node addresses, e.g. 10.0.0.1:4567,10.0.0.2:4567
+	--weights <weights>		Comma separated node weights, e.g. 10.0.0.1:4567=2
+	--in <file>      		The file to read, - for stdin
+	--batch <n>      		Pairs written in one batch (default: %d)
+	--resume         		Go on from where an interrupted load of the file stopped
+`, loadBatchSize)
+
+// pairs written in one batch while loading
+const loadBatchSize = 1024
+
+// how often progress is reported
+const progressInterval = time.Second
+
+func dumpCommand(arguments []string) {
+	var (
+		help bool
+		nodes string
+		weights string
+		out string
+		format string
+		prefix string
+	)
+	flags := flag.NewFlagSet("dump", flag.ExitOnError)
+	flags.BoolVar(&help, "help", false, "Display this help message and exit")
+	flags.StringVar(&nodes, "nodes", "", "Comma separated node addresses")
+	flags.StringVar(&weights, "weights", "", "Comma separated node weights")
+	flags.StringVar(&out, "out", "", "The file to write")
+	flags.StringVar(&format, "format", string(dump.FormatJSON), "json or binary")
+	flags.StringVar(&prefix, "prefix", "", "Only dump keys with this prefix")
+	flags.Usage = func() {
+		fmt.Println(dumpHelpPrompt)
+	}
+	flags.Parse(arguments)
+
+	if help || nodes == "" || out == "" {
+		fmt.Print(dumpHelpPrompt)
+		return
+	}
+	f, err := dump.ParseFormat(format)
+	if err != nil {
+		LOG.Error(err.Error())
+		os.Exit(1)
+	}
+	c := dialCluster(nodes, weights)
+	defer c.Close()
+
+	var pairs int64
+	if out == "-" {
+		pairs, err = dumpCluster(c, os.Stdout, f, []byte(prefix))
+	} else {
+		pairs, err = dumpToFile(c, out, f, []byte(prefix))
+	}
+	if err != nil {
+		LOG.Error("dump failed: ", err.Error())
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stderr, "dumped %d pairs\n", pairs)
+}
+
+// write the dump through a temporary file, so it is complete or missing
+func dumpToFile(c *client.Client, path string, format dump.Format, prefix []byte) (int64, error) {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return 0, err
+	}
+	pairs, err := dumpCluster(c, f, format, prefix)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return pairs, err
+	}
+	return pairs, os.Rename(tmp, path)
+}
+
+// scan every node and write the pairs in key order
+func dumpCluster(c *client.Client, w io.Writer, format dump.Format, prefix []byte) (int64, error) {
+	dw, err := dump.NewWriter(w, format)
+	if err != nil {
+		return 0, err
+	}
+	var it *client.Iterator
+	if len(prefix) > 0 {
+		it = c.ScanPrefix(prefix, 0)
+	} else {
+		it = c.Scan(nil, nil, 0)
+	}
+	progress := newProgress("dumped", 0)
+	for it.Next() {
+		pair := &dump.Pair{Key: it.Key(), Value: it.Value()}
+		if expire := it.ExpireAt(); !expire.IsZero() {
+			pair.ExpireAt = expire.UnixNano()
+		}
+		if err := dw.Add(pair); err != nil {
+			return dw.Pairs(), err
+		}
+		progress.report(dw.Pairs())
+	}
+	if err := it.Err(); err != nil {
+		return dw.Pairs(), err
+	}
+	return dw.Pairs(), dw.Close()
+}
+
+func loadCommand(arguments []string) {
+	var (
+		help bool
+		nodes string
+		weights string
+		in string
+		batch int
+		resume bool
+	)
+	flags := flag.NewFlagSet("load", flag.ExitOnError)
+	flags.BoolVar(&help, "help", false, "Display this help message and exit")
+	flags.StringVar(&nodes, "nodes", "", "Comma separated node addresses")
+	flags.StringVar(&weights, "weights", "", "Comma separated node weights")
+	flags.StringVar(&in, "in", "", "The file to read")
+	flags.IntVar(&batch, "batch", loadBatchSize, "Pairs written in one batch")
+	flags.BoolVar(&resume, "resume", false, "Go on from where an interrupted load stopped")
+	flags.Usage = func() {
+		fmt.Println(loadHelpPrompt)
+	}
+	flags.Parse(arguments)
+
+	if help || nodes == "" || in == "" || batch <= 0 {
+		fmt.Print(loadHelpPrompt)
+		return
+	}
+	if resume && in == "-" {
+		LOG.Error("cannot resume loading from stdin")
+		os.Exit(1)
+	}
+	c := dialCluster(nodes, weights)
+	defer c.Close()
+
+	var r io.Reader = os.Stdin
+	checkpoint := ""
+	if in != "-" {
+		f, err := os.Open(in)
+		if err != nil {
+			LOG.Error("open dump error: ", err.Error())
+			os.Exit(1)
+		}
+		defer f.Close()
+		r = f
+		checkpoint = in + ".progress"
+	}
+	var skip int64
+	if resume {
+		var err error
+		if skip, err = readCheckpoint(checkpoint); err != nil {
+			LOG.Error("read progress error: ", err.Error())
+			os.Exit(1)
+		}
+		fmt.Fprintf(os.Stderr, "resuming after %d pairs\n", skip)
+	}
+	loaded, expired, err := loadDump(c, r, batch, skip, checkpoint)
+	if err != nil {
+		LOG.Error("load failed: ", err.Error())
+		if checkpoint != "" && loaded > skip {
+			LOG.Errorf("run again with --resume to go on after %d pairs", loaded)
+		}
+		os.Exit(1)
+	}
+	if checkpoint != "" {
+		os.Remove(checkpoint)
+	}
+	fmt.Fprintf(os.Stderr, "loaded %d pairs of %d, %d expired ones skipped\n", loaded - skip - expired, loaded, expired)
+}
+
+// Write the pairs of a dump in batches, after skipping the first `skip`
+// ones. The number of pairs done is saved in `checkpoint`, if any, after
+// every batch. Writes are idempotent, so a batch cut off halfway is
+// simply written again on resume. Return the number of pairs done and of
+// expired ones among them.
+func loadDump(c *client.Client, r io.Reader, batch int, skip int64, checkpoint string) (int64, int64, error) {
+	dr, err := dump.NewReader(r)
+	if err != nil {
+		return skip, 0, err
+	}
+	for dr.Pairs() < skip && dr.Next() {
+	}
+	if err := dr.Err(); err != nil {
+		return skip, 0, err
+	}
+	if dr.Pairs() < skip {
+		return skip, 0, errors.New(fmt.Sprintf("the dump has %d pairs only, but %d are done", dr.Pairs(), skip))
+	}
+
+	done, expired := skip, int64(0)
+	var kvs []args.KVArgs
+	var consumed, dropped int64
+	progress := newProgress("loaded", skip)
+	flush := func() error {
+		if len(kvs) > 0 {
+			results, err := c.MultiPutKVs(context.Background(), kvs)
+			if err != nil {
+				return err
+			}
+			for _, result := range results {
+				if result.Err != nil {
+					return result.Err
+				}
+			}
+		}
+		done += consumed
+		expired += dropped
+		kvs, consumed, dropped = kvs[:0], 0, 0
+		progress.report(done)
+		if checkpoint == "" {
+			return nil
+		}
+		return writeCheckpoint(checkpoint, done)
+	}
+
+	now := time.Now()
+	for dr.Next() {
+		pair := dr.Pair()
+		consumed++
+		if pair.Expired(now) {
+			dropped++
+		} else {
+			kvs = append(kvs, args.KVArgs{Key: pair.Key, Value: pair.Value, ExpireAt: pair.ExpireAt})
+		}
+		if consumed >= int64(batch) {
+			if err := flush(); err != nil {
+				return done, expired, err
+			}
+			now = time.Now()
+		}
+	}
+	if err := dr.Err(); err != nil {
+		return done, expired, err
+	}
+	return done, expired, flush()
+}
+
+func readCheckpoint(path string) (int64, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+}
+
+// write through a temporary file, so a crash keeps the old checkpoint
+func writeCheckpoint(path string, done int64) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strconv.FormatInt(done, 10) + "\n"), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// prints the number of pairs handled to stderr now and then
+type progress struct {
+	verb string
+
+	// pairs handled before, left out of the rate
+	base int64
+
+	started time.Time
+
+	last time.Time
+}
+
+func newProgress(verb string, base int64) *progress {
+	now := time.Now()
+	return &progress{verb: verb, base: base, started: now, last: now}
+}
+
+func (p *progress) report(pairs int64) {
+	now := time.Now()
+	if now.Sub(p.last) < progressInterval {
+		return
+	}
+	p.last = now
+	rate := float64(pairs - p.base) / now.Sub(p.started).Seconds()
+	fmt.Fprintf(os.Stderr, "%s %d pairs, %.0f pairs/s\n", p.verb, pairs, rate)
+}
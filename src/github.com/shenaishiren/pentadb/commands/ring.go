@@ -0,0 +1,217 @@
+// Contains the implementation of ring-command which inspects hash ring
+
+/* BSD 3-Clause License
+
+Copyright (c) 2017, Guan Jiawen, Li Lundong
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice, this
+  list of conditions and the following disclaimer.
+
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+
+* Neither the name of the copyright holder nor the names of its
+  contributors may be used to endorse or promote products derived from
+  this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"os"
+	"fmt"
+	"sort"
+	"flag"
+	"strings"
+	"strconv"
+	"encoding/json"
+	"text/tabwriter"
+	"github.com/shenaishiren/pentadb/opt"
+	"github.com/shenaishiren/pentadb/client"
+)
+
+var ringHelpPrompt = fmt.Sprintf(`Usage: pentadb ring --nodes <nodes> [--weights <weights>] [--key <key>] [options]
+
+Inspect the hash ring built from the given nodes
+
+Options:
+	--help           		Display this help message and exit
+	--nodes <nodes>  		Comma separated node addresses, e.g. 10.0.0.1:4567,10.0.0.2:4567
+	--weights <weights>		Comma separated node weights, e.g. 10.0.0.1:4567=2
+	--key <key>      		Show the owner and preference list of the key
+	--replicas <n>   		Number of replicas in preference list (default: %d)
+	--vnodes         		Also show every virtual node
+	--format <format>		Output format, table or json (default: table)
+`, opt.DefaultReplicas)
+
+type ringNode struct {
+	Ipaddr string
+	Weight int
+	VNodes int
+	Ownership float64
+}
+
+type ringReport struct {
+	Nodes []ringNode
+	Key string                   `json:",omitempty"`
+	Owner string                 `json:",omitempty"`
+	PreferenceList []string      `json:",omitempty"`
+	VNodes []client.VNodeInfo    `json:",omitempty"`
+}
+
+// parse `ip:port` list separated by comma
+func parseNodes(s string) []string {
+	var nodes []string
+	for _, node := range strings.Split(s, ",") {
+		if node = strings.TrimSpace(node); node != "" {
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
+}
+
+// parse `ip:port=weight` list separated by comma
+func parseWeights(s string) (map[string]int, error) {
+	weights := make(map[string]int)
+	for _, item := range parseNodes(s) {
+		i := strings.LastIndex(item, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid weight: %s", item)
+		}
+		weight, err := strconv.Atoi(item[i + 1:])
+		if err != nil || weight <= 0 {
+			return nil, fmt.Errorf("invalid weight: %s", item)
+		}
+		weights[item[:i]] = weight
+	}
+	return weights, nil
+}
+
+func buildRingReport(hr *client.HashRing, key string, replicas int, vNodes bool) (*ringReport, error) {
+	report := new(ringReport)
+	counts := make(map[string]int)
+	allVNodes := hr.VNodes()
+	for _, v := range allVNodes {
+		counts[v.Ipaddr]++
+	}
+	ownership := hr.Ownership()
+	for _, node := range hr.Nodes() {
+		report.Nodes = append(report.Nodes, ringNode{
+			Ipaddr:    node.Ipaddr,
+			Weight:    node.Weight,
+			VNodes:    counts[node.Ipaddr],
+			Ownership: ownership[node.Ipaddr],
+		})
+	}
+	sort.Slice(report.Nodes, func(i, j int) bool {
+		return report.Nodes[i].Ownership > report.Nodes[j].Ownership
+	})
+	if key != "" {
+		nodes, err := hr.PreferenceList([]byte(key), replicas + 1)
+		if err != nil {
+			return nil, err
+		}
+		report.Key = key
+		report.Owner = nodes[0].Ipaddr
+		for _, node := range nodes {
+			report.PreferenceList = append(report.PreferenceList, node.Ipaddr)
+		}
+	}
+	if vNodes {
+		report.VNodes = allVNodes
+	}
+	return report, nil
+}
+
+func printRingTable(report *ringReport) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NODE\tWEIGHT\tVNODES\tOWNERSHIP")
+	for _, node := range report.Nodes {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%.2f%%\n", node.Ipaddr, node.Weight, node.VNodes, node.Ownership)
+	}
+	w.Flush()
+	if report.Key != "" {
+		fmt.Printf("\nkey: %s\nowner: %s\npreference list: %s\n",
+			report.Key, report.Owner, strings.Join(report.PreferenceList, ", "))
+	}
+	if len(report.VNodes) > 0 {
+		fmt.Println()
+		w = tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "HASH\tNODE")
+		for _, v := range report.VNodes {
+			fmt.Fprintf(w, "%d\t%s\n", v.Hash, v.Ipaddr)
+		}
+		w.Flush()
+	}
+}
+
+func ringCommand(arguments []string) {
+	var (
+		help bool
+		nodes string
+		weights string
+		key string
+		replicas int
+		vNodes bool
+		format string
+	)
+	flags := flag.NewFlagSet("ring", flag.ExitOnError)
+	flags.BoolVar(&help, "help", false, "Display this help message and exit")
+	flags.StringVar(&nodes, "nodes", "", "Comma separated node addresses")
+	flags.StringVar(&weights, "weights", "", "Comma separated node weights")
+	flags.StringVar(&key, "key", "", "Show the owner and preference list of the key")
+	flags.IntVar(&replicas, "replicas", opt.DefaultReplicas, "Number of replicas in preference list")
+	flags.BoolVar(&vNodes, "vnodes", false, "Also show every virtual node")
+	flags.StringVar(&format, "format", "table", "Output format, table or json")
+	flags.Usage = func() {
+		fmt.Println(ringHelpPrompt)
+	}
+	flags.Parse(arguments)
+
+	if help || nodes == "" {
+		fmt.Print(ringHelpPrompt)
+		return
+	}
+	weightDict, err := parseWeights(weights)
+	if err != nil {
+		LOG.Error(err.Error())
+		os.Exit(1)
+	}
+	hr, err := client.BuildHashRing(parseNodes(nodes), weightDict)
+	if err != nil {
+		LOG.Error("build hash ring failed: ", err.Error())
+		os.Exit(1)
+	}
+	report, err := buildRingReport(hr, key, replicas, vNodes)
+	if err != nil {
+		LOG.Error(err.Error())
+		os.Exit(1)
+	}
+	switch format {
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(report)
+	case "table":
+		printRingTable(report)
+	default:
+		LOG.Error("unknown format: ", format)
+		os.Exit(1)
+	}
+}
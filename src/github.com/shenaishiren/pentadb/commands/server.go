@@ -34,11 +34,18 @@ OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
 package main
 
 import (
+	"os"
 	"net"
+	"time"
+	"errors"
+	"context"
+	"syscall"
+	"os/signal"
 	"fmt"
 	"flag"
 	"github.com/syndtr/goleveldb/leveldb"
 	"github.com/shenaishiren/pentadb/rpc"
+	"github.com/shenaishiren/pentadb/args"
 	"github.com/shenaishiren/pentadb/opt"
 	"github.com/shenaishiren/pentadb/server"
 	"github.com/shenaishiren/pentadb/log"
@@ -46,7 +53,8 @@ import (
 
 var LOG = log.DefaultLog
 
-var helpPrompt = `Usage: pentadb [--port <port>] [--path <path>] [options]
+var helpPrompt = `Usage: pentadb [--port <port>] [--path <path>] [--config <file>] [options]
+       pentadb <command> [options]
 
 A PentaDB rpc server, backed by LevelDB
 
@@ -54,50 +62,144 @@ Options:
 	--help           		Display this help message and exit
 	--port <port>    		The port to listen on (default: 4567)
 	--path <path>    		The path to use for the LevelDB store
+	--config <file>  		The TOML config file (default: $PENTADB_CONFIG)
+
+Flags override PENTADB_<SECTION>_<KEY> environment variables,
+which override the config file, e.g. PENTADB_LEVELDB_BLOCK_CACHE_SIZE.
+PENTADB_PORT and PENTADB_PATH set the port and the path.
+
+Commands:
+	ring             		Inspect the hash ring of a cluster
+	backup           		Back up a running node
+	snapshot         		Take a consistent snapshot of a cluster
+	restore          		Rebuild the store of a node from a backup
+	dump             		Export every pair of a cluster into a portable file
+	load             		Import a file written by dump into a cluster
 `
 
+// sub commands, each one parses its own arguments
+var commands = map[string]func([]string){
+	"ring": ringCommand,
+	"backup": backupCommand,
+	"snapshot": snapshotCommand,
+	"restore": restoreCommand,
+	"dump": dumpCommand,
+	"load": loadCommand,
+}
+
 type Server struct {
 	Node *server.Node
+
+	listener net.Listener
+
+	tracker *rpc.Tracker
 }
 
-func (s *Server) listen(port string, path string) {
-	s.Node = server.NewNode(":" + port)
-	db, err := leveldb.OpenFile(path, nil)
+func (s *Server) listen(config *Config) {
+	options := &config.Options
+	self := config.Self
+	if self == "" {
+		self = config.Listen
+	}
+	s.Node = server.NewNodeWithOptions(self, options)
+	db, err := leveldb.OpenFile(config.Path, options.LevelDB())
 
 	if err != nil {
 		LOG.Error("open levelDB error: ", err.Error())
 		return
 	}
-	s.Node.DB = db
+	if err := s.Node.Open(db); err != nil {
+		LOG.Error("open change log error: ", err.Error())
+		return
+	}
+	if len(config.Peers) > 0 {
+		initArgs := &args.InitArgs{Self: self, OtherNodes: config.Peers, Replicas: config.Replicas}
+		if err := s.Node.Init(initArgs, nil); err != nil {
+			LOG.Error("init node error: ", err.Error())
+		}
+	}
+	s.Node.StartSweeper()
 	rpc.Register(s.Node)
 
-	l, err := net.Listen("tcp", ":" + port)
+	l, err := net.Listen(opt.DefaultProtocol, config.Listen)
 	if err != nil {
 		LOG.Error("listen error: ", err.Error())
+		s.Node.Close()
 		return
 	}
+	s.listener = l
+	s.tracker = rpc.NewTracker(options)
+
+	done := make(chan struct{})
+	go s.handleSignals(done, options.GetShutdownTimeout())
 
-	LOG.Infof("listen at 0.0.0.0:%s", port)
+	LOG.Infof("listen at %s", l.Addr())
 	for {
 		conn, err := l.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			break
+		}
 		if err != nil {
 			LOG.Error("accept rpc connection", err.Error())
 			continue
 		}
 		// blocking
-		go rpc.ServeConn(conn)
+		go s.tracker.ServeConn(conn)
 	}
+	<-done
+}
+
+// shut down on the first SIGINT or SIGTERM, exit at once on the second
+func (s *Server) handleSignals(done chan struct{}, timeout time.Duration) {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-signals
+	LOG.Infof("received %s, shutting down", sig)
+	go func() {
+		<-signals
+		LOG.Error("forced to exit")
+		os.Exit(1)
+	}()
+	s.shutdown(timeout)
+	close(done)
+}
+
+// Stop accepting connections, answer the calls in flight within
+// `timeout` and close the database
+func (s *Server) shutdown(timeout time.Duration) {
+	s.listener.Close()
+	s.Node.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := s.tracker.Shutdown(ctx); err != nil {
+		LOG.Warning("calls still in flight were cut off: ", err.Error())
+	}
+	if err := s.Node.Close(); err != nil {
+		LOG.Error("close levelDB error: ", err.Error())
+		return
+	}
+	LOG.Info("shut down")
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			command(os.Args[2:])
+			return
+		}
+	}
+
 	var (
 		help bool
 		port string
 		path string
+		configFile string
 	)
 	flag.BoolVar(&help, "h", false, "Display this help message and exit")
 	flag.StringVar(&port, "p", "4567", "The port to listen on (default: 4567)")
 	flag.StringVar(&path, "a", opt.DeafultPath, "The path to use for the LevelDB store")
+	flag.StringVar(&configFile, "config", os.Getenv("PENTADB_CONFIG"), "The TOML config file")
 
 	// change default usage
 	flag.Usage = func() {
@@ -110,8 +212,48 @@ func main() {
 	// help command
 	if help {
 		fmt.Print(helpPrompt)
-	} else {
-		svr := new(Server)
-		svr.listen(port, path)
+		return
+	}
+	config := defaultConfig()
+	if configFile != "" {
+		if err := config.LoadFile(configFile); err != nil {
+			LOG.Error("load config error: ", err.Error())
+			os.Exit(1)
+		}
+	}
+	if err := config.LoadEnv(); err != nil {
+		LOG.Error("load config error: ", err.Error())
+		os.Exit(1)
 	}
-}
\ No newline at end of file
+	// only flags given explicitly override the config
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "p":
+			config.setPort(port)
+		case "a":
+			config.Path = path
+		}
+	})
+	if err := setupLog(config); err != nil {
+		LOG.Error("open log file error: ", err.Error())
+		os.Exit(1)
+	}
+	svr := new(Server)
+	svr.listen(config)
+}
+
+func setupLog(config *Config) error {
+	if !config.LogColor {
+		// print the text only, the color code is left out
+		LOG.SetColorTemplate("%[2]s")
+	}
+	if config.LogFile == "" {
+		return nil
+	}
+	f, err := os.OpenFile(config.LogFile, os.O_CREATE | os.O_WRONLY | os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	LOG.SetOutput(f)
+	return nil
+}
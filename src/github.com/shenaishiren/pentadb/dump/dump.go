@@ -0,0 +1,341 @@
+// Contains the portable dump formats of cluster data
+
+/* BSD 3-Clause License
+
+Copyright (c) 2017, Guan Jiawen, Li Lundong
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice, this
+  list of conditions and the following disclaimer.
+
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+
+* Neither the name of the copyright holder nor the names of its
+  contributors may be used to endorse or promote products derived from
+  this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+
+package dump
+
+import (
+	"io"
+	"fmt"
+	"time"
+	"bufio"
+	"bytes"
+	"errors"
+	"encoding/json"
+	"encoding/binary"
+)
+
+// A dump is a stream of user pairs, independent of the ring and of the
+// storage of nodes, in one of two formats.
+//
+// json: one object per line, keys and values base64 encoded, the last
+// line holds the number of pairs
+//
+//	{"key":"a2V5","value":"dmFsdWU=","expire_at":1500000000000000000}
+//	...
+//	{"pairs":1}
+//
+// binary:
+//
+//	magic (10 bytes)
+//	'P' | uvarint key length | key | uvarint value length | value | varint expiry
+//	...
+//	'E' | uvarint number of pairs
+type Format string
+
+const (
+	FormatJSON   Format = "json"
+	FormatBinary Format = "binary"
+)
+
+var magic = []byte("PENTADUMP\x01")
+
+const (
+	recordPair = 'P'
+	recordEnd  = 'E'
+)
+
+var (
+	ErrBadDump   = errors.New("dump: not a pentadb dump")
+	ErrTruncated = errors.New("dump: truncated")
+)
+
+func ParseFormat(s string) (Format, error) {
+	switch Format(s) {
+	case FormatJSON, FormatBinary:
+		return Format(s), nil
+	}
+	return "", errors.New(fmt.Sprintf("dump: unknown format %q, want json or binary", s))
+}
+
+// One pair of a dump
+type Pair struct {
+	Key []byte `json:"key"`
+
+	Value []byte `json:"value"`
+
+	// unix nanoseconds, zero if the pair never expires
+	ExpireAt int64 `json:"expire_at,omitempty"`
+}
+
+// a line of a json dump, either a pair or the trailer
+type jsonRecord struct {
+	*Pair
+
+	Pairs *int64 `json:"pairs,omitempty"`
+}
+
+// Expired reports whether the pair has expired at `now`
+func (p *Pair) Expired(now time.Time) bool {
+	return p.ExpireAt != 0 && now.UnixNano() >= p.ExpireAt
+}
+
+type Writer struct {
+	w *bufio.Writer
+
+	format Format
+
+	enc *json.Encoder
+
+	pairs int64
+
+	err error
+}
+
+// NewWriter starts a dump on `w`, Close must be called to finish it
+func NewWriter(w io.Writer, format Format) (*Writer, error) {
+	dw := &Writer{w: bufio.NewWriter(w), format: format}
+	switch format {
+	case FormatJSON:
+		dw.enc = json.NewEncoder(dw.w)
+	case FormatBinary:
+		_, dw.err = dw.w.Write(magic)
+	default:
+		return nil, errors.New(fmt.Sprintf("dump: unknown format %q", format))
+	}
+	return dw, dw.err
+}
+
+func (w *Writer) Add(pair *Pair) error {
+	if w.err != nil {
+		return w.err
+	}
+	if w.format == FormatJSON {
+		// the encoder ends every object with a newline
+		w.err = w.enc.Encode(pair)
+	} else {
+		buf := make([]byte, 0, 1 + 3 * binary.MaxVarintLen64 + len(pair.Key) + len(pair.Value))
+		buf = append(buf, recordPair)
+		buf = binary.AppendUvarint(buf, uint64(len(pair.Key)))
+		buf = append(buf, pair.Key...)
+		buf = binary.AppendUvarint(buf, uint64(len(pair.Value)))
+		buf = append(buf, pair.Value...)
+		buf = binary.AppendVarint(buf, pair.ExpireAt)
+		_, w.err = w.w.Write(buf)
+	}
+	if w.err == nil {
+		w.pairs++
+	}
+	return w.err
+}
+
+// Pairs returns the number of pairs added
+func (w *Writer) Pairs() int64 { return w.pairs }
+
+// Close writes the trailer and flushes, it does not close the stream
+func (w *Writer) Close() error {
+	if w.err == nil && w.format == FormatJSON {
+		w.err = w.enc.Encode(&jsonRecord{Pairs: &w.pairs})
+	} else if w.err == nil {
+		buf := binary.AppendUvarint([]byte{recordEnd}, uint64(w.pairs))
+		_, w.err = w.w.Write(buf)
+	}
+	if w.err == nil {
+		w.err = w.w.Flush()
+	}
+	return w.err
+}
+
+// A Reader returns the pairs of a dump in either format
+type Reader struct {
+	r *bufio.Reader
+
+	format Format
+
+	pair Pair
+
+	pairs int64
+
+	// line number of a json dump
+	line int64
+
+	err error
+}
+
+// NewReader tells the format from the first bytes of the stream
+func NewReader(r io.Reader) (*Reader, error) {
+	dr := &Reader{r: bufio.NewReader(r)}
+	head, err := dr.r.Peek(len(magic))
+	switch {
+	case bytes.Equal(head, magic):
+		dr.format = FormatBinary
+		dr.r.Discard(len(magic))
+	case len(head) > 0 && head[0] == '{':
+		dr.format = FormatJSON
+	case err == io.EOF && len(bytes.TrimSpace(head)) == 0:
+		// an empty stream, Next reports it truncated
+		dr.format = FormatJSON
+	default:
+		return nil, ErrBadDump
+	}
+	return dr, nil
+}
+
+func (r *Reader) Format() Format { return r.format }
+
+// Next reads the next pair, it returns false at the end or on error
+func (r *Reader) Next() bool {
+	if r.err != nil {
+		return false
+	}
+	if r.format == FormatJSON {
+		r.err = r.nextJSON()
+	} else {
+		r.err = r.nextBinary()
+	}
+	if r.err != nil {
+		return false
+	}
+	r.pairs++
+	return true
+}
+
+func (r *Reader) nextJSON() error {
+	for {
+		line, err := r.r.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if len(line) > 0 {
+			r.line++
+		}
+		if len(bytes.TrimSpace(line)) > 0 {
+			// a last line without newline is complete if it parses
+			var record jsonRecord
+			if err := json.Unmarshal(line, &record); err != nil {
+				return errors.New(fmt.Sprintf("dump: line %d: %s", r.line, err.Error()))
+			}
+			if record.Pairs != nil {
+				return r.endJSON(*record.Pairs)
+			}
+			if record.Pair == nil || record.Key == nil {
+				return errors.New(fmt.Sprintf("dump: line %d: missing key", r.line))
+			}
+			r.pair = *record.Pair
+			return nil
+		}
+		if err == io.EOF {
+			// a dump cut at the end of a line parses, but has no trailer
+			return ErrTruncated
+		}
+	}
+}
+
+// check the trailer of a json dump, only blank lines may follow
+func (r *Reader) endJSON(pairs int64) error {
+	if pairs != r.pairs {
+		return errors.New(fmt.Sprintf("dump: %d pairs read, the trailer says %d", r.pairs, pairs))
+	}
+	rest, err := io.ReadAll(r.r)
+	if err != nil {
+		return err
+	}
+	if len(bytes.TrimSpace(rest)) > 0 {
+		return ErrBadDump
+	}
+	return io.EOF
+}
+
+func (r *Reader) readBytes() ([]byte, error) {
+	n, err := binary.ReadUvarint(r.r)
+	if err != nil {
+		return nil, err
+	}
+	// do not trust the length with a huge allocation
+	var buf bytes.Buffer
+	if _, err := io.CopyN(&buf, r.r, int64(n)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (r *Reader) nextBinary() error {
+	kind, err := r.r.ReadByte()
+	if err != nil {
+		return ErrTruncated
+	}
+	switch kind {
+	case recordPair:
+		key, err := r.readBytes()
+		if err != nil {
+			return ErrTruncated
+		}
+		value, err := r.readBytes()
+		if err != nil {
+			return ErrTruncated
+		}
+		expireAt, err := binary.ReadVarint(r.r)
+		if err != nil {
+			return ErrTruncated
+		}
+		r.pair = Pair{Key: key, Value: value, ExpireAt: expireAt}
+		return nil
+	case recordEnd:
+		pairs, err := binary.ReadUvarint(r.r)
+		if err != nil {
+			return ErrTruncated
+		}
+		if int64(pairs) != r.pairs {
+			return errors.New(fmt.Sprintf("dump: %d pairs read, the trailer says %d", r.pairs, pairs))
+		}
+		if _, err := r.r.ReadByte(); err != io.EOF {
+			return ErrBadDump
+		}
+		return io.EOF
+	}
+	return ErrBadDump
+}
+
+// Pair is valid until the next call of Next
+func (r *Reader) Pair() *Pair { return &r.pair }
+
+// Pairs returns the number of pairs read so far
+func (r *Reader) Pairs() int64 { return r.pairs }
+
+// Err returns nil once the whole dump is read
+func (r *Reader) Err() error {
+	if r.err == io.EOF {
+		return nil
+	}
+	return r.err
+}
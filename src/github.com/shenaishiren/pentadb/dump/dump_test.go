@@ -0,0 +1,80 @@
+package dump
+
+import (
+	"fmt"
+	"bytes"
+	"testing"
+)
+
+func TestDump(t *testing.T) {
+	for _, format := range []Format{FormatJSON, FormatBinary} {
+		var buf bytes.Buffer
+		w, err := NewWriter(&buf, format)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		for i := 0; i < 100; i++ {
+			pair := &Pair{Key: []byte(fmt.Sprint("key", i)), Value: bytes.Repeat([]byte{byte(i)}, i), ExpireAt: int64(i)}
+			if err := w.Add(pair); err != nil {
+				t.Fatal(err.Error())
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		r, err := NewReader(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatalf("%s: open: %v", format, err)
+		}
+		if r.Format() != format {
+			t.Fatalf("%s: read as %s", format, r.Format())
+		}
+		i := 0
+		for r.Next() {
+			pair := r.Pair()
+			if string(pair.Key) != fmt.Sprint("key", i) || len(pair.Value) != i || pair.ExpireAt != int64(i) {
+				t.Fatalf("%s: pair %d is %+v", format, i, pair)
+			}
+			i++
+		}
+		if err := r.Err(); err != nil || i != 100 {
+			t.Fatalf("%s: read %d pairs: %v", format, i, err)
+		}
+
+		// a dump cut in the middle of a pair, or before the trailer, is detected
+		data := buf.Bytes()
+		lastPair := bytes.LastIndexByte(data[:len(data) - 1], '\n') + 1
+		for _, cut := range [][]byte{data[:len(data) - 10], data[:lastPair]} {
+			r, err := NewReader(bytes.NewReader(cut))
+			if err != nil {
+				t.Fatalf("%s: open: %v", format, err)
+			}
+			for r.Next() {
+			}
+			if r.Err() == nil {
+				t.Fatalf("%s: truncated dump of %d bytes read", format, len(cut))
+			}
+		}
+	}
+}
+
+func TestEmptyDump(t *testing.T) {
+	var buf bytes.Buffer
+	w, _ := NewWriter(&buf, FormatJSON)
+	if err := w.Close(); err != nil {
+		t.Fatal(err.Error())
+	}
+	for _, data := range []string{buf.String(), ""} {
+		r, err := NewReader(bytes.NewReader([]byte(data)))
+		if err != nil {
+			t.Fatalf("open %q: %v", data, err)
+		}
+		if r.Next() {
+			t.Fatalf("pair read from %q", data)
+		}
+		if err := r.Err(); (data == "") != (err == ErrTruncated) {
+			t.Fatalf("read %q: %v", data, err)
+		}
+	}
+}
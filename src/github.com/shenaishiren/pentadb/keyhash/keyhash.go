@@ -0,0 +1,66 @@
+// Contains the hash functions placing keys and nodes on the hash ring
+
+/* BSD 3-Clause License
+
+Copyright (c) 2017, Guan Jiawen, Li Lundong
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice, this
+  list of conditions and the following disclaimer.
+
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+
+* Neither the name of the copyright holder nor the names of its
+  contributors may be used to endorse or promote products derived from
+  this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+
+package keyhash
+
+import (
+	"crypto/md5"
+)
+
+// shared by clients building the ring and nodes moving
+// keys between ranges of it, both must agree
+
+func Md5Hash(key []byte) []byte {
+	md := md5.New()
+	md.Write(key)
+	return md.Sum(nil)
+}
+
+func KemataHash(digest []byte, i int) uint32 {
+	// calculate the hash value
+	// each four bytes constitute a 32-bit integer
+	// then add the four 32-bit integers to the final hash value
+	var hash uint32 = 0
+	hash += (uint32(digest[(i << 2) + 3] & 0xff) << 24) |
+		(uint32(digest[(i << 2) + 2] & 0xff) << 16) |
+		(uint32(digest[(i << 2) + 1] & 0xff) << 8) |
+		uint32(digest[i << 2] & 0xff)
+
+	return hash
+}
+
+// Key returns the position of a key on the ring
+func Key(key []byte) uint32 {
+	return KemataHash(Md5Hash(key), 0)
+}
@@ -101,6 +101,14 @@ func (l *Log) SetFlags(flag int) {
 	l.flag = flag
 }
 
+// set the destination of the output
+func (l *Log) SetOutput(out io.Writer) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.out = out
+}
+
 // set color template to replace the old
 func (l *Log) SetColorTemplate(ct string) {
 	l.mu.Lock()
@@ -187,42 +195,42 @@ func (l *Log) wrapper(text string) string {
 
 func (l *Log) Infof(format string, v ...interface{}) {
 	text := fmt.Sprintf(l.colorTemplate, l.color >> 24, l.wrapper(fmt.Sprintf(format, v...)))
-	fmt.Println(text)
+	fmt.Fprintln(l.out, text)
 }
 
 func (l *Log) Info(v ...interface{}) {
 	text := fmt.Sprintf(l.colorTemplate, l.color >> 24, l.wrapper(fmt.Sprint(v...)))
-	fmt.Println(text)
+	fmt.Fprintln(l.out, text)
 }
 
 func (l *Log) Warningf(format string, v ...interface{}) {
 	text := fmt.Sprintf(l.colorTemplate, (l.color & 0x00ff0000) >> 16, l.wrapper(fmt.Sprintf(format, v...)))
-	fmt.Println(text)
+	fmt.Fprintln(l.out, text)
 }
 
 func (l *Log) Warning(v ...interface{}) {
 	text := fmt.Sprintf(l.colorTemplate, (l.color & 0x00ff0000) >> 16, l.wrapper(fmt.Sprint(v...)))
-	fmt.Println(text)
+	fmt.Fprintln(l.out, text)
 }
 
 func (l *Log) Debugf(format string, v ...interface{}) {
 	text := fmt.Sprintf(l.colorTemplate, (l.color & 0x0000ff00) >> 8, l.wrapper(fmt.Sprintf(format, v...)))
-	fmt.Println(text)
+	fmt.Fprintln(l.out, text)
 }
 
 func (l *Log) Debug(v ...interface{}) {
 	text := fmt.Sprintf(l.colorTemplate, (l.color & 0x0000ff00) >> 8, l.wrapper(fmt.Sprint(v...)))
-	fmt.Println(text)
+	fmt.Fprintln(l.out, text)
 }
 
 func (l *Log) Errorf(format string, v ...interface{}) {
 	text := fmt.Sprintf(l.colorTemplate, l.color & 0x000000ff, l.wrapper(fmt.Sprintf(format, v...)))
-	fmt.Println(text)
+	fmt.Fprintln(l.out, text)
 }
 
 func (l *Log) Error(v ...interface{}) {
 	text := fmt.Sprintf(l.colorTemplate, l.color & 0x000000ff, l.wrapper(fmt.Sprint(v...)))
-	fmt.Println(text)
+	fmt.Fprintln(l.out, text)
 }
 
 // default log
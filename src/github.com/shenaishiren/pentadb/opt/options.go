@@ -1,17 +1,326 @@
 package opt
 
-import "time"
+import (
+	"time"
+	"github.com/syndtr/goleveldb/leveldb/filter"
+	lopt "github.com/syndtr/goleveldb/leveldb/opt"
+)
 
 const (
 	DefaultReplicas = 1                 // default replicas for raft algorithm
 	DeafultPath = "/tmp/pentadb"        // default path for levelDB
 	DefaultProtocol = "tcp"
 	DefaultTimeout = 3 * time.Second
+	DefaultWriteTimeout = 30 * time.Second       // writing a request without deadline gives up after
+	DefaultPoolSize = 4                            // connections per node
+	DefaultMaxInFlight = 4096                      // async calls in flight per node
+	DefaultMaxAttempts = 3                         // attempts of a call, including the first one
+	DefaultRetryBackoff = 20 * time.Millisecond    // wait before the first retry, doubled after
+	DefaultMaxRetryBackoff = time.Second
+	DefaultRetryJitter = 0.5                       // fraction of the backoff which is random
+	DefaultBreakerThreshold = 5                    // consecutive failures opening a circuit breaker
+	DefaultBreakerOpenTimeout = 5 * time.Second    // how long a breaker stays open before a probe
+	DefaultHedgePercentile = 0.95                  // owner latency percentile after which reads are hedged
+	DefaultHedgeDelay = 10 * time.Millisecond      // hedge delay until enough latencies are known
+	DefaultHedgeMinSamples = 100
+	DefaultCacheTTL = 30 * time.Second             // cached values are dropped after, if not invalidated
+	DefaultDedupSize = 65536                       // replies of requests a node remembers
+	DefaultDedupTTL = time.Minute                  // how long a node remembers a reply
+	DefaultPoolIdleTimeout = time.Minute           // must be shorter than server's
+	DefaultHealthCheckInterval = 10 * time.Second
+	DefaultServerIdleTimeout = 5 * time.Minute     // server closes idle connections
+	DefaultShutdownTimeout = 10 * time.Second      // how long a stopping server waits for calls in flight
+	DefaultTxnTimeout = 10 * time.Second           // prepared transactions are aborted after
+	DefaultScanPageSize = 256                      // pairs fetched from a node per request
+	DefaultMigrateCacheTimeout = time.Minute       // keys changed since a migration began are forgotten after, if unused
+	DefaultSweepInterval = time.Second             // how often expired keys are looked for
+	DefaultSweepBatchSize = 256                    // expired keys deleted in one write
+	DefaultSweepRate = 10000                       // max expired keys deleted per second
+	DefaultChangeLogSize = 100000                  // changes a node keeps in its change log
+	DefaultChangePollInterval = time.Second        // how often a caught up change feed polls
+	DefaultWatchWait = 30 * time.Second            // how long a watch request waits for changes
+	DefaultWatchBatchSize = 256                    // max changes in one watch reply
+	DefaultBackupTimeout = time.Minute             // snapshots kept for reading are released after, if unused
+	DefaultBackupPageSize = 1024                   // max pairs in one backup read
+	DefaultFreezeHold = 5 * time.Second            // a frozen node thaws by itself after
+	DefaultFreezeAttempts = 10                     // attempts to freeze a cluster busy with transactions
 )
 
+// Options of client, nil options or zero fields mean defaults
+type ClientOptions struct {
+	// max number of connections kept to each node, every
+	// connection carries many concurrent calls
+	PoolSize int
+
+	// a connection unused for longer is closed
+	PoolIdleTimeout time.Duration
+
+	// how often idle connections are pinged
+	HealthCheckInterval time.Duration
+
+	// max number of attempts of a call which fails because the node
+	// is unavailable or times out, other errors are never retried
+	MaxAttempts int
+
+	// wait before the first retry, it doubles with every retry
+	// up to MaxRetryBackoff
+	RetryBackoff time.Duration
+
+	MaxRetryBackoff time.Duration
+
+	// fraction of the backoff which is random, so that clients do not
+	// retry at the same time, negative means none
+	RetryJitter float64
+
+	// consecutive failed calls to a node opening its circuit breaker,
+	// calls to the node then fail fast until a probe succeeds
+	BreakerThreshold int
+
+	// how long a breaker stays open before letting a probe through
+	BreakerOpenTimeout time.Duration
+
+	// send a second Get to the next node of the preference list if
+	// the owner has not answered within its HedgePercentile latency.
+	// Not supported yet, NewClientWithOptions rejects it: writes only
+	// reach the owner, so the next node holds no copy of the key, at
+	// most a stale one left by an earlier ring, which would win over a
+	// slow owner.
+	HedgedReads bool
+
+	// between 0 and 1
+	HedgePercentile float64
+
+	// max number of values kept in the read cache of the client, zero
+	// means no cache. Cached values are dropped when nodes report that
+	// their keys changed, Get may return a stale value until then.
+	// Writes of the client drop their keys at once, async ones excepted.
+	CacheSize int
+
+	// cached values are dropped after, even if no change is reported,
+	// or once they expire on their node if that is earlier
+	CacheTTL time.Duration
+
+	// max number of async calls in flight to each node,
+	// more calls block until earlier ones finish
+	MaxInFlight int
+
+	// allow write batches spanning several nodes, they are
+	// applied by two-phase commit instead of being rejected
+	CrossShardTxn bool
+}
+
+func (o *ClientOptions) GetPoolSize() int {
+	if o == nil || o.PoolSize <= 0 {
+		return DefaultPoolSize
+	}
+	return o.PoolSize
+}
+
+func (o *ClientOptions) GetPoolIdleTimeout() time.Duration {
+	if o == nil || o.PoolIdleTimeout <= 0 {
+		return DefaultPoolIdleTimeout
+	}
+	return o.PoolIdleTimeout
+}
+
+func (o *ClientOptions) GetHealthCheckInterval() time.Duration {
+	if o == nil || o.HealthCheckInterval <= 0 {
+		return DefaultHealthCheckInterval
+	}
+	return o.HealthCheckInterval
+}
+
+func (o *ClientOptions) GetMaxInFlight() int {
+	if o == nil || o.MaxInFlight <= 0 {
+		return DefaultMaxInFlight
+	}
+	return o.MaxInFlight
+}
+
+func (o *ClientOptions) GetMaxAttempts() int {
+	if o == nil || o.MaxAttempts <= 0 {
+		return DefaultMaxAttempts
+	}
+	return o.MaxAttempts
+}
+
+func (o *ClientOptions) GetRetryBackoff() time.Duration {
+	if o == nil || o.RetryBackoff <= 0 {
+		return DefaultRetryBackoff
+	}
+	return o.RetryBackoff
+}
+
+func (o *ClientOptions) GetMaxRetryBackoff() time.Duration {
+	if o == nil || o.MaxRetryBackoff <= 0 {
+		return DefaultMaxRetryBackoff
+	}
+	return o.MaxRetryBackoff
+}
+
+func (o *ClientOptions) GetRetryJitter() float64 {
+	if o == nil || o.RetryJitter == 0 {
+		return DefaultRetryJitter
+	}
+	if o.RetryJitter < 0 {
+		return 0
+	}
+	if o.RetryJitter > 1 {
+		return 1
+	}
+	return o.RetryJitter
+}
+
+func (o *ClientOptions) GetBreakerThreshold() int {
+	if o == nil || o.BreakerThreshold <= 0 {
+		return DefaultBreakerThreshold
+	}
+	return o.BreakerThreshold
+}
+
+func (o *ClientOptions) GetBreakerOpenTimeout() time.Duration {
+	if o == nil || o.BreakerOpenTimeout <= 0 {
+		return DefaultBreakerOpenTimeout
+	}
+	return o.BreakerOpenTimeout
+}
+
 type NodeState int
 
 const (
 	NodeRunning NodeState = iota
 	NodeTerminal
 )
+
+func (o *ClientOptions) GetHedgedReads() bool {
+	return o != nil && o.HedgedReads
+}
+
+func (o *ClientOptions) GetHedgePercentile() float64 {
+	if o == nil || o.HedgePercentile <= 0 || o.HedgePercentile > 1 {
+		return DefaultHedgePercentile
+	}
+	return o.HedgePercentile
+}
+
+func (o *ClientOptions) GetCacheSize() int {
+	if o == nil || o.CacheSize <= 0 {
+		return 0
+	}
+	return o.CacheSize
+}
+
+func (o *ClientOptions) GetCacheTTL() time.Duration {
+	if o == nil || o.CacheTTL <= 0 {
+		return DefaultCacheTTL
+	}
+	return o.CacheTTL
+}
+
+func (o *ClientOptions) GetCrossShardTxn() bool {
+	return o != nil && o.CrossShardTxn
+}
+
+// Options of server, nil options or zero fields mean defaults
+type ServerOptions struct {
+	// connections idle for longer are closed
+	IdleTimeout time.Duration
+
+	// how long a stopping server waits for calls in flight
+	ShutdownTimeout time.Duration
+
+	// prepared transactions are aborted after
+	TxnTimeout time.Duration
+
+	// how long a watch request waits for changes
+	WatchWait time.Duration
+
+	// how often expired keys are looked for
+	SweepInterval time.Duration
+
+	// changes a node keeps in its change log
+	ChangeLogSize int
+
+	// LevelDB tuning, zero fields mean the defaults of goleveldb
+
+	// capacity of the block cache in bytes
+	BlockCacheSize int
+
+	// size of the memtable in bytes, larger ones make
+	// writes faster and opening slower
+	WriteBufferSize int
+
+	// bits per key of the bloom filter, zero means no filter
+	BloomBitsPerKey int
+
+	// store blocks uncompressed instead of snappy compressed
+	NoCompression bool
+
+	// size of sorted tables in bytes
+	CompactionTableSize int
+
+	// max number of open files kept
+	OpenFilesCacheCapacity int
+}
+
+func (o *ServerOptions) GetIdleTimeout() time.Duration {
+	if o == nil || o.IdleTimeout <= 0 {
+		return DefaultServerIdleTimeout
+	}
+	return o.IdleTimeout
+}
+
+func (o *ServerOptions) GetShutdownTimeout() time.Duration {
+	if o == nil || o.ShutdownTimeout <= 0 {
+		return DefaultShutdownTimeout
+	}
+	return o.ShutdownTimeout
+}
+
+func (o *ServerOptions) GetTxnTimeout() time.Duration {
+	if o == nil || o.TxnTimeout <= 0 {
+		return DefaultTxnTimeout
+	}
+	return o.TxnTimeout
+}
+
+func (o *ServerOptions) GetWatchWait() time.Duration {
+	if o == nil || o.WatchWait <= 0 {
+		return DefaultWatchWait
+	}
+	return o.WatchWait
+}
+
+func (o *ServerOptions) GetSweepInterval() time.Duration {
+	if o == nil || o.SweepInterval <= 0 {
+		return DefaultSweepInterval
+	}
+	return o.SweepInterval
+}
+
+func (o *ServerOptions) GetChangeLogSize() int64 {
+	if o == nil || o.ChangeLogSize <= 0 {
+		return DefaultChangeLogSize
+	}
+	return int64(o.ChangeLogSize)
+}
+
+// LevelDB returns the options to open the database with
+func (o *ServerOptions) LevelDB() *lopt.Options {
+	if o == nil {
+		return nil
+	}
+	options := &lopt.Options{
+		BlockCacheCapacity:     o.BlockCacheSize,
+		WriteBuffer:            o.WriteBufferSize,
+		CompactionTableSize:    o.CompactionTableSize,
+		OpenFilesCacheCapacity: o.OpenFilesCacheCapacity,
+	}
+	if o.BloomBitsPerKey > 0 {
+		options.Filter = filter.NewBloomFilter(o.BloomBitsPerKey)
+	}
+	if o.NoCompression {
+		options.Compression = lopt.NoCompression
+	}
+	return options
+}
@@ -35,13 +35,14 @@ OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
 package rpc
 
 import (
+	"fmt"
 	"time"
-	"errors"
-	"io"
+	"context"
 	"encoding/gob"
 	"bufio"
 	"net/rpc"
 	"net"
+	"github.com/shenaishiren/pentadb/opt"
 )
 
 func TimeoutCoder(f func(interface{}) error, v interface{}, msg string) error {
@@ -53,25 +54,51 @@ func TimeoutCoder(f func(interface{}) error, v interface{}, msg string) error {
 	case v := <-eChan:
 		return v
 	case <-time.After(30 * time.Second):
-		return errors.New("timeout occurred when: " + msg)
+		return fmt.Errorf("%w when: %s", ErrTimeout, msg)
 	}
 }
 
 type gobClientCodec struct {
-	rwc    io.ReadWriteCloser
+	conn   net.Conn
 	dec    *gob.Decoder
 	enc    *gob.Encoder
 	encBuf *bufio.Writer
 }
 
+// implemented by args carrying the deadline of their call
+type deadliner interface {
+	Deadline(now time.Time) (time.Time, bool)
+}
+
+// The write of a request is bounded by the deadline of its call, or by
+// DefaultWriteTimeout if it has none. net/rpc writes one request at a
+// time, so the deadline of the connection belongs to this one.
 func (c *gobClientCodec) WriteRequest(r *rpc.Request, body interface{}) error {
-	if err := TimeoutCoder(c.enc.Encode, r, "client write request"); err != nil {
-		return err
+	now := time.Now()
+	deadline := now.Add(opt.DefaultWriteTimeout)
+	if d, ok := body.(deadliner); ok {
+		if t, ok := d.Deadline(now); ok {
+			deadline = t
+		}
 	}
-	if err := TimeoutCoder(c.enc.Encode, body, "client write request body"); err != nil {
+	if err := c.conn.SetWriteDeadline(deadline); err != nil {
 		return err
 	}
-	return c.encBuf.Flush()
+	err := c.enc.Encode(r)
+	if err == nil {
+		err = c.enc.Encode(body)
+	}
+	if err == nil {
+		err = c.encBuf.Flush()
+	}
+	if err != nil {
+		// a request cut off halfway leaves the stream unusable
+		c.conn.Close()
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			return fmt.Errorf("%w when: client write request", ErrTimeout)
+		}
+	}
+	return err
 }
 
 func (c *gobClientCodec) ReadResponseHeader(r *rpc.Response) error {
@@ -83,18 +110,27 @@ func (c *gobClientCodec) ReadResponseBody(body interface{}) error {
 }
 
 func (c *gobClientCodec) Close() error {
-	return c.rwc.Close()
+	return c.conn.Close()
 }
 
 // Dial connects to an RPC server at the specified network address.
 func DialTimeout(network, address string, timeout time.Duration) (*rpc.Client, error) {
-	conn, err := net.DialTimeout(network, address, timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return DialContext(ctx, network, address)
+}
+
+// DialContext connects to an RPC server at the specified network address.
+// The context only bounds dialing, use CallContext to bound a call.
+func DialContext(ctx context.Context, network, address string) (*rpc.Client, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, address)
 	if err != nil {
 		return nil, err
 	}
 	encBuf := bufio.NewWriter(conn)
 	codec := &gobClientCodec{
-		rwc:    conn,
+		conn:   conn,
 		dec:    gob.NewDecoder(conn),
 		enc:    gob.NewEncoder(encBuf),
 		encBuf: encBuf,
@@ -102,4 +138,17 @@ func DialTimeout(network, address string, timeout time.Duration) (*rpc.Client, e
 	c := rpc.NewClientWithCodec(codec)
 
 	return c, nil
+}
+
+// CallContext invokes the named function like `Call`, but gives up once
+// ctx is done. The reply of an abandoned call is dropped, the caller
+// should close the client if the connection is not shared.
+func CallContext(ctx context.Context, client *rpc.Client, serviceMethod string, args interface{}, reply interface{}) error {
+	call := client.Go(serviceMethod, args, reply, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		return call.Error
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
\ No newline at end of file
@@ -0,0 +1,43 @@
+package rpc
+
+import (
+	"net"
+	"time"
+	"errors"
+	"context"
+	"testing"
+	"github.com/shenaishiren/pentadb/args"
+)
+
+// a request the server never reads times out at the deadline of its call
+func TestWriteDeadline(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			defer conn.Close()
+			time.Sleep(5 * time.Second)
+		}
+	}()
+	client, err := DialTimeout("tcp", l.Addr().String(), time.Second)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer client.Close()
+
+	// larger than the socket buffers
+	kvArgs := &args.KVArgs{Header: args.Header{Timeout: 100 * time.Millisecond}, Value: make([]byte, 64 << 20)}
+	start := time.Now()
+	var result []byte
+	err = CallContext(context.Background(), client, "Node.Put", kvArgs, &result)
+	if !errors.Is(err, ErrTimeout) {
+		t.Fatalf("call: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2 * time.Second {
+		t.Fatalf("timed out after %s", elapsed)
+	}
+}
@@ -0,0 +1,67 @@
+// Contains the errors which are recognised on both sides of rpc
+
+/* BSD 3-Clause License
+
+Copyright (c) 2017, Guan Jiawen, Li Lundong
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice, this
+  list of conditions and the following disclaimer.
+
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+
+* Neither the name of the copyright holder nor the names of its
+  contributors may be used to endorse or promote products derived from
+  this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+
+package rpc
+
+import (
+	"errors"
+	"strings"
+	"net/rpc"
+)
+
+// net/rpc only carries the text of an error returned by the server,
+// so both sides compare the text to recognise these errors
+var (
+	ErrNotFound = errors.New("rpc: not found")
+	ErrDeadlineExceeded = errors.New("rpc: deadline exceeded")
+	ErrTxnConflict = errors.New("rpc: transaction conflict")
+	ErrTxnNotFound = errors.New("rpc: transaction not found")
+	ErrReservedKey = errors.New("rpc: key is reserved")
+	ErrNotInteger = errors.New("rpc: value is not an integer")
+	ErrOverflow = errors.New("rpc: integer overflow")
+	ErrCompacted = errors.New("rpc: revision compacted")
+	ErrBackupNotFound = errors.New("rpc: backup not found")
+	ErrBusy = errors.New("rpc: node is busy")
+	ErrTimeout = errors.New("timeout occurred")
+)
+
+// Report whether `err`, which may come from a remote server, is `target`.
+// Errors wrapping `target` start with its text, so a prefix is enough.
+func IsError(err error, target error) bool {
+	if errors.Is(err, target) {
+		return true
+	}
+	serverError, ok := err.(rpc.ServerError)
+	return ok && strings.HasPrefix(string(serverError), target.Error())
+}
@@ -36,12 +36,17 @@ package rpc
 
 import (
 	"io"
+	"sync"
+	"errors"
+	"context"
 	"encoding/gob"
 	"bufio"
 	"net/rpc"
 
 	"github.com/shenaishiren/pentadb/log"
+	"github.com/shenaishiren/pentadb/opt"
 	"net"
+	"time"
 )
 
 var LOG = log.DefaultLog
@@ -52,10 +57,33 @@ type gobServerCodec struct {
 	enc    *gob.Encoder
 	encBuf *bufio.Writer
 	closed bool
+
+	// connections idle for longer are closed
+	idleTimeout time.Duration
+
+	// counts the calls read but not answered yet, may be nil
+	tracker *Tracker
+
+	// calls in flight on this connection, guarded by tracker
+	inflight int
 }
 
 func (c *gobServerCodec) ReadRequestHeader(r *rpc.Request) error {
-	return TimeoutCoder(c.dec.Decode, r, "server read request header")
+	// clients keep connections open between requests,
+	// so waiting for a header is bound by the idle timeout
+	conn, ok := c.rwc.(net.Conn)
+	if !ok {
+		return TimeoutCoder(c.dec.Decode, r, "server read request header")
+	}
+	conn.SetReadDeadline(time.Now().Add(c.idleTimeout))
+	err := c.dec.Decode(r)
+	conn.SetReadDeadline(time.Time{})
+	// net/rpc writes one response for every header read, except
+	// when reading fails, then it stops reading the connection
+	if err == nil && c.tracker != nil && !c.tracker.begin(c) {
+		return errShutdown
+	}
+	return err
 }
 
 func (c *gobServerCodec) ReadRequestBody(body interface{}) error {
@@ -63,6 +91,9 @@ func (c *gobServerCodec) ReadRequestBody(body interface{}) error {
 }
 
 func (c *gobServerCodec) WriteResponse(r *rpc.Response, body interface{}) (err error) {
+	if c.tracker != nil {
+		defer c.tracker.end(c)
+	}
 	if err = TimeoutCoder(c.enc.Encode, r, "server write response"); err != nil {
 		if c.encBuf.Flush() == nil {
 			LOG.Error("rpc: gob error encoding response:", err)
@@ -98,15 +129,135 @@ func Register(rcvr interface{}) error { return rpc.Register(rcvr) }
 // ServeConn uses the gob wire format (see package gob) on the
 // connection. To use an alternate codec, use ServeCodec.
 func ServeConn(conn net.Conn) {
+	rpc.ServeCodec(newServerCodec(conn, opt.DefaultServerIdleTimeout, nil))
+}
+
+func newServerCodec(conn net.Conn, idleTimeout time.Duration, tracker *Tracker) *gobServerCodec {
 	buf := bufio.NewWriter(conn)
-	codec := &gobServerCodec{
-		rwc:    conn,
-		dec:    gob.NewDecoder(conn),
-		enc:    gob.NewEncoder(buf),
-		encBuf: buf,
+	return &gobServerCodec{
+		rwc:         conn,
+		dec:         gob.NewDecoder(conn),
+		enc:         gob.NewEncoder(buf),
+		encBuf:      buf,
+		idleTimeout: idleTimeout,
+		tracker:     tracker,
+	}
+}
+
+var errShutdown = errors.New("rpc: server is shutting down")
+
+// A Tracker serves connections and counts the calls in flight,
+// so that a server can stop without cutting calls off
+type Tracker struct {
+	mu *sync.Mutex
+
+	idleTimeout time.Duration
+
+	codecs map[*gobServerCodec]bool
+
+	inflight int
+
+	shutdown bool
+
+	// closed when no call is in flight after shutdown began
+	drained chan struct{}
+}
+
+// nil options mean defaults
+func NewTracker(options *opt.ServerOptions) *Tracker {
+	return &Tracker{
+		mu:          new(sync.Mutex),
+		idleTimeout: options.GetIdleTimeout(),
+		codecs:      make(map[*gobServerCodec]bool),
+		drained:     make(chan struct{}),
+	}
+}
+
+// ServeConn is like the function ServeConn, but tracks the connection
+func (t *Tracker) ServeConn(conn net.Conn) {
+	codec := newServerCodec(conn, t.idleTimeout, t)
+	t.mu.Lock()
+	if t.shutdown {
+		t.mu.Unlock()
+		conn.Close()
+		return
+	}
+	t.codecs[codec] = true
+	t.mu.Unlock()
+
+	rpc.ServeCodec(codec)
+
+	t.mu.Lock()
+	delete(t.codecs, codec)
+	t.mu.Unlock()
+}
+
+// count a call, false if shutdown began and it must not be served
+func (t *Tracker) begin(c *gobServerCodec) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.shutdown {
+		return false
+	}
+	c.inflight++
+	t.inflight++
+	return true
+}
+
+func (t *Tracker) end(c *gobServerCodec) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	c.inflight--
+	t.inflight--
+	if !t.shutdown {
+		return
+	}
+	// the connection has been answered, do not wait for more calls
+	if c.inflight == 0 {
+		c.rwc.Close()
+	}
+	t.checkDrained()
+}
+
+// lock must be held
+func (t *Tracker) checkDrained() {
+	if t.inflight > 0 {
+		return
+	}
+	select {
+	case <-t.drained:
+	default:
+		close(t.drained)
+	}
+}
+
+// Shutdown closes idle connections and waits for the calls in flight,
+// the others are closed as soon as their calls are answered.
+// Connections still busy once ctx is done are closed anyway.
+func (t *Tracker) Shutdown(ctx context.Context) error {
+	// closing a connection twice is harmless, the codecs close
+	// their own connections without holding the lock
+	t.mu.Lock()
+	t.shutdown = true
+	for c := range t.codecs {
+		if c.inflight == 0 {
+			c.rwc.Close()
+		}
+	}
+	t.checkDrained()
+	t.mu.Unlock()
+
+	select {
+	case <-t.drained:
+		return nil
+	case <-ctx.Done():
 	}
-	if err := rpc.ServeRequest(codec); err != nil {
-		LOG.Error("server rpc request: ", err.Error())
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for c := range t.codecs {
+		c.rwc.Close()
 	}
-	codec.Close()
-}
\ No newline at end of file
+	return ctx.Err()
+}
@@ -0,0 +1,86 @@
+package rpc
+
+import (
+	"net"
+	"time"
+	"context"
+	"testing"
+)
+
+type Sleeper struct{}
+
+func (s *Sleeper) Sleep(d time.Duration, result *int) error {
+	time.Sleep(d)
+	return nil
+}
+
+func init() {
+	Register(new(Sleeper))
+}
+
+func TestTrackerShutdown(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer l.Close()
+	tracker := NewTracker(nil)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go tracker.ServeConn(conn)
+		}
+	}()
+	busy, err := DialTimeout("tcp", l.Addr().String(), time.Second)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer busy.Close()
+	idle, err := DialTimeout("tcp", l.Addr().String(), time.Second)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer idle.Close()
+	var result int
+	if err := idle.Call("Sleeper.Sleep", time.Duration(0), &result); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	inflight := busy.Go("Sleeper.Sleep", 300 * time.Millisecond, &result, nil)
+	time.Sleep(50 * time.Millisecond)
+	shutdown := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+		defer cancel()
+		shutdown <- tracker.Shutdown(ctx)
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	// the idle connection is closed at once
+	start := time.Now()
+	if err := idle.Call("Sleeper.Sleep", time.Duration(0), &result); err == nil {
+		t.Fatal("idle connection served after shutdown")
+	}
+	if elapsed := time.Since(start); elapsed > 100 * time.Millisecond {
+		t.Fatalf("idle connection closed after %s", elapsed)
+	}
+	// a call read after shutdown began is not admitted, even on a busy connection
+	late := busy.Go("Sleeper.Sleep", 300 * time.Millisecond, &result, nil)
+
+	<-inflight.Done
+	if inflight.Error != nil {
+		t.Fatalf("call in flight: %v", inflight.Error)
+	}
+	if err := <-shutdown; err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 400 * time.Millisecond {
+		t.Fatalf("shutdown waited %s for a call read after it began", elapsed)
+	}
+	if (<-late.Done).Error == nil {
+		t.Fatal("call read after shutdown was served")
+	}
+}
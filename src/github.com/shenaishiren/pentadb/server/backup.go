@@ -0,0 +1,201 @@
+// Contains the online backups of Node
+
+/* BSD 3-Clause License
+
+Copyright (c) 2017, Guan Jiawen, Li Lundong
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice, this
+  list of conditions and the following disclaimer.
+
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+
+* Neither the name of the copyright holder nor the names of its
+  contributors may be used to endorse or promote products derived from
+  this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package server
+
+import (
+	"os"
+	"time"
+	"strings"
+	"path/filepath"
+	"github.com/satori/go.uuid"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"github.com/shenaishiren/pentadb/args"
+	"github.com/shenaishiren/pentadb/archive"
+	"github.com/shenaishiren/pentadb/opt"
+	"github.com/shenaishiren/pentadb/rpc"
+)
+
+// A snapshot kept for a caller reading it page by page
+type backupSession struct {
+	snapshot *leveldb.Snapshot
+
+	expire time.Time
+}
+
+// release sessions nobody reads any more, backupMutex must be held
+func (n *Node) releaseExpiredBackups(now time.Time) {
+	for id, session := range n.backups {
+		if now.After(session.expire) {
+			LOG.Warningf("release abandoned backup %s", id)
+			session.snapshot.Release()
+			delete(n.backups, id)
+		}
+	}
+}
+
+// Take a consistent snapshot of the whole database while writes go on.
+// Internal keys are backed up too, so a restored node keeps its expiries
+// and change log.
+func (n *Node) Backup(backupArgs *args.BackupArgs, reply *args.BackupReply) error {
+	received := time.Now()
+	if err := checkDeadline(backupArgs.Header, received); err != nil {
+		return err
+	}
+	snapshot, err := n.DB.GetSnapshot()
+	if err != nil {
+		return err
+	}
+	if backupArgs.Dir == "" {
+		id := uuid.NewV1().String()
+		n.backupMutex.Lock()
+		defer n.backupMutex.Unlock()
+		n.releaseExpiredBackups(received)
+		n.backups[id] = &backupSession{
+			snapshot: snapshot,
+			expire:   received.Add(opt.DefaultBackupTimeout),
+		}
+		reply.ID = id
+		return nil
+	}
+	defer snapshot.Release()
+	name := strings.Replace(n.Ipaddr, ":", "_", -1) + "-" + received.UTC().Format("20060102T150405.000Z") + ".pentadb"
+	path := filepath.Join(backupArgs.Dir, name)
+	summary, err := writeBackup(snapshot, path)
+	if err != nil {
+		return err
+	}
+	LOG.Infof("backed up %s to %s", summary, path)
+	reply.Path = path
+	reply.Pairs, reply.Checksum = summary.Pairs, summary.Checksum
+	return nil
+}
+
+// write the archive to a temporary file first,
+// so that `path` never holds a partial backup
+func writeBackup(snapshot *leveldb.Snapshot, path string) (archive.Summary, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return archive.Summary{}, err
+	}
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return archive.Summary{}, err
+	}
+	defer os.Remove(tmp)
+	defer f.Close()
+
+	w, err := archive.NewWriter(f)
+	if err != nil {
+		return archive.Summary{}, err
+	}
+	iter := snapshot.NewIterator(nil, nil)
+	for iter.Next() {
+		if err := w.Add(iter.Key(), iter.Value()); err != nil {
+			iter.Release()
+			return archive.Summary{}, err
+		}
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return archive.Summary{}, err
+	}
+	summary, err := w.Close()
+	if err != nil {
+		return summary, err
+	}
+	if err := f.Sync(); err != nil {
+		return summary, err
+	}
+	if err := f.Close(); err != nil {
+		return summary, err
+	}
+	return summary, os.Rename(tmp, path)
+}
+
+// Read a page of a snapshot kept by Backup, in key order. The snapshot
+// is kept after the last page, so a lost reply can be asked for again,
+// until ReleaseBackup or until nobody reads it for DefaultBackupTimeout.
+func (n *Node) ReadBackup(readArgs *args.ReadBackupArgs, reply *args.ReadBackupReply) error {
+	received := time.Now()
+	if err := checkDeadline(readArgs.Header, received); err != nil {
+		return err
+	}
+	n.backupMutex.Lock()
+	n.releaseExpiredBackups(received)
+	session, ok := n.backups[readArgs.ID]
+	if ok {
+		session.expire = received.Add(opt.DefaultBackupTimeout)
+	}
+	n.backupMutex.Unlock()
+	if !ok {
+		return rpc.ErrBackupNotFound
+	}
+
+	limit := readArgs.Limit
+	if limit <= 0 || limit > opt.DefaultBackupPageSize {
+		limit = opt.DefaultBackupPageSize
+	}
+	r := new(util.Range)
+	if readArgs.Started {
+		// the smallest key after `After`
+		r.Start = append(append([]byte(nil), readArgs.After...), 0)
+	}
+	iter := session.snapshot.NewIterator(r, nil)
+	defer iter.Release()
+	for iter.Next() {
+		if len(reply.KVs) >= limit {
+			reply.More = true
+			break
+		}
+		// the iterator reuses its buffers
+		reply.KVs = append(reply.KVs, args.KVArgs{
+			Key:   append([]byte(nil), iter.Key()...),
+			Value: append([]byte(nil), iter.Value()...),
+		})
+	}
+	return iter.Error()
+}
+
+// Release a snapshot kept by Backup, unknown ones are ignored
+func (n *Node) ReleaseBackup(id string, result *[]byte) error {
+	n.backupMutex.Lock()
+	defer n.backupMutex.Unlock()
+
+	if session, ok := n.backups[id]; ok {
+		session.snapshot.Release()
+		delete(n.backups, id)
+	}
+	return nil
+}
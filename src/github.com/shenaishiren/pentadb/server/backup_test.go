@@ -0,0 +1,88 @@
+package server
+
+import (
+	"os"
+	"fmt"
+	"testing"
+	"path/filepath"
+	"github.com/shenaishiren/pentadb/archive"
+	"github.com/shenaishiren/pentadb/args"
+	"github.com/shenaishiren/pentadb/rpc"
+)
+
+func TestBackupDir(t *testing.T) {
+	n := openTestNode(t)
+	for i := 0; i < 10; i++ {
+		n.Put(&args.KVArgs{Key: []byte(fmt.Sprint("k", i)), Value: []byte("v")}, nil)
+	}
+	dir := t.TempDir()
+	var reply args.BackupReply
+	if err := n.Backup(&args.BackupArgs{Dir: filepath.Join(dir, "backups")}, &reply); err != nil {
+		t.Fatal(err.Error())
+	}
+	f, err := os.Open(reply.Path)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer f.Close()
+	summary, err := archive.Verify(f)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	// the change log is backed up with the pairs
+	if summary.Pairs != 20 || summary.Pairs != reply.Pairs || summary.Checksum != reply.Checksum {
+		t.Fatalf("archive %+v, reply %+v", summary, reply)
+	}
+	// no temporary file is left
+	files, _ := filepath.Glob(filepath.Join(dir, "backups", "*"))
+	if len(files) != 1 {
+		t.Fatalf("files %v", files)
+	}
+}
+
+func TestReadBackup(t *testing.T) {
+	n := openTestNode(t)
+	for i := 0; i < 10; i++ {
+		n.Put(&args.KVArgs{Key: []byte(fmt.Sprint("k", i)), Value: []byte("v")}, nil)
+	}
+	var backup args.BackupReply
+	if err := n.Backup(&args.BackupArgs{}, &backup); err != nil {
+		t.Fatal(err.Error())
+	}
+	// not in the snapshot
+	n.Put(&args.KVArgs{Key: []byte("later"), Value: []byte("v")}, nil)
+
+	readArgs := &args.ReadBackupArgs{ID: backup.ID, Limit: 7}
+	var keys []string
+	var last args.ReadBackupReply
+	for pages := 0; ; pages++ {
+		var reply args.ReadBackupReply
+		if err := n.ReadBackup(readArgs, &reply); err != nil {
+			t.Fatal(err.Error())
+		}
+		if len(reply.KVs) > 7 || pages > 3 {
+			t.Fatalf("page %d of %d pairs", pages, len(reply.KVs))
+		}
+		for _, kv := range reply.KVs {
+			keys = append(keys, string(kv.Key))
+		}
+		if !reply.More {
+			last = reply
+			break
+		}
+		readArgs.After, readArgs.Started = reply.KVs[len(reply.KVs) - 1].Key, true
+	}
+	if len(keys) != 20 || keys[0] != "k0" || keys[9] != "k9" {
+		t.Fatalf("read %v", keys)
+	}
+
+	// the last page can be read again, its reply may have been lost
+	var again args.ReadBackupReply
+	if err := n.ReadBackup(readArgs, &again); err != nil || len(again.KVs) != len(last.KVs) {
+		t.Fatalf("read the last page again: %d pairs, %v", len(again.KVs), err)
+	}
+	n.ReleaseBackup(backup.ID, nil)
+	if err := n.ReadBackup(readArgs, &again); err != rpc.ErrBackupNotFound {
+		t.Fatalf("read after release: %v", err)
+	}
+}
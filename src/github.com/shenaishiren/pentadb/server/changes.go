@@ -0,0 +1,285 @@
+// Contains the change log of Node
+
+/* BSD 3-Clause License
+
+Copyright (c) 2017, Guan Jiawen, Li Lundong
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice, this
+  list of conditions and the following disclaimer.
+
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+
+* Neither the name of the copyright holder nor the names of its
+  contributors may be used to endorse or promote products derived from
+  this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+
+
+package server
+
+import (
+	"bytes"
+	"sync"
+	"time"
+	"encoding/binary"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"github.com/shenaishiren/pentadb/args"
+	"github.com/shenaishiren/pentadb/opt"
+	"github.com/shenaishiren/pentadb/rpc"
+)
+
+// change log: changePrefix | sequence number (8 bytes, big endian)
+var changePrefix = append(append([]byte(nil), internalPrefix...), "changes/"...)
+
+// The last changes of a node, stored in the database together with
+// the writes, so sequence numbers survive restarts. Changes older
+// than the change log size of the node are dropped.
+type changeLog struct {
+	mu *sync.Mutex
+
+	// kept sequence numbers are [first, last], first is last + 1 if none.
+	// Changes after last may be written already, but are not read until
+	// all changes before them are written.
+	first int64
+
+	last int64
+
+	// last sequence number handed to a write
+	assigned int64
+
+	// written changes after last, the end of each range by its start
+	written map[int64]int64
+
+	// closed and replaced when changes are appended
+	notify chan struct{}
+}
+
+func changeKey(seq int64) []byte {
+	buf := make([]byte, len(changePrefix) + 8)
+	n := copy(buf, changePrefix)
+	binary.BigEndian.PutUint64(buf[n:], uint64(seq))
+	return buf
+}
+
+// type (1 byte) | time (8 bytes) | key length (uvarint) | key | value
+func encodeChange(event *args.Event) []byte {
+	buf := make([]byte, 9 + binary.MaxVarintLen64 + len(event.Key) + len(event.Value))
+	buf[0] = byte(event.Type)
+	binary.BigEndian.PutUint64(buf[1:9], uint64(event.Time))
+	n := 9 + binary.PutUvarint(buf[9:], uint64(len(event.Key)))
+	n += copy(buf[n:], event.Key)
+	n += copy(buf[n:], event.Value)
+	return buf[:n]
+}
+
+func decodeChange(seq int64, raw []byte) (args.Event, error) {
+	if len(raw) < 10 {
+		return args.Event{}, errCorruptValue
+	}
+	keyLen, n := binary.Uvarint(raw[9:])
+	if n <= 0 || uint64(len(raw) - 9 - n) < keyLen {
+		return args.Event{}, errCorruptValue
+	}
+	rest := raw[9 + n:]
+	return args.Event{
+		Type:     args.EventType(raw[0]),
+		Time:     int64(binary.BigEndian.Uint64(raw[1:9])),
+		Key:      append([]byte(nil), rest[:keyLen]...),
+		Value:    append([]byte(nil), rest[keyLen:]...),
+		Revision: seq,
+	}, nil
+}
+
+// find the kept sequence numbers in the database
+func openChangeLog(db *leveldb.DB) (*changeLog, error) {
+	l := &changeLog{
+		mu:      new(sync.Mutex),
+		first:   1,
+		written: make(map[int64]int64),
+		notify:  make(chan struct{}),
+	}
+	iter := db.NewIterator(util.BytesPrefix(changePrefix), nil)
+	defer iter.Release()
+	if iter.First() {
+		l.first = int64(binary.BigEndian.Uint64(iter.Key()[len(changePrefix):]))
+		iter.Last()
+		l.last = int64(binary.BigEndian.Uint64(iter.Key()[len(changePrefix):]))
+	}
+	l.assigned = l.last
+	return l, iter.Error()
+}
+
+// implement leveldb.BatchReplay, values are still in envelopes
+type changeRecorder struct {
+	events []args.Event
+}
+
+func (r *changeRecorder) Put(key, value []byte) {
+	if isInternal(key) {
+		return
+	}
+	value, _, err := decodeValue(value)
+	if err != nil {
+		return
+	}
+	r.events = append(r.events, args.Event{Type: args.EventPut, Key: key, Value: value})
+}
+
+func (r *changeRecorder) Delete(key []byte) {
+	if isInternal(key) {
+		return
+	}
+	r.events = append(r.events, args.Event{Type: args.EventDelete, Key: key})
+}
+
+// Apply a batch and log its changes in the same write
+func (n *Node) write(batch *leveldb.Batch) error {
+	recorder := new(changeRecorder)
+	if err := batch.Replay(recorder); err != nil {
+		return err
+	}
+	// a frozen node holds the gate until it thaws
+	n.gate.RLock()
+	defer n.gate.RUnlock()
+	if err := n.checkMoving(recorder.events); err != nil {
+		return err
+	}
+
+	l := n.changes
+	// Only assigning sequence numbers is serialized, the writes run in
+	// parallel and may finish in any order. Writes of one key hold its
+	// stripe across this call, so its changes are still numbered in the
+	// order they are applied, and revisions never go back for a key.
+	l.mu.Lock()
+	now := time.Now().UnixNano()
+	start := l.assigned + 1
+	for i := range recorder.events {
+		event := &recorder.events[i]
+		event.Time = now
+		l.assigned++
+		batch.Put(changeKey(l.assigned), encodeChange(event))
+	}
+	// trim only what is written, a delete must not overtake its put
+	for l.assigned - l.first + 1 > n.options.GetChangeLogSize() && l.first <= l.last {
+		batch.Delete(changeKey(l.first))
+		l.first++
+	}
+	end := l.assigned
+	l.mu.Unlock()
+
+	err := n.DB.Write(batch, nil)
+	// a failed write leaves a gap, which must not hold back later changes
+	if end >= start {
+		l.publish(start, end)
+	}
+	return err
+}
+
+// make the written changes [start, end] visible to readers, once the
+// changes before are written as well
+func (l *changeLog) publish(start int64, end int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.written[start] = end
+	last := l.last
+	for {
+		end, ok := l.written[l.last + 1]
+		if !ok {
+			break
+		}
+		delete(l.written, l.last + 1)
+		l.last = end
+	}
+	if l.last != last {
+		close(l.notify)
+		l.notify = make(chan struct{})
+	}
+}
+
+// Apply a batch without logging it, nor refusing keys being migrated
+func (n *Node) writeUnlogged(batch *leveldb.Batch) error {
+	n.gate.RLock()
+	defer n.gate.RUnlock()
+	return n.DB.Write(batch, nil)
+}
+
+// Collect at most `limit` changes of keys with `prefix` after sequence
+// number `after`. Also return the sequence number read up to and a
+// channel closed once there are more changes.
+func (n *Node) changesSince(prefix []byte, after int64, limit int) ([]args.Event, int64, <-chan struct{}, error) {
+	l := n.changes
+	l.mu.Lock()
+	first, last, notify := l.first, l.last, l.notify
+	// a sequence number from the future is from a wiped database
+	if after < first - 1 || after > last {
+		l.mu.Unlock()
+		return nil, 0, nil, rpc.ErrCompacted
+	}
+	// the iterator reads a snapshot, so trimming can not make gaps
+	iter := n.DB.NewIterator(&util.Range{Start: changeKey(after + 1), Limit: changeKey(last + 1)}, nil)
+	l.mu.Unlock()
+	defer iter.Release()
+
+	seen := after
+	var events []args.Event
+	for len(events) < limit && iter.Next() {
+		seq := int64(binary.BigEndian.Uint64(iter.Key()[len(changePrefix):]))
+		event, err := decodeChange(seq, iter.Value())
+		if err != nil {
+			return nil, 0, nil, err
+		}
+		seen = seq
+		if bytes.HasPrefix(event.Key, prefix) {
+			events = append(events, event)
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return nil, 0, nil, err
+	}
+	return events, seen, notify, nil
+}
+
+// Return the logged changes from a sequence number on, moves of keys
+// between nodes are logged as puts on the new node only
+func (n *Node) ReadChanges(changesArgs *args.ChangesArgs, reply *args.ChangesReply) error {
+	received := time.Now()
+	if err := checkDeadline(changesArgs.Header, received); err != nil {
+		return err
+	}
+	from := changesArgs.FromSeq
+	if from == 0 {
+		n.changes.mu.Lock()
+		from = n.changes.first
+		n.changes.mu.Unlock()
+	}
+	limit := changesArgs.Limit
+	if limit <= 0 || limit > opt.DefaultWatchBatchSize {
+		limit = opt.DefaultWatchBatchSize
+	}
+	events, seen, _, err := n.changesSince(nil, from - 1, limit)
+	if err != nil {
+		return err
+	}
+	reply.Events, reply.LastSeq = events, seen
+	return nil
+}
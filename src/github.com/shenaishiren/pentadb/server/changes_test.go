@@ -0,0 +1,137 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+	"github.com/shenaishiren/pentadb/args"
+	"github.com/shenaishiren/pentadb/opt"
+	"github.com/shenaishiren/pentadb/rpc"
+)
+
+func openChangesNode(t *testing.T, stor storage.Storage) *Node {
+	db, err := leveldb.Open(stor, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	n := NewNodeWithOptions("127.0.0.1:4567", &opt.ServerOptions{ChangeLogSize: 5})
+	if err := n.Open(db); err != nil {
+		t.Fatal(err.Error())
+	}
+	return n
+}
+
+// read the revisions of changes from `from` on, at most `limit` of them
+func readRevisions(t *testing.T, n *Node, from int64, limit int) ([]int64, int64) {
+	var reply args.ChangesReply
+	if err := n.ReadChanges(&args.ChangesArgs{FromSeq: from, Limit: limit}, &reply); err != nil {
+		t.Fatal(err.Error())
+	}
+	var revisions []int64
+	for _, event := range reply.Events {
+		revisions = append(revisions, event.Revision)
+	}
+	return revisions, reply.LastSeq
+}
+
+func TestChangeLog(t *testing.T) {
+	stor := storage.NewMemStorage()
+	n := openChangesNode(t, stor)
+	for i := 0; i < 3; i++ {
+		n.Put(&args.KVArgs{Key: []byte(fmt.Sprint("k", i)), Value: []byte("v")}, nil)
+	}
+	// one sequence number per key, also in a batch
+	kvs := []args.KVArgs{{Key: []byte("k3"), Value: []byte("v")}, {Key: []byte("k4"), Value: []byte("v")}}
+	n.BatchPut(&args.KVArrayArgs{KVs: kvs}, nil)
+	n.Delete(&args.KeyArgs{Key: []byte("k0")}, nil)
+	revisions, last := readRevisions(t, n, 0, 0)
+	if fmt.Sprint(revisions) != "[2 3 4 5 6]" || last != 6 {
+		t.Fatalf("revisions %v up to %d, want the last 5 of 6", revisions, last)
+	}
+
+	// page through the log
+	var reply args.ChangesReply
+	n.ReadChanges(&args.ChangesArgs{FromSeq: 5, Limit: 1}, &reply)
+	if len(reply.Events) != 1 || string(reply.Events[0].Key) != "k4" || reply.LastSeq != 5 {
+		t.Fatalf("page from 5: %+v", reply)
+	}
+	if revisions, last := readRevisions(t, n, 6, 10); fmt.Sprint(revisions) != "[6]" || last != 6 {
+		t.Fatalf("page from 6: %v up to %d", revisions, last)
+	}
+	if revisions, last := readRevisions(t, n, 7, 10); len(revisions) != 0 || last != 6 {
+		t.Fatalf("page after the end: %v up to %d", revisions, last)
+	}
+
+	// trimmed changes, and changes not made yet
+	for _, from := range []int64{1, 8} {
+		if err := n.ReadChanges(&args.ChangesArgs{FromSeq: from}, &reply); err != rpc.ErrCompacted {
+			t.Fatalf("read from %d: %v", from, err)
+		}
+	}
+
+	// a reopened node resumes the kept sequence numbers
+	n.Close()
+	n = openChangesNode(t, stor)
+	defer n.Close()
+	if revisions, _ := readRevisions(t, n, 0, 0); fmt.Sprint(revisions) != "[2 3 4 5 6]" {
+		t.Fatalf("revisions %v after reopening", revisions)
+	}
+	n.Put(&args.KVArgs{Key: []byte("k5"), Value: []byte("v")}, nil)
+	if revisions, last := readRevisions(t, n, 0, 0); fmt.Sprint(revisions) != "[3 4 5 6 7]" || last != 7 {
+		t.Fatalf("revisions %v up to %d after a put", revisions, last)
+	}
+}
+
+// changes written out of order are read once the ones before are written
+func TestChangeLogPublish(t *testing.T) {
+	n := openTestNode(t)
+	l := n.changes
+	notify := l.notify
+	l.publish(3, 4)
+	if l.last != 0 {
+		t.Fatalf("last %d with changes 1 and 2 in flight", l.last)
+	}
+	l.publish(1, 2)
+	if l.last != 4 {
+		t.Fatalf("last %d, want 4", l.last)
+	}
+	select {
+	case <-notify:
+	default:
+		t.Fatal("watchers not told")
+	}
+}
+
+func TestConcurrentWrites(t *testing.T) {
+	n := openTestNode(t)
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				n.Put(&args.KVArgs{Key: []byte(fmt.Sprint("k", g, "-", i)), Value: []byte("v")}, nil)
+			}
+		}(g)
+	}
+	wg.Wait()
+	var revisions []int64
+	for from := int64(1); from <= 400; {
+		page, last := readRevisions(t, n, from, 0)
+		if len(page) == 0 {
+			t.Fatalf("no change from %d on", from)
+		}
+		revisions = append(revisions, page...)
+		from = last + 1
+	}
+	if len(revisions) != 400 {
+		t.Fatalf("%d changes, want 400", len(revisions))
+	}
+	for i, revision := range revisions {
+		if revision != int64(i + 1) {
+			t.Fatalf("revision %d at %d", revision, i)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+// Contains the cache of replies used to deduplicate retried requests
+
+/* BSD 3-Clause License
+
+Copyright (c) 2017, Guan Jiawen, Li Lundong
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice, this
+  list of conditions and the following disclaimer.
+
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+
+* Neither the name of the copyright holder nor the names of its
+  contributors may be used to endorse or promote products derived from
+  this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+
+
+package server
+
+import (
+	"sync"
+	"time"
+	"container/list"
+	"github.com/shenaishiren/pentadb/opt"
+)
+
+type dedupEntry struct {
+	requestID string
+
+	reply interface{}
+
+	expire time.Time
+}
+
+// Replies of recent requests by request id, so a retried request which
+// does not set but change a value is not applied twice. The oldest
+// replies are dropped first.
+type dedupCache struct {
+	mu *sync.Mutex
+
+	entries map[string]*list.Element
+
+	// oldest first
+	order *list.List
+}
+
+func newDedupCache() *dedupCache {
+	return &dedupCache{
+		mu:      new(sync.Mutex),
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+func (c *dedupCache) get(requestID string, now time.Time) (interface{}, bool) {
+	if requestID == "" {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[requestID]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*dedupEntry)
+	if now.After(entry.expire) {
+		return nil, false
+	}
+	return entry.reply, true
+}
+
+func (c *dedupCache) put(requestID string, reply interface{}, now time.Time) {
+	if requestID == "" {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[requestID]; ok {
+		c.order.Remove(elem)
+	}
+	c.entries[requestID] = c.order.PushBack(&dedupEntry{
+		requestID: requestID,
+		reply:     reply,
+		expire:    now.Add(opt.DefaultDedupTTL),
+	})
+	// drop expired entries and keep the size bounded
+	for front := c.order.Front(); front != nil; front = c.order.Front() {
+		entry := front.Value.(*dedupEntry)
+		if c.order.Len() <= opt.DefaultDedupSize && now.Before(entry.expire) {
+			break
+		}
+		c.order.Remove(front)
+		delete(c.entries, entry.requestID)
+	}
+}
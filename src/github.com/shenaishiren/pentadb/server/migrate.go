@@ -0,0 +1,290 @@
+// Contains the migration of data between owners of Node
+
+/* BSD 3-Clause License
+
+Copyright (c) 2017, Guan Jiawen, Li Lundong
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice, this
+  list of conditions and the following disclaimer.
+
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+
+* Neither the name of the copyright holder nor the names of its
+  contributors may be used to endorse or promote products derived from
+  this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+
+package server
+
+import (
+	"sync"
+	"time"
+	"bytes"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"github.com/shenaishiren/pentadb/args"
+	"github.com/shenaishiren/pentadb/keyhash"
+	"github.com/shenaishiren/pentadb/opt"
+	"github.com/shenaishiren/pentadb/rpc"
+)
+
+// number of pairs sent in one request when migrating data
+const migrateBatchSize = 512
+
+// Keys a migration target changed after a revision, kept across the
+// batches of a migration so the change log is read only once
+type changedKeys struct {
+	// the change log is read up to here
+	seen int64
+
+	keys map[string]bool
+
+	used time.Time
+}
+
+// by the revision they start from, see MigrateArgs.Since
+type changedKeysCache struct {
+	mu *sync.Mutex
+
+	entries map[int64]*changedKeys
+}
+
+func newChangedKeysCache() *changedKeysCache {
+	return &changedKeysCache{mu: new(sync.Mutex), entries: make(map[int64]*changedKeys)}
+}
+
+func inRanges(ranges []args.HashRange, hash uint32) bool {
+	for _, r := range ranges {
+		if r.Contains(hash) {
+			return true
+		}
+	}
+	return false
+}
+
+// Writes to keys being migrated away would be lost, they are refused
+// with ErrBusy until the migration ends. The gate must be held.
+func (n *Node) checkMoving(events []args.Event) error {
+	for _, m := range n.moving {
+		for i := range events {
+			if inRanges(m.Ranges, keyhash.Key(events[i].Key)) {
+				return rpc.ErrBusy
+			}
+		}
+	}
+	return nil
+}
+
+// Hand over the keys in the given hash ranges to the target node.
+// No lock is held while talking to the target, otherwise two nodes
+// migrating to each other would wait for each other forever.
+func (n *Node) Migrate(migrateArgs *args.MigrateArgs, result *[]byte) error {
+	conn, err := rpc.DialTimeout(opt.DefaultProtocol, migrateArgs.Target, opt.DefaultTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// from now on the moving keys cannot change here, the writes in
+	// flight are waited for, so the copies sent are their last versions
+	n.gate.Lock()
+	n.moving = append(n.moving, migrateArgs)
+	n.gate.Unlock()
+	defer func() {
+		n.gate.Lock()
+		for i, m := range n.moving {
+			if m == migrateArgs {
+				n.moving = append(n.moving[:i], n.moving[i + 1:]...)
+				break
+			}
+		}
+		n.gate.Unlock()
+	}()
+
+	var kvs []args.KVArgs
+	// the stored values of the pairs in kvs
+	var raws [][]byte
+	moved := 0
+	// send the pending pairs and delete them locally
+	flush := func() error {
+		if len(kvs) == 0 {
+			return nil
+		}
+		pairsArgs := &args.MigratePairsArgs{Since: migrateArgs.Since, KVs: kvs}
+		var reply []byte
+		if err := conn.Call("Node.MigratePairs", pairsArgs, &reply); err != nil {
+			return err
+		}
+		count, err := n.deleteMoved(kvs, raws)
+		moved += count
+		kvs, raws = kvs[:0], raws[:0]
+		return err
+	}
+	now := time.Now()
+	// internal keys stay, index entries of moved keys are swept later
+	iter := userIterator(n.DB, &util.Range{})
+	defer iter.Release()
+	for iter.Next() {
+		if !inRanges(migrateArgs.Ranges, keyhash.Key(iter.Key())) {
+			continue
+		}
+		value, expire, err := decodeValue(iter.Value())
+		if err != nil {
+			return err
+		}
+		// left to the sweeper
+		if expired(expire, now) {
+			continue
+		}
+		// the iterator reuses its buffers, the expiry is sent
+		// as absolute time so it does not move with the key
+		kv := args.KVArgs{Key: append([]byte(nil), iter.Key()...), Value: append([]byte(nil), value...)}
+		if !expire.IsZero() {
+			kv.ExpireAt = expire.UnixNano()
+		}
+		kvs = append(kvs, kv)
+		raws = append(raws, append([]byte(nil), iter.Value()...))
+		if len(kvs) >= migrateBatchSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return err
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+	LOG.Infof("migrated %d keys to %s", moved, migrateArgs.Target)
+	return nil
+}
+
+// Delete the moved keys whose value is still the copied one, return
+// the number deleted. Moved keys still exist, so watchers are not told.
+func (n *Node) deleteMoved(kvs []args.KVArgs, raws [][]byte) (int, error) {
+	keys := make([][]byte, len(kvs))
+	for i := range kvs {
+		keys[i] = kvs[i].Key
+	}
+	unlock := n.locks.lock(keys...)
+	defer unlock()
+
+	batch := new(leveldb.Batch)
+	for i, key := range keys {
+		raw, err := n.DB.Get(key, nil)
+		if err == leveldb.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return batch.Len(), err
+		}
+		if !bytes.Equal(raw, raws[i]) {
+			LOG.Warningf("key %q changed while migrating, kept", key)
+			continue
+		}
+		batch.Delete(key)
+	}
+	return batch.Len(), n.writeUnlogged(batch)
+}
+
+// Write pairs moved from another node, except those this node has a
+// newer version of: keys which exist or were changed after the revision
+// the migration started from, deletes included. Keys of prepared
+// transactions are written, the commit is newer still.
+func (n *Node) MigratePairs(pairsArgs *args.MigratePairsArgs, result *[]byte) error {
+	received := time.Now()
+	if err := checkDeadline(pairsArgs.Header, received); err != nil {
+		return err
+	}
+	keys := make([][]byte, len(pairsArgs.KVs))
+	for i := range pairsArgs.KVs {
+		keys[i] = pairsArgs.KVs[i].Key
+	}
+	unlock := n.locks.lock(keys...)
+	defer unlock()
+
+	changed, err := n.changedSince(pairsArgs.Since, received)
+	if err != nil {
+		return err
+	}
+	batch := new(leveldb.Batch)
+	for i := range pairsArgs.KVs {
+		kv := &pairsArgs.KVs[i]
+		if err := checkKey(kv.Key); err != nil {
+			return err
+		}
+		if changed[string(kv.Key)] {
+			continue
+		}
+		_, err := getValue(n.DB, kv.Key, received)
+		if err == nil {
+			continue
+		}
+		if err != leveldb.ErrNotFound {
+			return err
+		}
+		putValue(batch, kv.Key, kv.Value, expireOf(kv, received))
+	}
+	return n.write(batch)
+}
+
+// Return the keys changed after revision `since`. If the change log
+// does not go back that far, or `since` is negative, nothing is known
+// and only existing keys can win over moved ones.
+func (n *Node) changedSince(since int64, now time.Time) (map[string]bool, error) {
+	if since < 0 {
+		return nil, nil
+	}
+	cache := n.migrations
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	// entries of finished migrations
+	for start, entry := range cache.entries {
+		if now.Sub(entry.used) > opt.DefaultMigrateCacheTimeout {
+			delete(cache.entries, start)
+		}
+	}
+	entry := cache.entries[since]
+	if entry == nil {
+		entry = &changedKeys{seen: since, keys: make(map[string]bool)}
+		cache.entries[since] = entry
+	}
+	entry.used = now
+	for {
+		events, seen, _, err := n.changesSince(nil, entry.seen, opt.DefaultWatchBatchSize)
+		if err == rpc.ErrCompacted {
+			LOG.Warningf("changes after revision %d are compacted, moved keys may overwrite newer deletes", entry.seen)
+			delete(cache.entries, since)
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, event := range events {
+			entry.keys[string(event.Key)] = true
+		}
+		if seen == entry.seen {
+			return entry.keys, nil
+		}
+		entry.seen = seen
+	}
+}
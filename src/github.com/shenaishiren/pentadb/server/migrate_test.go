@@ -0,0 +1,104 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"github.com/shenaishiren/pentadb/args"
+	"github.com/shenaishiren/pentadb/rpc"
+)
+
+// serve `n` on a local port, only one node can be registered per process
+func serveTestNode(t *testing.T, n *Node) string {
+	if err := rpc.Register(n); err != nil {
+		t.Fatal(err.Error())
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go rpc.ServeConn(conn)
+		}
+	}()
+	return l.Addr().String()
+}
+
+func getString(n *Node, key string) (string, error) {
+	var value []byte
+	err := n.Get(&args.KeyArgs{Key: []byte(key)}, &value)
+	return string(value), err
+}
+
+func TestMigrate(t *testing.T) {
+	source, target := openTestNode(t), openTestNode(t)
+	for i := 0; i < 100; i++ {
+		source.Put(&args.KVArgs{Key: []byte(fmt.Sprint("k", i)), Value: []byte(fmt.Sprint("v", i))}, nil)
+	}
+	// sorts after the internal keys
+	source.Put(&args.KVArgs{Key: []byte("\xffz"), Value: []byte("z")}, nil)
+	var stats args.StatsReply
+	if err := target.Stats(&args.StatsArgs{}, &stats); err != nil {
+		t.Fatal(err.Error())
+	}
+	// written to the new owner before the data arrives
+	target.Put(&args.KVArgs{Key: []byte("k1"), Value: []byte("new")}, nil)
+	target.Delete(&args.KeyArgs{Key: []byte("k2")}, nil)
+
+	all := []args.HashRange{{Start: 0, End: 0}}
+	migrateArgs := &args.MigrateArgs{Target: serveTestNode(t, target), Ranges: all, Since: stats.Revision}
+	if err := source.Migrate(migrateArgs, nil); err != nil {
+		t.Fatal(err.Error())
+	}
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprint("k", i)
+		if _, err := getString(source, key); err != rpc.ErrNotFound {
+			t.Fatalf("%s left on the source: %v", key, err)
+		}
+		value, err := getString(target, key)
+		switch i {
+		case 1:
+			if value != "new" {
+				t.Fatalf("newer k1 overwritten with %q", value)
+			}
+		case 2:
+			if err != rpc.ErrNotFound {
+				t.Fatalf("deleted k2 brought back: %q %v", value, err)
+			}
+		default:
+			if value != fmt.Sprint("v", i) {
+				t.Fatalf("%s is %q %v", key, value, err)
+			}
+		}
+	}
+	if value, err := getString(target, "\xffz"); value != "z" {
+		t.Fatalf("key after the internal prefix not moved: %q %v", value, err)
+	}
+}
+
+func TestMigrateFence(t *testing.T) {
+	n := openTestNode(t)
+	n.Put(&args.KVArgs{Key: []byte("a"), Value: []byte("1")}, nil)
+	n.moving = []*args.MigrateArgs{{Ranges: []args.HashRange{{Start: 0, End: 0}}}}
+	if err := n.Put(&args.KVArgs{Key: []byte("a"), Value: []byte("2")}, nil); err != rpc.ErrBusy {
+		t.Fatalf("write to a moving key: %v", err)
+	}
+	n.moving = nil
+
+	// a key changed after it was copied is kept
+	raw, _ := n.DB.Get([]byte("a"), nil)
+	n.Put(&args.KVArgs{Key: []byte("a"), Value: []byte("3")}, nil)
+	count, err := n.deleteMoved([]args.KVArgs{{Key: []byte("a")}}, [][]byte{raw})
+	if err != nil || count != 0 {
+		t.Fatalf("deleted %d: %v", count, err)
+	}
+	if value, _ := getString(n, "a"); value != "3" {
+		t.Fatalf("a is %q", value)
+	}
+}
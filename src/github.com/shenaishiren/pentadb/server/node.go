@@ -35,11 +35,18 @@ package server
 
 import (
 	"sync"
+	"bytes"
+	"time"
 	"errors"
+	"math"
 	"math/rand"
+	"strconv"
 	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
 	"github.com/shenaishiren/pentadb/args"
 	"github.com/shenaishiren/pentadb/log"
+	"github.com/shenaishiren/pentadb/opt"
+	"github.com/shenaishiren/pentadb/rpc"
 	"fmt"
 )
 
@@ -63,27 +70,130 @@ type Node struct {
 
 	DB *leveldb.DB
 
-	mutex *sync.RWMutex   // read-write lock
+	mutex *sync.RWMutex   // protects the membership state, not the data
+
+	locks *keyLocks       // writes of a key exclude each other, reads take no lock
+
+	txnMutex *sync.Mutex  // serializes prepare, commit and abort
+
+	txnLockMutex *sync.RWMutex    // protects txns and txnLocks, taken last
+
+	txns map[string]*preparedTxn  // prepared transactions by id
+
+	txnLocks map[string]string    // keys locked by prepared transactions
+
+	stopSweep chan struct{}       // closed to stop the expired key sweeper
+
+	sweepDone chan struct{}
+
+	changes *changeLog            // recent changes, see changes.go
+
+	replies *dedupCache           // replies of requests which must not be applied twice
+
+	stopping chan struct{}        // closed when the node begins to shut down
+
+	stopOnce *sync.Once
+
+	options *opt.ServerOptions
+
+	backups map[string]*backupSession  // snapshots kept for reading by id
+
+	backupMutex *sync.Mutex
+
+	gate *sync.RWMutex            // writes hold it shared, a frozen node holds it exclusively
+
+	prepared int64                // number of prepared transactions, read atomically
+
+	freezeMutex *sync.Mutex       // protects frozen and thawTimer
+
+	frozen string                 // id of the snapshot taken when the node froze
+
+	thawTimer *time.Timer
+
+	moving []*args.MigrateArgs    // migrations away from the node, guarded by gate
+
+	migrations *changedKeysCache  // keys changed during migrations to the node
 }
 
 func NewNode(ipaddr string) *Node {
+	return NewNodeWithOptions(ipaddr, nil)
+}
+
+// NewNodeWithOptions is like NewNode, nil options mean defaults
+func NewNodeWithOptions(ipaddr string, options *opt.ServerOptions) *Node {
 	return &Node {
 		Ipaddr: ipaddr,
 		State: Running,
 		mutex: new(sync.RWMutex),
+		locks: new(keyLocks),
+		txnMutex: new(sync.Mutex),
+		txnLockMutex: new(sync.RWMutex),
+		txns: make(map[string]*preparedTxn),
+		txnLocks: make(map[string]string),
+		replies: newDedupCache(),
+		stopping: make(chan struct{}),
+		stopOnce: new(sync.Once),
+		options: options,
+		backups: make(map[string]*backupSession),
+		backupMutex: new(sync.Mutex),
+		migrations: newChangedKeysCache(),
+		gate: new(sync.RWMutex),
+		freezeMutex: new(sync.Mutex),
 	}
 }
 
+// Use an opened database, must be called before serving
+func (n *Node) Open(db *leveldb.DB) error {
+	changes, err := openChangeLog(db)
+	if err != nil {
+		return err
+	}
+	n.DB = db
+	n.changes = changes
+	return nil
+}
+
+// Stop begins to shut down, background work stops
+// and watch requests return at once
+func (n *Node) Stop() {
+	n.stopOnce.Do(func() {
+		n.mutex.Lock()
+		n.State = Terminal
+		n.mutex.Unlock()
+		close(n.stopping)
+		n.StopSweeper()
+	})
+}
+
+// Close the database, calls must not be served any more
+func (n *Node) Close() error {
+	n.Stop()
+	n.backupMutex.Lock()
+	for id, session := range n.backups {
+		session.snapshot.Release()
+		delete(n.backups, id)
+	}
+	n.backupMutex.Unlock()
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if n.DB == nil {
+		return nil
+	}
+	return n.DB.Close()
+}
+
 func (n *Node) randomChoice(list []string, k int) []string {
-	pool := list
-	p := len(pool)
-	result := make([]string, k)
+	// shuffle a copy, `list` is owned by the caller
+	pool := append([]string(nil), list...)
+	if k > len(pool) {
+		k = len(pool)
+	}
 	for i := 0; i < k; i++ {
-		j := rand.Intn(p - i)
-		result[i] = pool[j]
-		pool[j] = result[p - i - 1]
+		j := i + rand.Intn(len(pool) - i)
+		pool[i], pool[j] = pool[j], pool[i]
 	}
-	return result
+	return pool[:k]
 }
 
 func (n *Node) Init(args *args.InitArgs, result *[]byte) error {
@@ -129,27 +239,323 @@ func (n *Node) RemoveNode(node string, result *[]byte) error {
 	return nil
 }
 
-func (n *Node) Put(args *args.KVArgs, result *[]byte) error {
-	n.mutex.Lock()
-	defer n.mutex.Unlock()
+// Answer health checks of clients
+func (n *Node) Ping(payload []byte, result *[]byte) error {
+	*result = payload
+	return nil
+}
 
-	err := n.DB.Put(args.Key, args.Value, nil)
-	return err
+// drop the request if the client has stopped waiting for it
+func checkDeadline(header args.Header, received time.Time) error {
+	if deadline, ok := header.Deadline(received); ok && time.Now().After(deadline) {
+		return rpc.ErrDeadlineExceeded
+	}
+	return nil
 }
 
-func (n *Node) Get(key []byte, result *[]byte) error {
-	n.mutex.Lock()
-	defer n.mutex.Unlock()
+func (n *Node) Put(args *args.KVArgs, result *[]byte) error {
+	received := time.Now()
+	unlock := n.locks.lock(args.Key)
+	defer unlock()
 
-	res, err := n.DB.Get(key, nil)
+	if err := checkDeadline(args.Header, received); err != nil {
+		return err
+	}
+	if err := checkKey(args.Key); err != nil {
+		return err
+	}
+	if err := n.checkTxnLocks(args.Key); err != nil {
+		return err
+	}
+	batch := new(leveldb.Batch)
+	putValue(batch, args.Key, args.Value, expireOf(args, received))
+	return n.write(batch)
+}
+
+func (n *Node) Get(args *args.KeyArgs, result *[]byte) error {
+	received := time.Now()
+	if err := checkDeadline(args.Header, received); err != nil {
+		return err
+	}
+	res, err := getValue(n.DB, args.Key, received)
+	if err == leveldb.ErrNotFound {
+		return rpc.ErrNotFound
+	}
 	*result = res
 	return err
 }
 
-func (n *Node) Delete(key []byte, result *[]byte) error {
-	n.mutex.Lock()
-	defer n.mutex.Unlock()
+// Like Get, but also return when the value expires
+func (n *Node) GetEntry(args *args.KeyArgs, reply *args.ValueReply) error {
+	received := time.Now()
+	if err := checkDeadline(args.Header, received); err != nil {
+		return err
+	}
+	raw, err := n.DB.Get(args.Key, nil)
+	if err == leveldb.ErrNotFound {
+		return rpc.ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	value, expire, err := decodeValue(raw)
+	if err != nil {
+		return err
+	}
+	if expired(expire, received) {
+		return rpc.ErrNotFound
+	}
+	reply.Value = value
+	if !expire.IsZero() {
+		reply.ExpireAt = expire.UnixNano()
+	}
+	return nil
+}
 
-	err := n.DB.Delete(key, nil)
-	return err
-}
\ No newline at end of file
+func (n *Node) Delete(args *args.KeyArgs, result *[]byte) error {
+	received := time.Now()
+	unlock := n.locks.lock(args.Key)
+	defer unlock()
+
+	if err := checkDeadline(args.Header, received); err != nil {
+		return err
+	}
+	if err := checkKey(args.Key); err != nil {
+		return err
+	}
+	if err := n.checkTxnLocks(args.Key); err != nil {
+		return err
+	}
+	batch := new(leveldb.Batch)
+	batch.Delete(args.Key)
+	return n.write(batch)
+}
+
+// Write all pairs in one atomic batch
+func (n *Node) BatchPut(args *args.KVArrayArgs, result *[]byte) error {
+	received := time.Now()
+	keys := make([][]byte, len(args.KVs))
+	for i := range args.KVs {
+		keys[i] = args.KVs[i].Key
+	}
+	unlock := n.locks.lock(keys...)
+	defer unlock()
+
+	if err := checkDeadline(args.Header, received); err != nil {
+		return err
+	}
+	if err := n.checkTxnLocks(keys...); err != nil {
+		return err
+	}
+	batch := new(leveldb.Batch)
+	for i := range args.KVs {
+		kv := &args.KVs[i]
+		if err := checkKey(kv.Key); err != nil {
+			return err
+		}
+		putValue(batch, kv.Key, kv.Value, expireOf(kv, received))
+	}
+	return n.write(batch)
+}
+
+// Read all keys from one snapshot, missing keys are reported
+// in the reply instead of failing the whole request
+func (n *Node) MultiGet(keyArrayArgs *args.KeyArrayArgs, reply *args.ValueArrayReply) error {
+	received := time.Now()
+	if err := checkDeadline(keyArrayArgs.Header, received); err != nil {
+		return err
+	}
+	snapshot, err := n.DB.GetSnapshot()
+	if err != nil {
+		return err
+	}
+	defer snapshot.Release()
+	reply.Values = make([][]byte, len(keyArrayArgs.Keys))
+	reply.Found = make([]bool, len(keyArrayArgs.Keys))
+	for i, key := range keyArrayArgs.Keys {
+		value, err := getValue(snapshot, key, received)
+		if err == leveldb.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		reply.Values[i] = value
+		reply.Found[i] = true
+	}
+	return nil
+}
+
+// Delete all keys in one atomic batch
+func (n *Node) BatchDelete(args *args.KeyArrayArgs, result *[]byte) error {
+	received := time.Now()
+	unlock := n.locks.lock(args.Keys...)
+	defer unlock()
+
+	if err := checkDeadline(args.Header, received); err != nil {
+		return err
+	}
+	for _, key := range args.Keys {
+		if err := checkKey(key); err != nil {
+			return err
+		}
+	}
+	if err := n.checkTxnLocks(args.Keys...); err != nil {
+		return err
+	}
+	batch := new(leveldb.Batch)
+	for _, key := range args.Keys {
+		batch.Delete(key)
+	}
+	return n.write(batch)
+}
+
+// Apply a write only if the current value matches,
+// `swapped` reports whether the condition held
+func (n *Node) CompareAndSwap(casArgs *args.CASArgs, swapped *bool) error {
+	received := time.Now()
+	unlock := n.locks.lock(casArgs.Key)
+	defer unlock()
+
+	if err := checkDeadline(casArgs.Header, received); err != nil {
+		return err
+	}
+	if err := checkKey(casArgs.Key); err != nil {
+		return err
+	}
+	if err := n.checkTxnLocks(casArgs.Key); err != nil {
+		return err
+	}
+	// a retry of a swap must not be compared with its own write
+	if reply, ok := n.replies.get(casArgs.RequestID, received); ok {
+		*swapped = reply.(bool)
+		return nil
+	}
+	current, err := getValue(n.DB, casArgs.Key, received)
+	switch {
+	case err == leveldb.ErrNotFound:
+		*swapped = casArgs.ExpectAbsent
+	case err != nil:
+		return err
+	default:
+		*swapped = !casArgs.ExpectAbsent && bytes.Equal(current, casArgs.Expected)
+	}
+	if !*swapped {
+		return nil
+	}
+	batch := new(leveldb.Batch)
+	if casArgs.Delete {
+		batch.Delete(casArgs.Key)
+	} else {
+		putValue(batch, casArgs.Key, casArgs.Value, time.Time{})
+	}
+	if err := n.write(batch); err != nil {
+		return err
+	}
+	n.replies.put(casArgs.RequestID, true, received)
+	return nil
+}
+
+// Add a delta to the counter at a key and return the new value.
+// Counters are decimal strings, a missing key counts as 0 and
+// an existing expiry is kept.
+func (n *Node) Incr(incrArgs *args.IncrArgs, result *int64) error {
+	received := time.Now()
+	unlock := n.locks.lock(incrArgs.Key)
+	defer unlock()
+
+	if err := checkDeadline(incrArgs.Header, received); err != nil {
+		return err
+	}
+	if err := checkKey(incrArgs.Key); err != nil {
+		return err
+	}
+	if err := n.checkTxnLocks(incrArgs.Key); err != nil {
+		return err
+	}
+	if reply, ok := n.replies.get(incrArgs.RequestID, received); ok {
+		*result = reply.(int64)
+		return nil
+	}
+	var current int64
+	var expire time.Time
+	raw, err := n.DB.Get(incrArgs.Key, nil)
+	switch {
+	case err == leveldb.ErrNotFound:
+	case err != nil:
+		return err
+	default:
+		var value []byte
+		value, expire, err = decodeValue(raw)
+		if err != nil {
+			return err
+		}
+		if expired(expire, received) {
+			expire = time.Time{}
+			break
+		}
+		current, err = strconv.ParseInt(string(value), 10, 64)
+		if err != nil {
+			return rpc.ErrNotInteger
+		}
+	}
+	delta := incrArgs.Delta
+	if (delta > 0 && current > math.MaxInt64 - delta) || (delta < 0 && current < math.MinInt64 - delta) {
+		return rpc.ErrOverflow
+	}
+	current += delta
+	// the index entry of the expiry exists already
+	batch := new(leveldb.Batch)
+	batch.Put(incrArgs.Key, encodeValue(strconv.AppendInt(nil, current, 10), expire))
+	if err := n.write(batch); err != nil {
+		return err
+	}
+	n.replies.put(incrArgs.RequestID, current, received)
+	*result = current
+	return nil
+}
+
+// Return keys of a range in order, at most `Limit` of them
+func (n *Node) Scan(scanArgs *args.ScanArgs, reply *args.ScanReply) error {
+	received := time.Now()
+	if err := checkDeadline(scanArgs.Header, received); err != nil {
+		return err
+	}
+	r := &util.Range{Start: scanArgs.Start, Limit: scanArgs.End}
+	if scanArgs.Prefix != nil {
+		r = util.BytesPrefix(scanArgs.Prefix)
+		// narrow the prefix range by start and end
+		if bytes.Compare(scanArgs.Start, r.Start) > 0 {
+			r.Start = scanArgs.Start
+		}
+		if scanArgs.End != nil && (r.Limit == nil || bytes.Compare(scanArgs.End, r.Limit) < 0) {
+			r.Limit = scanArgs.End
+		}
+	}
+	// keep internal keys out of sight
+	iter := userIterator(n.DB, r)
+	defer iter.Release()
+	for iter.Next() {
+		value, expire, err := decodeValue(iter.Value())
+		if err != nil {
+			return err
+		}
+		if expired(expire, received) {
+			continue
+		}
+		if scanArgs.Limit > 0 && len(reply.KVs) >= scanArgs.Limit {
+			reply.More = true
+			break
+		}
+		// the iterator reuses its buffers
+		kv := args.KVArgs{
+			Key: append([]byte(nil), iter.Key()...),
+			Value: append([]byte(nil), value...),
+		}
+		if !expire.IsZero() {
+			kv.ExpireAt = expire.UnixNano()
+		}
+		reply.KVs = append(reply.KVs, kv)
+	}
+	return iter.Error()
+}
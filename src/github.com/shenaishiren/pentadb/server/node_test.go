@@ -0,0 +1,313 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+	"time"
+	"testing"
+	"math/rand"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+	"github.com/shenaishiren/pentadb/args"
+	"github.com/shenaishiren/pentadb/rpc"
+)
+
+func openTestNode(tb testing.TB) *Node {
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		tb.Fatal(err.Error())
+	}
+	n := NewNode("127.0.0.1:4567")
+	if err := n.Open(db); err != nil {
+		tb.Fatal(err.Error())
+	}
+	tb.Cleanup(func() { n.Close() })
+	return n
+}
+
+func TestConcurrentIncr(t *testing.T) {
+	n := openTestNode(t)
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				var result int64
+				if err := n.Incr(&args.IncrArgs{Key: []byte("counter"), Delta: 1}, &result); err != nil {
+					t.Error(err.Error())
+					return
+				}
+				// plain writes of other keys run alongside
+				n.Put(&args.KVArgs{Key: []byte(fmt.Sprint("k", i)), Value: []byte("v")}, nil)
+			}
+		}()
+	}
+	wg.Wait()
+	var value []byte
+	if err := n.Get(&args.KeyArgs{Key: []byte("counter")}, &value); err != nil {
+		t.Fatal(err.Error())
+	}
+	if string(value) != "800" {
+		t.Fatalf("counter is %s, want 800", value)
+	}
+}
+
+// 90% gets and 10% puts over 1000 keys from parallel clients, through
+// one exclusive lock like the old node took, and through the stripe
+// locks alone. Compare core counts with -cpu
+func BenchmarkNodeParallel(b *testing.B) {
+	n := openTestNode(b)
+	for i := 0; i < 1000; i++ {
+		if err := n.Put(&args.KVArgs{Key: []byte(fmt.Sprint("key", i)), Value: make([]byte, 100)}, nil); err != nil {
+			b.Fatal(err.Error())
+		}
+	}
+	global := new(sync.Mutex)
+	b.Run("GlobalLock", func(b *testing.B) {
+		benchmarkNode(b, n, func(call func()) {
+			global.Lock()
+			defer global.Unlock()
+			call()
+		})
+	})
+	b.Run("Striped", func(b *testing.B) {
+		benchmarkNode(b, n, func(call func()) { call() })
+	})
+}
+
+// run the calls of parallel clients through `wrap`
+func benchmarkNode(b *testing.B, n *Node, wrap func(call func())) {
+	b.SetParallelism(8)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		r := rand.New(rand.NewSource(rand.Int63()))
+		value := make([]byte, 100)
+		var result []byte
+		for pb.Next() {
+			key := []byte(fmt.Sprint("key", r.Intn(1000)))
+			if r.Intn(10) == 0 {
+				wrap(func() { n.Put(&args.KVArgs{Key: key, Value: value}, nil) })
+			} else {
+				wrap(func() { n.Get(&args.KeyArgs{Key: key}, &result) })
+			}
+		}
+	})
+}
+
+func TestFreeze(t *testing.T) {
+	n := openTestNode(t)
+	ops := []args.BatchOp{{Type: args.OpPut, Key: []byte("a"), Value: []byte("1")}}
+	if err := n.Prepare(&args.TxnArgs{TxnID: "t1", Ops: ops}, nil); err != nil {
+		t.Fatal(err.Error())
+	}
+	// a prepared transaction could commit on one side of the barrier
+	var reply args.BackupReply
+	if err := n.Freeze(&args.FreezeArgs{}, &reply); err != rpc.ErrBusy {
+		t.Fatalf("freeze with a prepared transaction: %v", err)
+	}
+	n.Abort(&args.TxnArgs{TxnID: "t1"}, nil)
+	if err := n.Freeze(&args.FreezeArgs{}, &reply); err != nil {
+		t.Fatal(err.Error())
+	}
+	written := make(chan struct{})
+	go func() {
+		n.Put(&args.KVArgs{Key: []byte("b"), Value: []byte("2")}, nil)
+		close(written)
+	}()
+	select {
+	case <-written:
+		t.Fatal("write went through a frozen node")
+	case <-time.After(50 * time.Millisecond):
+	}
+	var thawed bool
+	if n.Thaw(reply.ID, &thawed); !thawed {
+		t.Fatal("frozen node not thawed")
+	}
+	<-written
+	// thawed already, e.g. by itself after the hold
+	if n.Thaw(reply.ID, &thawed); thawed {
+		t.Fatal("thawed twice")
+	}
+
+	// the snapshot was taken before the write
+	var page args.ReadBackupReply
+	if err := n.ReadBackup(&args.ReadBackupArgs{ID: reply.ID}, &page); err != nil {
+		t.Fatal(err.Error())
+	}
+	for _, kv := range page.KVs {
+		if string(kv.Key) == "b" {
+			t.Fatal("snapshot holds a write made after the freeze")
+		}
+	}
+}
+
+func TestBatchOps(t *testing.T) {
+	n := openTestNode(t)
+	kvs := []args.KVArgs{{Key: []byte("a"), Value: []byte("1")}, {Key: []byte("b"), Value: []byte("2")}}
+	if err := n.BatchPut(&args.KVArrayArgs{KVs: kvs}, nil); err != nil {
+		t.Fatal(err.Error())
+	}
+	// one bad pair fails the whole batch
+	bad := append(kvs, args.KVArgs{Key: []byte(args.InternalPrefix + "x"), Value: []byte("3")})
+	bad[0].Value = []byte("changed")
+	if err := n.BatchPut(&args.KVArrayArgs{KVs: bad}, nil); err != rpc.ErrReservedKey {
+		t.Fatalf("batch with a reserved key: %v", err)
+	}
+
+	// missing keys are reported per key, not as an error
+	var reply args.ValueArrayReply
+	keys := [][]byte{[]byte("a"), []byte("missing"), []byte("b")}
+	if err := n.MultiGet(&args.KeyArrayArgs{Keys: keys}, &reply); err != nil {
+		t.Fatal(err.Error())
+	}
+	if !reply.Found[0] || reply.Found[1] || !reply.Found[2] {
+		t.Fatalf("found %v", reply.Found)
+	}
+	if string(reply.Values[0]) != "1" || reply.Values[1] != nil || string(reply.Values[2]) != "2" {
+		t.Fatalf("values %q", reply.Values)
+	}
+
+	if err := n.BatchDelete(&args.KeyArrayArgs{Keys: keys}, nil); err != nil {
+		t.Fatal(err.Error())
+	}
+	reply = args.ValueArrayReply{}
+	n.MultiGet(&args.KeyArrayArgs{Keys: keys}, &reply)
+	for i, found := range reply.Found {
+		if found {
+			t.Fatalf("%s left after delete", keys[i])
+		}
+	}
+}
+
+func TestScan(t *testing.T) {
+	n := openTestNode(t)
+	for i := 0; i < 10; i++ {
+		n.Put(&args.KVArgs{Key: []byte(fmt.Sprint("k", i)), Value: []byte(fmt.Sprint(i))}, nil)
+	}
+	// expiring keys add index entries, which must stay hidden
+	n.Put(&args.KVArgs{Key: []byte("x"), Value: []byte("x"), TTL: time.Hour}, nil)
+
+	// page through the prefix 3 keys at a time
+	var keys []string
+	start := []byte(nil)
+	for page := 0; ; page++ {
+		var reply args.ScanReply
+		if err := n.Scan(&args.ScanArgs{Prefix: []byte("k"), Start: start, Limit: 3}, &reply); err != nil {
+			t.Fatal(err.Error())
+		}
+		if len(reply.KVs) > 3 {
+			t.Fatalf("page %d has %d pairs", page, len(reply.KVs))
+		}
+		for _, kv := range reply.KVs {
+			keys = append(keys, string(kv.Key))
+		}
+		if !reply.More {
+			break
+		}
+		start = append(reply.KVs[len(reply.KVs)-1].Key, 0)
+	}
+	if fmt.Sprint(keys) != "[k0 k1 k2 k3 k4 k5 k6 k7 k8 k9]" {
+		t.Fatalf("scanned %v", keys)
+	}
+
+	// without a limit the range is read at once
+	var reply args.ScanReply
+	if err := n.Scan(&args.ScanArgs{Start: []byte("k8")}, &reply); err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(reply.KVs) != 3 || reply.More || string(reply.KVs[2].Key) != "x" || reply.KVs[2].ExpireAt == 0 {
+		t.Fatalf("scan from k8: %+v", reply)
+	}
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	n := openTestNode(t)
+	cas := func(c args.CASArgs) bool {
+		var swapped bool
+		if err := n.CompareAndSwap(&c, &swapped); err != nil {
+			t.Fatal(err.Error())
+		}
+		return swapped
+	}
+	key := []byte("a")
+	// a missing key only matches ExpectAbsent
+	if cas(args.CASArgs{Key: key, Expected: []byte(""), Value: []byte("1")}) {
+		t.Fatal("swapped a missing key by value")
+	}
+	if !cas(args.CASArgs{Key: key, ExpectAbsent: true, Value: []byte("1")}) {
+		t.Fatal("missing key not swapped")
+	}
+	// a present key only matches its value
+	if cas(args.CASArgs{Key: key, ExpectAbsent: true, Value: []byte("2")}) {
+		t.Fatal("swapped a present key as absent")
+	}
+	if cas(args.CASArgs{Key: key, Expected: []byte("2"), Value: []byte("3")}) {
+		t.Fatal("swapped a present key with another value")
+	}
+	if value, _ := getString(n, "a"); value != "1" {
+		t.Fatalf("a = %q after failed swaps, want 1", value)
+	}
+	if !cas(args.CASArgs{Key: key, Expected: []byte("1"), Value: []byte("2")}) {
+		t.Fatal("present key not swapped")
+	}
+	if !cas(args.CASArgs{Key: key, Expected: []byte("2"), Delete: true}) {
+		t.Fatal("present key not deleted")
+	}
+	if _, err := getString(n, "a"); err != rpc.ErrNotFound {
+		t.Fatalf("get after delete: %v", err)
+	}
+}
+
+func TestIncrNotInteger(t *testing.T) {
+	n := openTestNode(t)
+	n.Put(&args.KVArgs{Key: []byte("a"), Value: []byte("one")}, nil)
+	var result int64
+	if err := n.Incr(&args.IncrArgs{Key: []byte("a"), Delta: 1}, &result); err != rpc.ErrNotInteger {
+		t.Fatalf("incr of a non-integer: %v", err)
+	}
+	if value, _ := getString(n, "a"); value != "one" {
+		t.Fatalf("a = %q after a failed incr", value)
+	}
+	// a missing key counts as 0
+	if err := n.Incr(&args.IncrArgs{Key: []byte("b"), Delta: -2}, &result); err != nil || result != -2 {
+		t.Fatalf("incr of a missing key: %d, %v", result, err)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	n := openTestNode(t)
+	var current args.WatchReply
+	if err := n.Watch(&args.WatchArgs{After: -1}, &current); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// no change of the prefix, the watch times out empty
+	n.Put(&args.KVArgs{Key: []byte("other"), Value: []byte("1")}, nil)
+	var reply args.WatchReply
+	watchArgs := &args.WatchArgs{Header: args.Header{Timeout: 50 * time.Millisecond}, Prefix: []byte("w/"), After: current.Revision}
+	if err := n.Watch(watchArgs, &reply); err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(reply.Events) != 0 || reply.Revision <= current.Revision {
+		t.Fatalf("watch without a change: %+v", reply)
+	}
+
+	// a put while waiting wakes the watch up
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		n.Put(&args.KVArgs{Key: []byte("w/a"), Value: []byte("2")}, nil)
+	}()
+	reply = args.WatchReply{}
+	watchArgs = &args.WatchArgs{Header: args.Header{Timeout: 5 * time.Second}, Prefix: []byte("w/"), After: current.Revision}
+	started := time.Now()
+	if err := n.Watch(watchArgs, &reply); err != nil {
+		t.Fatal(err.Error())
+	}
+	if time.Since(started) > time.Second {
+		t.Fatal("watch did not return on the put")
+	}
+	if len(reply.Events) != 1 || reply.Events[0].Type != args.EventPut || string(reply.Events[0].Key) != "w/a" || string(reply.Events[0].Value) != "2" {
+		t.Fatalf("events %+v", reply.Events)
+	}
+}
@@ -0,0 +1,150 @@
+// Contains the write barrier and restore of cluster snapshots
+
+/* BSD 3-Clause License
+
+Copyright (c) 2017, Guan Jiawen, Li Lundong
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice, this
+  list of conditions and the following disclaimer.
+
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+
+* Neither the name of the copyright holder nor the names of its
+  contributors may be used to endorse or promote products derived from
+  this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package server
+
+import (
+	"time"
+	"sync/atomic"
+	"github.com/satori/go.uuid"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/shenaishiren/pentadb/args"
+	"github.com/shenaishiren/pentadb/opt"
+	"github.com/shenaishiren/pentadb/rpc"
+)
+
+// Wait for the writes in flight, stop new ones and take a snapshot.
+// A cluster is snapshotted consistently by freezing every node before
+// thawing any, so a write seen on one node has all writes it waited for
+// on the others. Nodes with prepared transactions refuse with ErrBusy,
+// as their commits would land on one side of the barrier only.
+func (n *Node) Freeze(freezeArgs *args.FreezeArgs, reply *args.BackupReply) error {
+	received := time.Now()
+	if err := checkDeadline(freezeArgs.Header, received); err != nil {
+		return err
+	}
+	n.freezeMutex.Lock()
+	defer n.freezeMutex.Unlock()
+
+	if n.frozen != "" {
+		return rpc.ErrBusy
+	}
+	n.gate.Lock()
+	// transactions are only prepared with the gate held shared
+	if atomic.LoadInt64(&n.prepared) > 0 {
+		n.gate.Unlock()
+		return rpc.ErrBusy
+	}
+	snapshot, err := n.DB.GetSnapshot()
+	if err != nil {
+		n.gate.Unlock()
+		return err
+	}
+	id := uuid.NewV1().String()
+	n.backupMutex.Lock()
+	n.backups[id] = &backupSession{
+		snapshot: snapshot,
+		expire:   received.Add(opt.DefaultBackupTimeout),
+	}
+	n.backupMutex.Unlock()
+
+	hold := freezeArgs.Hold
+	if hold <= 0 || hold > opt.DefaultFreezeHold {
+		hold = opt.DefaultFreezeHold
+	}
+	// the coordinator may die, do not stop writes forever
+	n.frozen = id
+	n.thawTimer = time.AfterFunc(hold, func() {
+		if n.thaw(id) {
+			LOG.Warningf("snapshot %s was not thawed in %s", id, hold)
+		}
+	})
+	reply.ID = id
+	return nil
+}
+
+// Let writes go on after Freeze, the snapshot stays readable.
+// `thawed` is false if the node was no longer frozen under `id`,
+// then writes may have gone on before all nodes froze.
+func (n *Node) Thaw(id string, thawed *bool) error {
+	*thawed = n.thaw(id)
+	return nil
+}
+
+func (n *Node) thaw(id string) bool {
+	n.freezeMutex.Lock()
+	defer n.freezeMutex.Unlock()
+
+	if id == "" || n.frozen != id {
+		return false
+	}
+	n.frozen = ""
+	n.thawTimer.Stop()
+	n.gate.Unlock()
+	return true
+}
+
+// Write the user pairs of a backup, which may come from another node.
+// Internal keys are skipped, the node indexes expiries itself and
+// logs the pairs as new changes.
+func (n *Node) RestorePairs(restoreArgs *args.RestoreArgs, result *[]byte) error {
+	received := time.Now()
+	if err := checkDeadline(restoreArgs.Header, received); err != nil {
+		return err
+	}
+	var keys [][]byte
+	for _, kv := range restoreArgs.KVs {
+		keys = append(keys, kv.Key)
+	}
+	unlock := n.locks.lock(keys...)
+	defer unlock()
+	if err := n.checkTxnLocks(keys...); err != nil {
+		return err
+	}
+
+	batch := new(leveldb.Batch)
+	for _, kv := range restoreArgs.KVs {
+		if isInternal(kv.Key) {
+			continue
+		}
+		value, expire, err := decodeValue(kv.Value)
+		if err != nil {
+			return err
+		}
+		if expired(expire, received) {
+			continue
+		}
+		putValue(batch, kv.Key, value, expire)
+	}
+	return n.write(batch)
+}
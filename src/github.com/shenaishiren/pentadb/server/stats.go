@@ -0,0 +1,81 @@
+// Contains the statistics of Node
+
+/* BSD 3-Clause License
+
+Copyright (c) 2017, Guan Jiawen, Li Lundong
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice, this
+  list of conditions and the following disclaimer.
+
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+
+* Neither the name of the copyright holder nor the names of its
+  contributors may be used to endorse or promote products derived from
+  this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package server
+
+import (
+	"time"
+	"github.com/syndtr/goleveldb/leveldb"
+	lopt "github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/shenaishiren/pentadb/args"
+)
+
+// Report the LevelDB settings and counters of the node
+func (n *Node) Stats(statsArgs *args.StatsArgs, reply *args.StatsReply) error {
+	if err := checkDeadline(statsArgs.Header, time.Now()); err != nil {
+		return err
+	}
+	// the getters of goleveldb fill in the defaults of nil options
+	options := n.options.LevelDB()
+	compression := "snappy"
+	if options.GetCompression() == lopt.NoCompression {
+		compression = "none"
+	}
+	reply.Options = args.LevelDBOptions{
+		BlockCacheSize:         options.GetBlockCacheCapacity(),
+		WriteBufferSize:        options.GetWriteBuffer(),
+		Compression:            compression,
+		CompactionTableSize:    options.GetCompactionTableSize(0),
+		OpenFilesCacheCapacity: options.GetOpenFilesCacheCapacity(),
+	}
+	if n.options != nil {
+		reply.Options.BloomBitsPerKey = n.options.BloomBitsPerKey
+	}
+
+	stats := new(leveldb.DBStats)
+	if err := n.DB.Stats(stats); err != nil {
+		return err
+	}
+	reply.BlockCacheSize = stats.BlockCacheSize
+	reply.OpenedTables = stats.OpenedTablesCount
+	reply.IORead, reply.IOWrite = stats.IORead, stats.IOWrite
+	reply.WriteDelayCount = stats.WriteDelayCount
+	reply.WriteDelayDuration = stats.WriteDelayDuration
+	reply.LevelSizes = stats.LevelSizes
+	reply.LevelTables = stats.LevelTablesCounts
+
+	n.changes.mu.Lock()
+	reply.Revision = n.changes.last
+	n.changes.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,302 @@
+// Contains the value envelope, key expiry and the expired key sweeper of Node
+
+/* BSD 3-Clause License
+
+Copyright (c) 2017, Guan Jiawen, Li Lundong
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice, this
+  list of conditions and the following disclaimer.
+
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+
+* Neither the name of the copyright holder nor the names of its
+  contributors may be used to endorse or promote products derived from
+  this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+
+
+package server
+
+import (
+	"bytes"
+	"errors"
+	"time"
+	"encoding/binary"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"github.com/syndtr/goleveldb/leveldb/comparer"
+	"github.com/syndtr/goleveldb/leveldb/iterator"
+	lopt "github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/shenaishiren/pentadb/args"
+	"github.com/shenaishiren/pentadb/opt"
+	"github.com/shenaishiren/pentadb/rpc"
+)
+
+// Every value is stored in an envelope:
+//   magic (4 bytes) | version (1 byte) | flag (1 byte) |
+//   expiry in unix nanoseconds (8 bytes, only with envelopeTTL) | value
+// Values written before envelopes existed lack the magic, they are read
+// as plain values which never expire. So is a value with an unknown
+// version, as the magic may start a legacy value by chance.
+var envelopeMagic = []byte("\xfepdb")
+
+const envelopeVersion byte = 1
+
+const envelopeHeader = 6
+
+const (
+	envelopePlain byte = iota
+	envelopeTTL
+)
+
+var errCorruptValue = errors.New("corrupt value envelope")
+
+// see args.InternalPrefix
+var internalPrefix = []byte(args.InternalPrefix)
+
+// expiry index: ttlPrefix | expiry (8 bytes, big endian) | key,
+// ordered by expiry so the sweeper only reads what is due
+var ttlPrefix = append(append([]byte(nil), internalPrefix...), "ttl/"...)
+
+func isInternal(key []byte) bool {
+	return bytes.HasPrefix(key, internalPrefix)
+}
+
+// split `r` around the internal keys, user keys may sort after them
+func userRanges(r *util.Range) []*util.Range {
+	internal := util.BytesPrefix(internalPrefix)
+	var ranges []*util.Range
+	if bytes.Compare(r.Start, internal.Start) < 0 {
+		limit := r.Limit
+		if limit == nil || bytes.Compare(limit, internal.Start) > 0 {
+			limit = internal.Start
+		}
+		ranges = append(ranges, &util.Range{Start: r.Start, Limit: limit})
+	}
+	if r.Limit == nil || bytes.Compare(r.Limit, internal.Limit) > 0 {
+		start := r.Start
+		if bytes.Compare(start, internal.Limit) < 0 {
+			start = internal.Limit
+		}
+		ranges = append(ranges, &util.Range{Start: start, Limit: r.Limit})
+	}
+	return ranges
+}
+
+// iterate the user keys of `r` in order
+func userIterator(db *leveldb.DB, r *util.Range) iterator.Iterator {
+	ranges := userRanges(r)
+	iters := make([]iterator.Iterator, len(ranges))
+	for i, userRange := range ranges {
+		iters[i] = db.NewIterator(userRange, nil)
+	}
+	return iterator.NewMergedIterator(iters, comparer.DefaultComparer, true)
+}
+
+func checkKey(key []byte) error {
+	if isInternal(key) {
+		return rpc.ErrReservedKey
+	}
+	return nil
+}
+
+func encodeValue(value []byte, expire time.Time) []byte {
+	size := envelopeHeader + len(value)
+	if !expire.IsZero() {
+		size += 8
+	}
+	buf := make([]byte, size)
+	n := copy(buf, envelopeMagic)
+	buf[n] = envelopeVersion
+	buf[n + 1] = envelopePlain
+	if !expire.IsZero() {
+		buf[n + 1] = envelopeTTL
+		binary.BigEndian.PutUint64(buf[envelopeHeader:], uint64(expire.UnixNano()))
+	}
+	copy(buf[size - len(value):], value)
+	return buf
+}
+
+// return the value and its expiry, zero if it never expires
+func decodeValue(raw []byte) ([]byte, time.Time, error) {
+	if len(raw) < envelopeHeader || !bytes.HasPrefix(raw, envelopeMagic) || raw[len(envelopeMagic)] != envelopeVersion {
+		return raw, time.Time{}, nil
+	}
+	rest := raw[envelopeHeader:]
+	switch raw[envelopeHeader - 1] {
+	case envelopePlain:
+		return rest, time.Time{}, nil
+	case envelopeTTL:
+		if len(rest) < 8 {
+			return nil, time.Time{}, errCorruptValue
+		}
+		expire := time.Unix(0, int64(binary.BigEndian.Uint64(rest[:8])))
+		return rest[8:], expire, nil
+	}
+	return nil, time.Time{}, errCorruptValue
+}
+
+func expired(expire time.Time, now time.Time) bool {
+	return !expire.IsZero() && !now.Before(expire)
+}
+
+// absolute expiry of a pair, a relative ttl counts from `received`
+func expireOf(kv *args.KVArgs, received time.Time) time.Time {
+	if kv.ExpireAt != 0 {
+		return time.Unix(0, kv.ExpireAt)
+	}
+	if kv.TTL > 0 {
+		return received.Add(kv.TTL)
+	}
+	return time.Time{}
+}
+
+func ttlIndexKey(expire time.Time, key []byte) []byte {
+	buf := make([]byte, len(ttlPrefix) + 8 + len(key))
+	n := copy(buf, ttlPrefix)
+	binary.BigEndian.PutUint64(buf[n:], uint64(expire.UnixNano()))
+	copy(buf[n + 8:], key)
+	return buf
+}
+
+func parseTTLIndexKey(indexKey []byte) (time.Time, []byte) {
+	rest := indexKey[len(ttlPrefix):]
+	return time.Unix(0, int64(binary.BigEndian.Uint64(rest[:8]))), rest[8:]
+}
+
+// add a put of `key` to the batch, indexing its expiry if any
+func putValue(batch *leveldb.Batch, key []byte, value []byte, expire time.Time) {
+	batch.Put(key, encodeValue(value, expire))
+	if !expire.IsZero() {
+		batch.Put(ttlIndexKey(expire, key), nil)
+	}
+}
+
+// both the database and its snapshots
+type reader interface {
+	Get(key []byte, ro *lopt.ReadOptions) ([]byte, error)
+}
+
+// read a live value, expired ones are reported as not found
+func getValue(r reader, key []byte, now time.Time) ([]byte, error) {
+	raw, err := r.Get(key, nil)
+	if err != nil {
+		return nil, err
+	}
+	value, expire, err := decodeValue(raw)
+	if err != nil {
+		return nil, err
+	}
+	if expired(expire, now) {
+		return nil, leveldb.ErrNotFound
+	}
+	return value, nil
+}
+
+// Delete expired keys in the background until `StopSweeper`.
+// Reads already hide expired keys, sweeping only frees the space.
+func (n *Node) StartSweeper() {
+	n.stopSweep = make(chan struct{})
+	n.sweepDone = make(chan struct{})
+	go func() {
+		defer close(n.sweepDone)
+		ticker := time.NewTicker(n.options.GetSweepInterval())
+		defer ticker.Stop()
+		// pause between batches to stay under the sweep rate
+		pause := time.Duration(opt.DefaultSweepBatchSize) * time.Second / opt.DefaultSweepRate
+		for {
+			select {
+			case <-n.stopSweep:
+				return
+			case <-ticker.C:
+			}
+			for {
+				count, err := n.sweep(time.Now(), opt.DefaultSweepBatchSize)
+				if err != nil {
+					LOG.Error("sweep expired keys: ", err.Error())
+					break
+				}
+				if count < opt.DefaultSweepBatchSize {
+					break
+				}
+				select {
+				case <-n.stopSweep:
+					return
+				case <-time.After(pause):
+				}
+			}
+		}
+	}()
+}
+
+func (n *Node) StopSweeper() {
+	if n.stopSweep == nil {
+		return
+	}
+	close(n.stopSweep)
+	<-n.sweepDone
+	n.stopSweep = nil
+}
+
+// Delete at most `limit` keys expired at `now` in one batch,
+// return the number of index entries handled
+func (n *Node) sweep(now time.Time, limit int) (int, error) {
+	r := &util.Range{Start: ttlPrefix, Limit: ttlIndexKey(now, nil)}
+	iter := n.DB.NewIterator(r, nil)
+	var indexKeys, keys [][]byte
+	for len(indexKeys) < limit && iter.Next() {
+		indexKey := append([]byte(nil), iter.Key()...)
+		_, key := parseTTLIndexKey(indexKey)
+		indexKeys = append(indexKeys, indexKey)
+		keys = append(keys, key)
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return 0, err
+	}
+	count := len(indexKeys)
+	if count == 0 {
+		return 0, nil
+	}
+	// keys must not be written between checking and deleting them
+	unlock := n.locks.lock(keys...)
+	defer unlock()
+
+	batch := new(leveldb.Batch)
+	for _, indexKey := range indexKeys {
+		batch.Delete(indexKey)
+		expire, key := parseTTLIndexKey(indexKey)
+		// the key may have been overwritten or deleted since,
+		// then the index entry is stale and the key is kept
+		raw, err := n.DB.Get(key, nil)
+		if err == leveldb.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return count, err
+		}
+		_, current, err := decodeValue(raw)
+		if err == nil && current.Equal(expire) {
+			batch.Delete(key)
+		}
+	}
+	return count, n.write(batch)
+}
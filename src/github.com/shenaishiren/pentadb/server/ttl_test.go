@@ -0,0 +1,95 @@
+package server
+
+import (
+	"bytes"
+	"time"
+	"testing"
+	"github.com/shenaishiren/pentadb/args"
+	"github.com/shenaishiren/pentadb/rpc"
+)
+
+func TestValueEnvelope(t *testing.T) {
+	expire := time.Unix(0, time.Now().Add(time.Hour).UnixNano())
+	for _, want := range []time.Time{{}, expire} {
+		for _, v := range [][]byte{nil, []byte("v"), []byte("\xfepdb")} {
+			value, got, err := decodeValue(encodeValue(v, want))
+			if err != nil || !bytes.Equal(value, v) || !got.Equal(want) {
+				t.Fatalf("round trip of %q, %v: %q, %v, %v", v, want, value, got, err)
+			}
+		}
+	}
+	// values written before envelopes are plain and never expire
+	for _, raw := range [][]byte{nil, []byte("\x00"), []byte("\x01\x00\x00"), []byte("\xfepdb\x09\x01xx")} {
+		value, got, err := decodeValue(raw)
+		if err != nil || !bytes.Equal(value, raw) || !got.IsZero() {
+			t.Fatalf("legacy %q: %q, %v, %v", raw, value, got, err)
+		}
+	}
+	if _, _, err := decodeValue([]byte("\xfepdb\x01\x01short")); err != errCorruptValue {
+		t.Fatalf("truncated expiry: %v", err)
+	}
+}
+
+func TestExpire(t *testing.T) {
+	n := openTestNode(t)
+	n.DB.Put([]byte("legacy"), []byte("old"), nil)
+	if value, err := getString(n, "legacy"); err != nil || value != "old" {
+		t.Fatalf("legacy = %q, %v", value, err)
+	}
+
+	now := time.Now()
+	n.Put(&args.KVArgs{Key: []byte("a"), Value: []byte("1"), ExpireAt: now.Add(-time.Second).UnixNano()}, nil)
+	n.Put(&args.KVArgs{Key: []byte("b"), Value: []byte("2"), ExpireAt: now.Add(time.Hour).UnixNano()}, nil)
+	// overwritten without expiry, its index entry is stale
+	n.Put(&args.KVArgs{Key: []byte("c"), Value: []byte("3"), ExpireAt: now.Add(-time.Second).UnixNano()}, nil)
+	n.Put(&args.KVArgs{Key: []byte("c"), Value: []byte("4")}, nil)
+	if _, err := getString(n, "a"); err != rpc.ErrNotFound {
+		t.Fatalf("get of an expired key: %v", err)
+	}
+	if value, err := getString(n, "b"); err != nil || value != "2" {
+		t.Fatalf("b = %q, %v", value, err)
+	}
+
+	count, err := n.sweep(now, 10)
+	if err != nil || count != 2 {
+		t.Fatalf("sweep = %d, %v, want 2", count, err)
+	}
+	if _, err := n.DB.Get([]byte("a"), nil); err == nil {
+		t.Fatal("expired key not swept")
+	}
+	if value, err := getString(n, "c"); err != nil || value != "4" {
+		t.Fatalf("c = %q, %v after sweep", value, err)
+	}
+	// the index entries are gone, b is not due yet
+	if count, err := n.sweep(now, 10); err != nil || count != 0 {
+		t.Fatalf("second sweep = %d, %v", count, err)
+	}
+}
+
+func TestKeysAfterInternal(t *testing.T) {
+	n := openTestNode(t)
+	reserved := []byte(args.InternalPrefix + "x")
+	if err := n.Delete(&args.KeyArgs{Key: reserved}, nil); err != rpc.ErrReservedKey {
+		t.Fatalf("delete of a reserved key: %v", err)
+	}
+	if err := n.BatchDelete(&args.KeyArrayArgs{Keys: [][]byte{reserved}}, nil); err != rpc.ErrReservedKey {
+		t.Fatalf("batch delete of a reserved key: %v", err)
+	}
+
+	n.Put(&args.KVArgs{Key: []byte("a"), Value: []byte("1"), TTL: time.Hour}, nil)
+	n.Put(&args.KVArgs{Key: []byte("\xffz"), Value: []byte("2")}, nil)
+	var reply args.ScanReply
+	if err := n.Scan(&args.ScanArgs{}, &reply); err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(reply.KVs) != 2 || string(reply.KVs[1].Key) != "\xffz" {
+		t.Fatalf("scan: %+v", reply.KVs)
+	}
+	reply = args.ScanReply{}
+	if err := n.Scan(&args.ScanArgs{Start: []byte("\xff"), Limit: 1}, &reply); err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(reply.KVs) != 1 || string(reply.KVs[0].Key) != "\xffz" || reply.More {
+		t.Fatalf("scan from \\xff: %+v", reply)
+	}
+}
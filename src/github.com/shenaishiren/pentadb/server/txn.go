@@ -0,0 +1,221 @@
+// Contains the atomic write batches and the two-phase commit of Node
+
+/* BSD 3-Clause License
+
+Copyright (c) 2017, Guan Jiawen, Li Lundong
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice, this
+  list of conditions and the following disclaimer.
+
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+
+* Neither the name of the copyright holder nor the names of its
+  contributors may be used to endorse or promote products derived from
+  this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+
+package server
+
+import (
+	"time"
+	"sync/atomic"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/shenaishiren/pentadb/args"
+	"github.com/shenaishiren/pentadb/rpc"
+)
+
+// A transaction which voted yes and waits for commit or abort.
+// Prepared state lives in memory, a restarted node forgets it.
+type preparedTxn struct {
+	batch *leveldb.Batch
+
+	keys []string
+
+	expire time.Time
+}
+
+func checkOps(ops []args.BatchOp) error {
+	for _, op := range ops {
+		if err := checkKey(op.Key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func opKeys(ops []args.BatchOp) [][]byte {
+	keys := make([][]byte, len(ops))
+	for i, op := range ops {
+		keys[i] = op.Key
+	}
+	return keys
+}
+
+func newBatch(ops []args.BatchOp) *leveldb.Batch {
+	batch := new(leveldb.Batch)
+	for _, op := range ops {
+		switch op.Type {
+		case args.OpPut:
+			putValue(batch, op.Key, op.Value, time.Time{})
+		case args.OpDelete:
+			batch.Delete(op.Key)
+		}
+	}
+	return batch
+}
+
+// Apply puts and deletes in one atomic write
+func (n *Node) Write(args *args.BatchArgs, result *[]byte) error {
+	received := time.Now()
+	unlock := n.locks.lock(opKeys(args.Ops)...)
+	defer unlock()
+
+	if err := checkDeadline(args.Header, received); err != nil {
+		return err
+	}
+	if err := checkOps(args.Ops); err != nil {
+		return err
+	}
+	if err := n.checkTxnLocks(opKeys(args.Ops)...); err != nil {
+		return err
+	}
+	return n.write(newBatch(args.Ops))
+}
+
+// Refuse a plain write to keys of a prepared transaction, its commit
+// would overwrite the write with the batch prepared before. The stripes
+// of the keys must be held, Prepare holds them while locking keys.
+func (n *Node) checkTxnLocks(keys ...[]byte) error {
+	n.txnLockMutex.RLock()
+	defer n.txnLockMutex.RUnlock()
+
+	now := time.Now()
+	for _, key := range keys {
+		// an expired transaction can no longer commit, see Commit
+		if txnID, ok := n.txnLocks[string(key)]; ok && !now.After(n.txns[txnID].expire) {
+			return rpc.ErrBusy
+		}
+	}
+	return nil
+}
+
+// drop the transaction and unlock its keys, txnMutex must be held
+func (n *Node) releaseTxn(txnID string) {
+	n.txnLockMutex.Lock()
+	defer n.txnLockMutex.Unlock()
+
+	txn, ok := n.txns[txnID]
+	if !ok {
+		return
+	}
+	for _, key := range txn.keys {
+		delete(n.txnLocks, key)
+	}
+	delete(n.txns, txnID)
+	atomic.StoreInt64(&n.prepared, int64(len(n.txns)))
+}
+
+// Lock the keys of a transaction and keep its writes until commit.
+// Other transactions get ErrTxnConflict and plain writes ErrBusy
+// for the keys until the transaction commits, aborts or expires.
+func (n *Node) Prepare(args *args.TxnArgs, result *[]byte) error {
+	received := time.Now()
+	n.txnMutex.Lock()
+	defer n.txnMutex.Unlock()
+	// wait for plain writes in flight, see checkTxnLocks
+	unlock := n.locks.lock(opKeys(args.Ops)...)
+	defer unlock()
+	// a frozen node takes no new transactions, see Freeze
+	n.gate.RLock()
+	defer n.gate.RUnlock()
+
+	if err := checkDeadline(args.Header, received); err != nil {
+		return err
+	}
+	if err := checkOps(args.Ops); err != nil {
+		return err
+	}
+	// the coordinator may have died, abort transactions left over
+	for txnID, txn := range n.txns {
+		if received.After(txn.expire) {
+			LOG.Warningf("abort expired transaction %s", txnID)
+			n.releaseTxn(txnID)
+		}
+	}
+	var keys []string
+	for _, op := range args.Ops {
+		key := string(op.Key)
+		if owner, ok := n.txnLocks[key]; ok && owner != args.TxnID {
+			return rpc.ErrTxnConflict
+		}
+		keys = append(keys, key)
+	}
+	n.txnLockMutex.Lock()
+	defer n.txnLockMutex.Unlock()
+	for _, key := range keys {
+		n.txnLocks[key] = args.TxnID
+	}
+	n.txns[args.TxnID] = &preparedTxn{
+		batch:  newBatch(args.Ops),
+		keys:   keys,
+		expire: received.Add(n.options.GetTxnTimeout()),
+	}
+	atomic.StoreInt64(&n.prepared, int64(len(n.txns)))
+	return nil
+}
+
+// Apply the writes of a prepared transaction, one which expired
+// or is unknown fails with ErrTxnNotFound
+func (n *Node) Commit(args *args.TxnArgs, result *[]byte) error {
+	n.txnMutex.Lock()
+	defer n.txnMutex.Unlock()
+
+	txn, ok := n.txns[args.TxnID]
+	if !ok {
+		return rpc.ErrTxnNotFound
+	}
+	keys := make([][]byte, len(txn.keys))
+	for i, key := range txn.keys {
+		keys[i] = []byte(key)
+	}
+	unlock := n.locks.lock(keys...)
+	defer unlock()
+	// plain writes may have changed the keys since it expired
+	if time.Now().After(txn.expire) {
+		LOG.Warningf("abort expired transaction %s", args.TxnID)
+		n.releaseTxn(args.TxnID)
+		return rpc.ErrTxnNotFound
+	}
+	if err := n.write(txn.batch); err != nil {
+		return err
+	}
+	n.releaseTxn(args.TxnID)
+	return nil
+}
+
+// Drop a prepared transaction, unknown ones are ignored
+func (n *Node) Abort(args *args.TxnArgs, result *[]byte) error {
+	n.txnMutex.Lock()
+	defer n.txnMutex.Unlock()
+
+	n.releaseTxn(args.TxnID)
+	return nil
+}
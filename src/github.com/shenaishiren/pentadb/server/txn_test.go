@@ -0,0 +1,107 @@
+package server
+
+import (
+	"time"
+	"testing"
+	"github.com/shenaishiren/pentadb/args"
+	"github.com/shenaishiren/pentadb/rpc"
+)
+
+func putOps(pairs ...string) []args.BatchOp {
+	var ops []args.BatchOp
+	for i := 0; i+1 < len(pairs); i += 2 {
+		ops = append(ops, args.BatchOp{Type: args.OpPut, Key: []byte(pairs[i]), Value: []byte(pairs[i+1])})
+	}
+	return ops
+}
+
+func TestTxnCommit(t *testing.T) {
+	n := openTestNode(t)
+	if err := n.Prepare(&args.TxnArgs{TxnID: "t1", Ops: putOps("a", "1", "b", "2")}, nil); err != nil {
+		t.Fatal(err.Error())
+	}
+	// nothing is visible before commit
+	if _, err := getString(n, "a"); err != rpc.ErrNotFound {
+		t.Fatalf("get before commit: %v", err)
+	}
+	// the keys are locked against other transactions and plain writes
+	if err := n.Prepare(&args.TxnArgs{TxnID: "t2", Ops: putOps("b", "3")}, nil); err != rpc.ErrTxnConflict {
+		t.Fatalf("prepare of a locked key: %v", err)
+	}
+	if err := n.Put(&args.KVArgs{Key: []byte("a"), Value: []byte("x")}, nil); err != rpc.ErrBusy {
+		t.Fatalf("put of a locked key: %v", err)
+	}
+	var result int64
+	if err := n.Incr(&args.IncrArgs{Key: []byte("b"), Delta: 1}, &result); err != rpc.ErrBusy {
+		t.Fatalf("incr of a locked key: %v", err)
+	}
+	if err := n.BatchDelete(&args.KeyArrayArgs{Keys: [][]byte{[]byte("c"), []byte("b")}}, nil); err != rpc.ErrBusy {
+		t.Fatalf("delete of a locked key: %v", err)
+	}
+	if err := n.Put(&args.KVArgs{Key: []byte("c"), Value: []byte("3")}, nil); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if err := n.Commit(&args.TxnArgs{TxnID: "t1"}, nil); err != nil {
+		t.Fatal(err.Error())
+	}
+	for key, want := range map[string]string{"a": "1", "b": "2", "c": "3"} {
+		if value, err := getString(n, key); err != nil || value != want {
+			t.Fatalf("%s = %q, %v, want %q", key, value, err, want)
+		}
+	}
+	// committed transactions unlock their keys and are forgotten
+	if err := n.Put(&args.KVArgs{Key: []byte("a"), Value: []byte("x")}, nil); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := n.Commit(&args.TxnArgs{TxnID: "t1"}, nil); err != rpc.ErrTxnNotFound {
+		t.Fatalf("second commit: %v", err)
+	}
+}
+
+func TestTxnAbort(t *testing.T) {
+	n := openTestNode(t)
+	if err := n.Prepare(&args.TxnArgs{TxnID: "t1", Ops: putOps("a", "1")}, nil); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := n.Abort(&args.TxnArgs{TxnID: "t1"}, nil); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := n.Prepare(&args.TxnArgs{TxnID: "t2", Ops: putOps("a", "2")}, nil); err != nil {
+		t.Fatalf("prepare after abort: %v", err)
+	}
+	if err := n.Commit(&args.TxnArgs{TxnID: "t1"}, nil); err != rpc.ErrTxnNotFound {
+		t.Fatalf("commit after abort: %v", err)
+	}
+	if err := n.Commit(&args.TxnArgs{TxnID: "t2"}, nil); err != nil {
+		t.Fatal(err.Error())
+	}
+	if value, _ := getString(n, "a"); value != "2" {
+		t.Fatalf("a = %q, want 2", value)
+	}
+}
+
+func TestTxnExpire(t *testing.T) {
+	n := openTestNode(t)
+	if err := n.Prepare(&args.TxnArgs{TxnID: "t1", Ops: putOps("a", "1")}, nil); err != nil {
+		t.Fatal(err.Error())
+	}
+	n.txnLockMutex.Lock()
+	n.txns["t1"].expire = time.Now().Add(-time.Second)
+	n.txnLockMutex.Unlock()
+
+	// an expired transaction no longer blocks writes, and must not
+	// overwrite them by committing late
+	if err := n.Put(&args.KVArgs{Key: []byte("a"), Value: []byte("x")}, nil); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := n.Commit(&args.TxnArgs{TxnID: "t1"}, nil); err != rpc.ErrTxnNotFound {
+		t.Fatalf("commit of an expired transaction: %v", err)
+	}
+	if value, _ := getString(n, "a"); value != "x" {
+		t.Fatalf("a = %q, want x", value)
+	}
+	if len(n.txns) != 0 || len(n.txnLocks) != 0 {
+		t.Fatalf("expired transaction kept: %v %v", n.txns, n.txnLocks)
+	}
+}
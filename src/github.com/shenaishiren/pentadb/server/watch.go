@@ -0,0 +1,87 @@
+// Contains the change notification of Node
+
+/* BSD 3-Clause License
+
+Copyright (c) 2017, Guan Jiawen, Li Lundong
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+* Redistributions of source code must retain the above copyright notice, this
+  list of conditions and the following disclaimer.
+
+* Redistributions in binary form must reproduce the above copyright notice,
+  this list of conditions and the following disclaimer in the documentation
+  and/or other materials provided with the distribution.
+
+* Neither the name of the copyright holder nor the names of its
+  contributors may be used to endorse or promote products derived from
+  this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+
+package server
+
+import (
+	"time"
+	"github.com/shenaishiren/pentadb/args"
+	"github.com/shenaishiren/pentadb/opt"
+)
+
+// Return the changes of keys with a prefix after a revision, waiting
+// for them if there is none yet. Keys moved in from other nodes show
+// up as puts, expired keys as deletes once they are swept.
+func (n *Node) Watch(watchArgs *args.WatchArgs, reply *args.WatchReply) error {
+	received := time.Now()
+	wait := n.options.GetWatchWait()
+	if deadline, ok := watchArgs.Header.Deadline(received); ok && time.Until(deadline) < wait {
+		// answer a bit before the client stops waiting
+		wait = time.Until(deadline) * 9 / 10
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	for {
+		if watchArgs.After < 0 {
+			n.changes.mu.Lock()
+			reply.Revision = n.changes.last
+			n.changes.mu.Unlock()
+			return nil
+		}
+		events, seen, notify, err := n.changesSince(watchArgs.Prefix, watchArgs.After, opt.DefaultWatchBatchSize)
+		if err != nil {
+			return err
+		}
+		if watchArgs.KeysOnly {
+			for i := range events {
+				events[i].Value = nil
+			}
+		}
+		reply.Events, reply.Revision = events, seen
+		if len(events) > 0 {
+			return nil
+		}
+		// skip changes of other prefixes
+		watchArgs.After = seen
+		select {
+		case <-notify:
+		case <-timer.C:
+			return nil
+		case <-n.stopping:
+			// let the node drain, the client asks again
+			return nil
+		}
+	}
+}